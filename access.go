@@ -0,0 +1,154 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "net/http"
+  "strconv"
+  "time"
+
+  "github.com/yugur/api/metrics"
+  "github.com/yugur/api/util"
+)
+
+// Longest request ID accepted from a client or proxy
+const maxRequestID = 64
+
+/*
+  requestIDs gives every request an identifier, kept in its context for
+  logging (see util.Logger) and echoed in the X-Request-ID response header.
+  An identifier sent by the client or a proxy in X-Request-ID is kept so that
+  requests can be followed across services; otherwise one is made up.
+*/
+func requestIDs(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    id := r.Header.Get(util.RequestIDHeader)
+    if !validRequestID(id) {
+      id = util.NewRequestID()
+    }
+    w.Header().Set(util.RequestIDHeader, id)
+    next.ServeHTTP(w, r.WithContext(util.WithRequestID(r.Context(), id)))
+  })
+}
+
+// validRequestID reports whether a request ID from a client is safe to log
+// and repeat: short, and made of letters, digits, '-', '_' and '.'.
+func validRequestID(id string) bool {
+  if id == "" || len(id) > maxRequestID {
+    return false
+  }
+  for _, c := range id {
+    switch {
+    case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+    case c == '-', c == '_', c == '.':
+    default:
+      return false
+    }
+  }
+  return true
+}
+
+// accessLog logs every request once it has been served, with its status,
+// size and how long it took. It must be wrapped by requestIDs.
+func accessLog(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+    rec := &responseRecorder{ResponseWriter: w}
+    next.ServeHTTP(rec, r)
+
+    util.Logger(r.Context()).Info("request",
+      "method", r.Method,
+      "path", r.URL.Path,
+      "query", r.URL.RawQuery,
+      "status", rec.Status(),
+      "bytes", rec.size,
+      "duration_ms", float64(time.Since(start).Microseconds())/1000,
+      "remote", r.RemoteAddr,
+      "user_agent", r.UserAgent(),
+    )
+  })
+}
+
+// Methods given their own series in the request metrics, others are counted
+// together as "OTHER"
+var meteredMethods = map[string]bool{
+  http.MethodGet:     true,
+  http.MethodHead:    true,
+  http.MethodPost:    true,
+  http.MethodPut:     true,
+  http.MethodDelete:  true,
+  http.MethodOptions: true,
+}
+
+/*
+  meter records the requests served by next in metrics.Requests and
+  metrics.RequestDuration. Requests are labelled with the pattern of the
+  endpoint in mux they are routed to, rather than their path, so that
+  requests for unknown paths can't make up new series.
+*/
+func meter(mux *http.ServeMux, next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+    rec := &responseRecorder{ResponseWriter: w}
+    next.ServeHTTP(rec, r)
+
+    endpoint := "unknown"
+    if _, pattern := mux.Handler(r); pattern != "" {
+      endpoint = pattern
+    }
+    method := r.Method
+    if !meteredMethods[method] {
+      method = "OTHER"
+    }
+    status := strconv.Itoa(rec.Status())
+    metrics.Requests.WithLabelValues(endpoint, method, status).Inc()
+    metrics.Since(metrics.RequestDuration.WithLabelValues(endpoint, method, status), start)
+  })
+}
+
+// responseRecorder notes the status and size of a response as it is written.
+type responseRecorder struct {
+  http.ResponseWriter
+  status int
+  size   int64
+}
+
+// Status returns the status of the response, which is 200 OK if the handler
+// didn't set one.
+func (rec *responseRecorder) Status() int {
+  if rec.status == 0 {
+    return http.StatusOK
+  }
+  return rec.status
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+  if rec.status == 0 {
+    rec.status = status
+  }
+  rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+  if rec.status == 0 {
+    rec.status = http.StatusOK
+  }
+  n, err := rec.ResponseWriter.Write(b)
+  rec.size += int64(n)
+  return n, err
+}
+
+// Flush lets streaming handlers, such as exportHandler, flush through the
+// recorder.
+func (rec *responseRecorder) Flush() {
+  if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+// Unwrap gives http.ResponseController the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+  return rec.ResponseWriter
+}
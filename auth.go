@@ -0,0 +1,267 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "net/http"
+  "strings"
+  "time"
+
+  "github.com/yugur/api/crypto"
+  "github.com/yugur/api/util"
+)
+
+// API keys start with this prefix so that they can be told apart from access
+// tokens in an Authorization header.
+const apiKeyPrefix = "yk_"
+
+// Roles of users, in increasing order of privilege. Each role may do
+// everything the roles before it may.
+const (
+  roleViewer      = "viewer"
+  roleContributor = "contributor"
+  roleEditor      = "editor"
+  roleAdmin       = "admin"
+)
+
+var roleRank = map[string]int{
+  roleViewer:      1,
+  roleContributor: 2,
+  roleEditor:      3,
+  roleAdmin:       4,
+}
+
+// contextKey is the type of keys for values stored in a request context.
+type contextKey int
+
+const userKey contextKey = iota
+
+// tokenResponse is the body returned when tokens are issued.
+type tokenResponse struct {
+  AccessToken  string `json:"access_token"`
+  TokenType    string `json:"token_type"`
+  ExpiresIn    int    `json:"expires_in"`
+  RefreshToken string `json:"refresh_token"`
+}
+
+/*
+  authenticate resolves the user making a request and stores them in the
+  request context, see currentUser. Users are identified by either an
+  'Authorization: Bearer' header, holding an access token or API key, or the
+  session cookie set by loginHandler. Requests with neither are anonymous.
+  A bearer token that isn't valid is rejected with 401 Unauthorized rather
+  than treated as anonymous so that clients know to refresh it.
+*/
+func authenticate(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    var user *User
+
+    if header := r.Header.Get("Authorization"); header != "" {
+      token := strings.TrimPrefix(header, "Bearer ")
+      if token == header || token == "" {
+        authError(w, r, "invalid_request", "expected a Bearer token")
+        return
+      }
+
+      var err error
+      user, err = bearerUser(token)
+      if err != nil {
+        authError(w, r, "invalid_token", err.Error())
+        return
+      }
+    } else if session, err := sessionStore.Get(r, "uid"); err == nil {
+      if uid, ok := session.Values["uid"].(string); ok {
+        user, _ = data.UserByID(uid)
+      }
+    }
+
+    if user != nil {
+      r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+// accessRules maps the path and method of each protected endpoint to the role
+// required to use it. Anything not listed is open to anonymous users.
+func accessRules() map[string]map[string]string {
+  e := conf.Endpoints
+  return map[string]map[string]string{
+    e.Entry.Path: {
+      http.MethodPost:   roleEditor,
+      http.MethodPut:    roleEditor,
+      http.MethodDelete: roleEditor,
+    },
+    e.Tag.Path: {
+      http.MethodPost:   roleContributor,
+      http.MethodDelete: roleContributor,
+    },
+    e.Audio.Path: {
+      http.MethodPost:   roleContributor,
+      http.MethodDelete: roleEditor,
+    },
+    e.Relation.Path: {
+      http.MethodPost:   roleContributor,
+      http.MethodDelete: roleEditor,
+    },
+    e.History.Path: {
+      http.MethodPost: roleEditor,
+    },
+    e.Proposal.Path: {
+      http.MethodGet:  roleContributor,
+      http.MethodPost: roleContributor,
+      http.MethodPut:  roleContributor,
+    },
+    e.Review.Path: {
+      http.MethodPost: roleEditor,
+    },
+    e.Import.Path: {
+      http.MethodPost: roleEditor,
+    },
+    e.Bundle.Path: {
+      http.MethodPost: roleEditor,
+    },
+    e.Keys.Path: {
+      http.MethodGet:    roleViewer,
+      http.MethodPost:   roleViewer,
+      http.MethodDelete: roleViewer,
+    },
+    e.Role.Path: {
+      http.MethodGet: roleViewer,
+      http.MethodPut: roleAdmin,
+    },
+  }
+}
+
+/*
+  authorize rejects requests from users without the role required by rules
+  for the path and method requested. It must be wrapped by authenticate.
+  Anonymous users are refused with 401 Unauthorized and users whose role is
+  too low with 403 Forbidden.
+*/
+func authorize(rules map[string]map[string]string, next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    required, ok := rules[r.URL.Path][r.Method]
+    if !ok {
+      next.ServeHTTP(w, r)
+      return
+    }
+
+    user := currentUser(r)
+    if user == nil {
+      authError(w, r, "invalid_token", "authentication required")
+      return
+    }
+    if !hasRole(user, required) {
+      util.WriteProblem(w, r, util.Forbidden("requires the "+required+" role"))
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
+
+// hasRole reports whether the user has the given role or a greater one.
+func hasRole(user *User, role string) bool {
+  return roleRank[user.Role] >= roleRank[role]
+}
+
+// currentUser returns the user making a request, or nil if it is anonymous.
+func currentUser(r *http.Request) *User {
+  user, _ := r.Context().Value(userKey).(*User)
+  return user
+}
+
+// authorID returns the uid of the user making a request, or "" if it is
+// anonymous, for recording who made a change.
+func authorID(r *http.Request) string {
+  if user := currentUser(r); user != nil {
+    return user.UID
+  }
+  return ""
+}
+
+// bearerUser returns the user identified by an access token or API key.
+func bearerUser(token string) (*User, error) {
+  if strings.HasPrefix(token, apiKeyPrefix) {
+    user, err := data.APIKeyUser(crypto.HashToken(token))
+    if err == sql.ErrNoRows {
+      return nil, crypto.ErrInvalidToken
+    }
+    return user, err
+  }
+
+  claims, err := crypto.Verify(token, tokenKey(), time.Now())
+  if err != nil {
+    return nil, err
+  }
+  user, err := data.UserByID(claims.Subject)
+  if err == sql.ErrNoRows {
+    return nil, crypto.ErrInvalidToken
+  }
+  return user, err
+}
+
+// issueTokens creates a new access token and refresh token for a user.
+func issueTokens(user *User) (*tokenResponse, error) {
+  now := time.Now()
+  access, err := crypto.Sign(crypto.Claims{
+    Subject:   user.UID,
+    IssuedAt:  now.Unix(),
+    ExpiresAt: now.Add(time.Duration(conf.Auth.AccessTokenTTL) * time.Second).Unix(),
+  }, tokenKey())
+  if err != nil {
+    return nil, err
+  }
+
+  refresh, err := crypto.Token(32)
+  if err != nil {
+    return nil, err
+  }
+  expires := now.Add(time.Duration(conf.Auth.RefreshTokenTTL) * time.Second)
+  if err := data.InsertRefreshToken(crypto.HashToken(refresh), user.UID, expires); err != nil {
+    return nil, err
+  }
+
+  return &tokenResponse{
+    AccessToken:  access,
+    TokenType:    "Bearer",
+    ExpiresIn:    conf.Auth.AccessTokenTTL,
+    RefreshToken: refresh,
+  }, nil
+}
+
+// tokenKey returns the key access tokens are signed with.
+func tokenKey() []byte {
+  if conf.Auth.TokenKey != "" {
+    return []byte(conf.Auth.TokenKey)
+  }
+  return []byte(conf.Keystore)
+}
+
+// authError refuses a request that isn't authenticated with 401 Unauthorized,
+// challenging the client for a Bearer token. The OAuth error code, see RFC
+// 6750 section 3.1, is only given in the challenge.
+func authError(w http.ResponseWriter, r *http.Request, code, description string) {
+  w.Header().Set("WWW-Authenticate", `Bearer error="`+code+`"`)
+  util.WriteProblem(w, r, util.Unauthorized(description))
+}
+
+// tokenError writes an OAuth 2.0 error response from the token endpoint,
+// see RFC 6749 section 5.2.
+func tokenError(w http.ResponseWriter, r *http.Request, code, description string) {
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Cache-Control", "no-store")
+  w.WriteHeader(http.StatusBadRequest)
+  err := json.NewEncoder(w).Encode(map[string]string{
+    "error":             code,
+    "error_description": description,
+  })
+  if err != nil {
+    util.Logger(r.Context()).Error("writing token error failed", "error", err)
+  }
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// blob provides storage for binary files such as audio clips.
+package blob
+
+import (
+  "bytes"
+  "errors"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+// ErrNotFound is raised when there is no blob with the requested key.
+var ErrNotFound = errors.New("blob not found")
+
+// ErrBadKey is raised for keys which could escape the store, e.g. "../x".
+var ErrBadKey = errors.New("invalid blob key")
+
+// Store is implemented by anything that can hold blobs by key.
+type Store interface {
+  // Put writes the contents of r under key, replacing any existing blob.
+  Put(key string, r io.Reader) (int64, error)
+  // Open returns the blob under key along with when it was last modified.
+  Open(key string) (io.ReadSeekCloser, time.Time, error)
+  Delete(key string) error
+}
+
+func validKey(key string) bool {
+  return key != "" && !strings.ContainsAny(key, `/\`) && key != "." && key != ".."
+}
+
+//---------------------------------------------------------
+//---- Disk
+//---------------------------------------------------------
+
+// Disk stores blobs as files in a single directory.
+type Disk struct {
+  Root string
+}
+
+// NewDisk returns a Disk store rooted at dir, creating it if required.
+func NewDisk(dir string) (*Disk, error) {
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return nil, err
+  }
+  return &Disk{Root: dir}, nil
+}
+
+func (s *Disk) Put(key string, r io.Reader) (int64, error) {
+  if !validKey(key) {
+    return 0, ErrBadKey
+  }
+
+  // Write to a temporary file first so that readers never see half a blob
+  tmp, err := os.CreateTemp(s.Root, ".upload-*")
+  if err != nil {
+    return 0, err
+  }
+  defer os.Remove(tmp.Name())
+
+  n, err := io.Copy(tmp, r)
+  if err != nil {
+    tmp.Close()
+    return n, err
+  }
+  if err := tmp.Close(); err != nil {
+    return n, err
+  }
+  return n, os.Rename(tmp.Name(), filepath.Join(s.Root, key))
+}
+
+func (s *Disk) Open(key string) (io.ReadSeekCloser, time.Time, error) {
+  if !validKey(key) {
+    return nil, time.Time{}, ErrBadKey
+  }
+
+  f, err := os.Open(filepath.Join(s.Root, key))
+  if os.IsNotExist(err) {
+    return nil, time.Time{}, ErrNotFound
+  } else if err != nil {
+    return nil, time.Time{}, err
+  }
+
+  info, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return nil, time.Time{}, err
+  }
+  return f, info.ModTime(), nil
+}
+
+func (s *Disk) Delete(key string) error {
+  if !validKey(key) {
+    return ErrBadKey
+  }
+
+  err := os.Remove(filepath.Join(s.Root, key))
+  if os.IsNotExist(err) {
+    return ErrNotFound
+  }
+  return err
+}
+
+//---------------------------------------------------------
+//---- Memory
+//---------------------------------------------------------
+
+// Memory keeps blobs in memory. It is intended for tests.
+type Memory struct {
+  mu    sync.RWMutex
+  blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+  data     []byte
+  modified time.Time
+}
+
+func NewMemory() *Memory {
+  return &Memory{blobs: make(map[string]memoryBlob)}
+}
+
+func (s *Memory) Put(key string, r io.Reader) (int64, error) {
+  if !validKey(key) {
+    return 0, ErrBadKey
+  }
+
+  b, err := io.ReadAll(r)
+  if err != nil {
+    return int64(len(b)), err
+  }
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.blobs[key] = memoryBlob{b, time.Now()}
+  return int64(len(b)), nil
+}
+
+func (s *Memory) Open(key string) (io.ReadSeekCloser, time.Time, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  b, ok := s.blobs[key]
+  if !ok {
+    return nil, time.Time{}, ErrNotFound
+  }
+  return nopCloser{bytes.NewReader(b.data)}, b.modified, nil
+}
+
+func (s *Memory) Delete(key string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if _, ok := s.blobs[key]; !ok {
+    return ErrNotFound
+  }
+  delete(s.blobs, key)
+  return nil
+}
+
+type nopCloser struct {
+  io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
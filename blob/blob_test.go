@@ -0,0 +1,55 @@
+package blob
+
+import (
+  "io"
+  "strings"
+  "testing"
+)
+
+func testStore(t *testing.T, name string, s Store) {
+  if _, err := s.Put("clip.ogg", strings.NewReader("first")); err != nil {
+    t.Fatalf("%s: Put failed: %v", name, err)
+  }
+  if _, err := s.Put("clip.ogg", strings.NewReader("second")); err != nil {
+    t.Fatalf("%s: Put failed to replace a blob: %v", name, err)
+  }
+
+  r, _, err := s.Open("clip.ogg")
+  if err != nil {
+    t.Fatalf("%s: Open failed: %v", name, err)
+  }
+  r.Seek(3, io.SeekStart)
+  b, _ := io.ReadAll(r)
+  r.Close()
+  if string(b) != "ond" {
+    t.Errorf("%s: Wrong contents after seeking. Expected: %q, got: %q.", name, "ond", b)
+  }
+
+  if err := s.Delete("clip.ogg"); err != nil {
+    t.Errorf("%s: Delete failed: %v", name, err)
+  }
+  if _, _, err := s.Open("clip.ogg"); err != ErrNotFound {
+    t.Errorf("%s: Expected: ErrNotFound after delete, got: %v", name, err)
+  }
+  if err := s.Delete("clip.ogg"); err != ErrNotFound {
+    t.Errorf("%s: Expected: ErrNotFound deleting twice, got: %v", name, err)
+  }
+
+  for _, key := range []string{"", "..", "../clip.ogg", "a/b"} {
+    if _, err := s.Put(key, strings.NewReader("x")); err != ErrBadKey {
+      t.Errorf("%s: Expected: ErrBadKey for key %q, got: %v", name, key, err)
+    }
+  }
+}
+
+func TestDisk(t *testing.T) {
+  s, err := NewDisk(t.TempDir())
+  if err != nil {
+    t.Fatal(err)
+  }
+  testStore(t, "Disk", s)
+}
+
+func TestMemory(t *testing.T) {
+  testStore(t, "Memory", NewMemory())
+}
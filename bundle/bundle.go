@@ -0,0 +1,192 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// bundle writes dictionaries in formats read by offline dictionary programs:
+// StarDict (GoldenDict, ColorDict and others) and dictd.
+package bundle
+
+import (
+  "bytes"
+  "fmt"
+  "sort"
+  "strings"
+  "time"
+)
+
+// Word is a headword and its definition as plain text.
+type Word struct {
+  Headword   string
+  Definition string
+}
+
+// Info describes a dictionary.
+type Info struct {
+  Name        string
+  Description string
+  Date        time.Time
+}
+
+// File is a file making up a dictionary.
+type File struct {
+  Name string
+  Data []byte
+}
+
+// StarDict's index can't hold longer headwords
+const maxStarDictWord = 255
+
+/*
+  StarDict returns the .ifo, .idx and .dict files of a StarDict dictionary
+  named base. Definitions are stored as plain text. Headwords longer than
+  StarDict allows are left out.
+*/
+func StarDict(base string, words []Word, info Info) []File {
+  words = sortedWords(words, starDictLess)
+
+  var idx, dict bytes.Buffer
+  count := 0
+  for _, w := range words {
+    if len(w.Headword) > maxStarDictWord || w.Headword == "" {
+      continue
+    }
+    // Each index entry is the headword, a NUL and the big endian offset and
+    // size of its definition
+    offset, size := dict.Len(), len(w.Definition)
+    idx.WriteString(w.Headword)
+    idx.Write([]byte{0,
+      byte(offset >> 24), byte(offset >> 16), byte(offset >> 8), byte(offset),
+      byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)})
+    dict.WriteString(w.Definition)
+    count++
+  }
+
+  var ifo bytes.Buffer
+  ifo.WriteString("StarDict's dict ifo file\n")
+  ifo.WriteString("version=2.4.2\n")
+  fmt.Fprintf(&ifo, "bookname=%s\n", oneLine(info.Name))
+  fmt.Fprintf(&ifo, "wordcount=%d\n", count)
+  fmt.Fprintf(&ifo, "idxfilesize=%d\n", idx.Len())
+  if info.Description != "" {
+    fmt.Fprintf(&ifo, "description=%s\n", oneLine(info.Description))
+  }
+  if !info.Date.IsZero() {
+    fmt.Fprintf(&ifo, "date=%s\n", info.Date.Format("2006.01.02"))
+  }
+  ifo.WriteString("sametypesequence=m\n")
+
+  return []File{
+    {base + ".ifo", ifo.Bytes()},
+    {base + ".idx", idx.Bytes()},
+    {base + ".dict", dict.Bytes()},
+  }
+}
+
+// starDictLess orders headwords as StarDict expects: ignoring ASCII case,
+// with ties broken by byte order.
+func starDictLess(a, b string) bool {
+  if c := asciiFoldCompare(a, b); c != 0 {
+    return c < 0
+  }
+  return a < b
+}
+
+// asciiFoldCompare compares strings as g_ascii_strcasecmp does.
+func asciiFoldCompare(a, b string) int {
+  for i := 0; i < len(a) && i < len(b); i++ {
+    x, y := asciiLower(a[i]), asciiLower(b[i])
+    if x != y {
+      return int(x) - int(y)
+    }
+  }
+  return len(a) - len(b)
+}
+
+func asciiLower(c byte) byte {
+  if 'A' <= c && c <= 'Z' {
+    return c + 'a' - 'A'
+  }
+  return c
+}
+
+/*
+  Dictd returns the .index and .dict files of a dictd dictionary named base.
+  Like dictfmt with --utf8 and --allchars, the index is sorted by lowercased
+  headword and starts with the 00-database-* entries describing the
+  dictionary. The .dict file may be compressed with dictzip but needn't be.
+*/
+func Dictd(base string, words []Word, info Info) []File {
+  headers := []Word{
+    {"00-database-allchars", ""},
+    {"00-database-info", info.Description},
+    {"00-database-short", info.Name},
+    {"00-database-utf8", ""},
+  }
+
+  var index, dict bytes.Buffer
+  add := func(w Word, body string) {
+    offset := dict.Len()
+    dict.WriteString(body)
+    fmt.Fprintf(&index, "%s\t%s\t%s\n", w.Headword, dictdNumber(offset), dictdNumber(dict.Len()-offset))
+  }
+  for _, w := range headers {
+    add(w, w.Headword+"\n"+indent(w.Definition))
+  }
+  for _, w := range sortedWords(words, dictdLess) {
+    if w.Headword == "" || strings.ContainsAny(w.Headword, "\t\n") {
+      continue
+    }
+    add(w, w.Headword+"\n"+indent(w.Definition)+"\n")
+  }
+
+  return []File{
+    {base + ".index", index.Bytes()},
+    {base + ".dict", dict.Bytes()},
+  }
+}
+
+func dictdLess(a, b string) bool {
+  x, y := strings.ToLower(a), strings.ToLower(b)
+  if x != y {
+    return x < y
+  }
+  return a < b
+}
+
+// Digits of numbers in a dictd index
+const dictdDigits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// dictdNumber writes n in base 64 as dictd indexes do, most significant digit
+// first.
+func dictdNumber(n int) string {
+  if n == 0 {
+    return dictdDigits[:1]
+  }
+  var digits []byte
+  for ; n > 0; n /= 64 {
+    digits = append([]byte{dictdDigits[n%64]}, digits...)
+  }
+  return string(digits)
+}
+
+// indent indents each line of a definition, as dictd clients expect.
+func indent(s string) string {
+  if s == "" {
+    return ""
+  }
+  lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+  return "  " + strings.Join(lines, "\n  ") + "\n"
+}
+
+func oneLine(s string) string {
+  return strings.Join(strings.Fields(s), " ")
+}
+
+func sortedWords(words []Word, less func(a, b string) bool) []Word {
+  sorted := make([]Word, len(words))
+  copy(sorted, words)
+  sort.SliceStable(sorted, func(i, j int) bool {
+    return less(sorted[i].Headword, sorted[j].Headword)
+  })
+  return sorted
+}
@@ -0,0 +1,108 @@
+package bundle
+
+import (
+  "bytes"
+  "encoding/binary"
+  "strings"
+  "testing"
+  "time"
+)
+
+var words = []Word{
+  {"zeal", "great energy or enthusiasm"},
+  {"Fire", "burning intensity of feeling"},
+  {"fire", "burning fuel"},
+  {"ot", "fire\ngrass"},
+}
+
+func TestStarDict(t *testing.T) {
+  files := StarDict("yugur", words, Info{Name: "Yugur", Date: time.Date(2017, 9, 20, 0, 0, 0, 0, time.UTC)})
+  if len(files) != 3 || files[0].Name != "yugur.ifo" || files[1].Name != "yugur.idx" || files[2].Name != "yugur.dict" {
+    t.Fatalf("Expected: yugur.ifo, .idx and .dict, got: %v", files)
+  }
+  ifo, idx, dict := string(files[0].Data), files[1].Data, files[2].Data
+
+  for _, line := range []string{"bookname=Yugur", "wordcount=4", "date=2017.09.20", "sametypesequence=m"} {
+    if !strings.Contains(ifo, line+"\n") {
+      t.Errorf("Expected: %q in the .ifo, got: %q", line, ifo)
+    }
+  }
+
+  // Case is ignored when sorting, then ties are broken by bytes
+  expected := []string{"Fire", "fire", "ot", "zeal"}
+  for _, headword := range expected {
+    i := bytes.IndexByte(idx, 0)
+    if i < 0 || string(idx[:i]) != headword {
+      t.Fatalf("Expected: %q next in the index, got: %q", headword, idx)
+    }
+    offset := binary.BigEndian.Uint32(idx[i+1:])
+    size := binary.BigEndian.Uint32(idx[i+5:])
+    idx = idx[i+9:]
+
+    definition := string(dict[offset : offset+size])
+    found := false
+    for _, w := range words {
+      found = found || (w.Headword == headword && w.Definition == definition)
+    }
+    if !found {
+      t.Errorf("Wrong definition for %q: %q", headword, definition)
+    }
+  }
+  if len(idx) != 0 {
+    t.Errorf("Unexpected index data: %q", idx)
+  }
+}
+
+func TestDictdNumber(t *testing.T) {
+  tables := []struct {
+    n int
+    s string
+  }{
+    {0, "A"},
+    {1, "B"},
+    {63, "/"},
+    {64, "BA"},
+    {4096 + 2*64 + 3, "BCD"},
+  }
+
+  for _, table := range tables {
+    if s := dictdNumber(table.n); s != table.s {
+      t.Errorf("dictdNumber(%d) was incorrect. Expected: %q, got: %q.", table.n, table.s, s)
+    }
+  }
+}
+
+func TestDictd(t *testing.T) {
+  files := Dictd("yugur", words, Info{Name: "Yugur", Description: "A test dictionary"})
+  if len(files) != 2 || files[0].Name != "yugur.index" || files[1].Name != "yugur.dict" {
+    t.Fatalf("Expected: yugur.index and .dict, got: %v", files)
+  }
+  index, dict := string(files[0].Data), files[1].Data
+
+  lines := strings.Split(strings.TrimSuffix(index, "\n"), "\n")
+  expected := []string{"00-database-allchars", "00-database-info", "00-database-short", "00-database-utf8", "Fire", "fire", "ot", "zeal"}
+  if len(lines) != len(expected) {
+    t.Fatalf("Expected: %d index lines, got: %q", len(expected), lines)
+  }
+  for i, line := range lines {
+    fields := strings.Split(line, "\t")
+    if len(fields) != 3 || fields[0] != expected[i] {
+      t.Fatalf("Expected: %q on line %d, got: %q", expected[i], i+1, line)
+    }
+    offset, size := decodeDictdNumber(fields[1]), decodeDictdNumber(fields[2])
+    if body := string(dict[offset : offset+size]); !strings.HasPrefix(body, fields[0]+"\n") {
+      t.Errorf("Expected: the entry for %q, got: %q", fields[0], body)
+    }
+  }
+  if !bytes.Contains(dict, []byte("ot\n  fire\n  grass\n")) {
+    t.Errorf("Expected: definitions to be indented, got: %q", dict)
+  }
+}
+
+func decodeDictdNumber(s string) int {
+  n := 0
+  for _, c := range s {
+    n = n*64 + strings.IndexRune(dictdDigits, c)
+  }
+  return n
+}
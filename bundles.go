@@ -0,0 +1,241 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "bytes"
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/yugur/api/blob"
+  "github.com/yugur/api/bundle"
+  d "github.com/yugur/api/entry"
+)
+
+// Formats of offline bundles
+const (
+  bundleStarDict = "stardict"
+  bundleDictd    = "dictd"
+)
+
+// Bundles are generated one at a time so that two generations of the same
+// language pair can't race to the same version.
+var bundleMu sync.Mutex
+
+// bundleManifest describes the offline bundles of a language pair. Clients
+// poll it and download the files again when the version changes.
+type bundleManifest struct {
+  HeadwordLanguage   string       `json:"hw_lang"`
+  DefinitionLanguage string       `json:"def_lang"`
+  Version            int          `json:"version"`
+  Generated          time.Time    `json:"generated"`
+  Entries            int          `json:"entries"`
+  // SHA-256 of the content of the bundle, used to tell whether it changed
+  Checksum           string       `json:"checksum"`
+  Files              []bundleFile `json:"files"`
+}
+
+// bundleFile is one file of a bundle, stored as a blob under Key.
+type bundleFile struct {
+  Format string `json:"format"`
+  Name   string `json:"name"`
+  Key    string `json:"key"`
+  URL    string `json:"url"`
+  Size   int64  `json:"size"`
+  SHA256 string `json:"sha256"`
+}
+
+// bundleManifestKey returns the key of the blob holding the manifest of the
+// bundles of a language pair.
+func bundleManifestKey(hw, def string) string {
+  return "bundle." + hw + "." + def + ".json"
+}
+
+// bundleURL returns the URL from which a bundle file can be downloaded.
+func bundleURL(key string) string {
+  return conf.Endpoints.Bundle.Path + "?file=" + url.QueryEscape(key)
+}
+
+// loadBundle returns the manifest of the latest bundles of a language pair,
+// or blob.ErrNotFound if they have never been generated.
+func loadBundle(hw, def string) (*bundleManifest, error) {
+  f, _, err := blobs.Open(bundleManifestKey(hw, def))
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  m := new(bundleManifest)
+  if err := json.NewDecoder(f).Decode(m); err != nil {
+    return nil, err
+  }
+  return m, nil
+}
+
+/*
+  generateBundle builds the StarDict and dictd bundles of the entries from
+  language hw to def. If nothing has changed since the bundles were last
+  generated they are kept as they are; otherwise the new bundles are given
+  the next version and those they replace are deleted. Languages are given
+  by their codes.
+*/
+func generateBundle(hw, def string) (*bundleManifest, error) {
+  bundleMu.Lock()
+  defer bundleMu.Unlock()
+
+  var words []bundle.Word
+  filter := entryFilter{Headword_Language: hw, Definition_Language: def}
+  err := exportEntries(filter, func(e *d.Entry) error {
+    words = append(words, bundle.Word{Headword: e.Headword, Definition: bundleText(e)})
+    return nil
+  }, func() {})
+  if err != nil {
+    return nil, err
+  }
+
+  sum := sha256.New()
+  for _, w := range words {
+    fmt.Fprintf(sum, "%s\x00%s\x00", w.Headword, w.Definition)
+  }
+  checksum := hex.EncodeToString(sum.Sum(nil))
+
+  previous, err := loadBundle(hw, def)
+  if err != nil && err != blob.ErrNotFound {
+    return nil, err
+  }
+  if previous != nil && previous.Checksum == checksum {
+    return previous, nil
+  }
+
+  m := &bundleManifest{
+    HeadwordLanguage:   hw,
+    DefinitionLanguage: def,
+    Version:            1,
+    Generated:          time.Now().UTC(),
+    Entries:            len(words),
+    Checksum:           checksum,
+  }
+  if previous != nil {
+    m.Version = previous.Version + 1
+  }
+
+  base := "yugur-" + hw + "-" + def
+  info := bundle.Info{
+    Name:        "Yugur " + hw + "-" + def,
+    Description: fmt.Sprintf("Yugur dictionary from %s to %s, version %d", hw, def, m.Version),
+    Date:        m.Generated,
+  }
+  formats := []struct {
+    Name  string
+    Files []bundle.File
+  }{
+    {bundleStarDict, bundle.StarDict(base, words, info)},
+    {bundleDictd, bundle.Dictd(base+"-dictd", words, info)},
+  }
+  for _, format := range formats {
+    for _, f := range format.Files {
+      key := "bundle.v" + strconv.Itoa(m.Version) + "." + f.Name
+      size, err := blobs.Put(key, bytes.NewReader(f.Data))
+      if err != nil {
+        return nil, err
+      }
+      hash := sha256.Sum256(f.Data)
+      m.Files = append(m.Files, bundleFile{
+        Format: format.Name,
+        Name:   f.Name,
+        Key:    key,
+        URL:    bundleURL(key),
+        Size:   size,
+        SHA256: hex.EncodeToString(hash[:]),
+      })
+    }
+  }
+
+  manifest, err := json.Marshal(m)
+  if err != nil {
+    return nil, err
+  }
+  if _, err := blobs.Put(bundleManifestKey(hw, def), bytes.NewReader(manifest)); err != nil {
+    return nil, err
+  }
+  if previous != nil {
+    for _, f := range previous.Files {
+      if err := blobs.Delete(f.Key); err != nil && err != blob.ErrNotFound {
+        slog.Warn("failed to remove bundle file", "key", f.Key, "error", err)
+      }
+    }
+  }
+  return m, nil
+}
+
+// bundleText formats an entry as plain text for an offline dictionary.
+func bundleText(e *d.Entry) string {
+  var lines []string
+  var pronunciation []string
+  if e.IPA != "" {
+    pronunciation = append(pronunciation, "/"+e.IPA+"/")
+  }
+  if e.Phonetic != "" {
+    pronunciation = append(pronunciation, e.Phonetic)
+  }
+  if len(pronunciation) > 0 {
+    lines = append(lines, strings.Join(pronunciation, " "))
+  }
+
+  for i, sense := range e.Senses {
+    line := sense.Definition
+    if sense.Wordtype != "" {
+      line = "(" + sense.Wordtype + ") " + line
+    }
+    if len(e.Senses) > 1 {
+      line = strconv.Itoa(i+1) + ". " + line
+    }
+    if len(sense.Labels) > 0 {
+      line += " [" + strings.Join(sense.Labels, ", ") + "]"
+    }
+    lines = append(lines, line)
+    for _, example := range sense.Examples {
+      line := "  " + example.Text
+      if example.Translation != "" {
+        line += " - " + example.Translation
+      }
+      lines = append(lines, line)
+    }
+  }
+
+  if e.Etymology != "" {
+    lines = append(lines, "Etymology: "+e.Etymology)
+  }
+  return strings.Join(lines, "\n")
+}
+
+// scheduleBundles regenerates the bundles of the configured language pairs
+// every interval, starting straight away, until ctx is done.
+func scheduleBundles(ctx context.Context, interval time.Duration) {
+  for {
+    for _, pair := range conf.Bundles.Pairs {
+      m, err := generateBundle(pair.HeadwordLanguage, pair.DefinitionLanguage)
+      if err != nil {
+        slog.Error("bundle generation failed", "hw_lang", pair.HeadwordLanguage, "def_lang", pair.DefinitionLanguage, "error", err)
+        continue
+      }
+      slog.Debug("bundle generated", "hw_lang", m.HeadwordLanguage, "def_lang", m.DefinitionLanguage, "version", m.Version)
+    }
+    select {
+    case <-ctx.Done():
+      return
+    case <-time.After(interval):
+    }
+  }
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// certs keeps a TLS certificate loaded from files, reloading it when they
+// change so that renewed certificates are served without a restart.
+package certs
+
+import (
+  "context"
+  "crypto/tls"
+  "log/slog"
+  "os"
+  "sync"
+  "time"
+)
+
+// Reloader serves the certificate in a pair of PEM files through
+// GetCertificate, see tls.Config.
+type Reloader struct {
+  CertFile string
+  KeyFile  string
+
+  mu       sync.RWMutex
+  cert     *tls.Certificate
+  // When the files were last modified as of the certificate being loaded
+  modified [2]time.Time
+}
+
+// New loads the certificate and key in certFile and keyFile.
+func New(certFile, keyFile string) (*Reloader, error) {
+  r := &Reloader{CertFile: certFile, KeyFile: keyFile}
+  if _, err := r.Reload(); err != nil {
+    return nil, err
+  }
+  return r, nil
+}
+
+// GetCertificate returns the current certificate, whatever the client asks.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  return r.cert, nil
+}
+
+/*
+  Reload loads the certificate again if either file was modified since it
+  was last loaded, reporting whether it did. If the files can't be loaded,
+  for example because only one of them has been replaced so far, the current
+  certificate is kept and the next Reload tries again.
+*/
+func (r *Reloader) Reload() (bool, error) {
+  modified, err := r.modTimes()
+  if err != nil {
+    return false, err
+  }
+  r.mu.RLock()
+  unchanged := r.cert != nil && modified == r.modified
+  r.mu.RUnlock()
+  if unchanged {
+    return false, nil
+  }
+
+  cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+  if err != nil {
+    return false, err
+  }
+  r.mu.Lock()
+  r.cert = &cert
+  r.modified = modified
+  r.mu.Unlock()
+  return true, nil
+}
+
+// Watch calls Reload every interval until ctx is done, logging the outcome.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      reloaded, err := r.Reload()
+      if err != nil {
+        slog.Error("failed to reload TLS certificate", "cert", r.CertFile, "key", r.KeyFile, "error", err)
+      } else if reloaded {
+        slog.Info("TLS certificate reloaded", "cert", r.CertFile, "key", r.KeyFile)
+      }
+    }
+  }
+}
+
+func (r *Reloader) modTimes() ([2]time.Time, error) {
+  var modified [2]time.Time
+  for i, name := range []string{r.CertFile, r.KeyFile} {
+    info, err := os.Stat(name)
+    if err != nil {
+      return modified, err
+    }
+    modified[i] = info.ModTime()
+  }
+  return modified, nil
+}
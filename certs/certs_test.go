@@ -0,0 +1,111 @@
+package certs
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "math/big"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// writePair writes a self-signed certificate with the given serial number and
+// its key, dated modified, and returns the certificate in DER.
+func writePair(t *testing.T, certFile, keyFile string, serial int64, modified time.Time) []byte {
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  template := &x509.Certificate{
+    SerialNumber: big.NewInt(serial),
+    Subject:      pkix.Name{CommonName: "localhost"},
+    DNSNames:     []string{"localhost"},
+    NotBefore:    time.Now().Add(-time.Hour),
+    NotAfter:     time.Now().Add(time.Hour),
+  }
+  der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+  if err != nil {
+    t.Fatal(err)
+  }
+  keyDER, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+    t.Fatal(err)
+  }
+  for _, name := range []string{certFile, keyFile} {
+    if err := os.Chtimes(name, modified, modified); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return der
+}
+
+func current(t *testing.T, r *Reloader) []byte {
+  cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+  if err != nil || cert == nil {
+    t.Fatalf("GetCertificate failed: %v", err)
+  }
+  return cert.Certificate[0]
+}
+
+func TestReloader(t *testing.T) {
+  dir := t.TempDir()
+  certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+  start := time.Now().Add(-time.Hour)
+
+  if _, err := New(certFile, keyFile); err == nil {
+    t.Error("Expected: an error for missing files")
+  }
+
+  first := writePair(t, certFile, keyFile, 1, start)
+  r, err := New(certFile, keyFile)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if string(current(t, r)) != string(first) {
+    t.Error("Expected: the first certificate")
+  }
+  if reloaded, err := r.Reload(); reloaded || err != nil {
+    t.Errorf("Expected: no reload of unchanged files, got: %v, %v", reloaded, err)
+  }
+
+  second := writePair(t, certFile, keyFile, 2, start.Add(time.Minute))
+  if reloaded, err := r.Reload(); !reloaded || err != nil {
+    t.Errorf("Expected: a reload of changed files, got: %v, %v", reloaded, err)
+  }
+  if string(current(t, r)) != string(second) {
+    t.Error("Expected: the second certificate after reloading")
+  }
+
+  // A certificate whose key hasn't been replaced yet is skipped until it is
+  keyPEM, _ := os.ReadFile(keyFile)
+  writePair(t, certFile, keyFile, 3, start.Add(2*time.Minute))
+  if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := r.Reload(); err == nil {
+    t.Error("Expected: an error reloading a mismatched pair")
+  }
+  if string(current(t, r)) != string(second) {
+    t.Error("Expected: the second certificate kept after a failed reload")
+  }
+  third := writePair(t, certFile, keyFile, 3, start.Add(3*time.Minute))
+  if reloaded, err := r.Reload(); !reloaded || err != nil {
+    t.Errorf("Expected: a reload once the pair matches, got: %v, %v", reloaded, err)
+  }
+  if string(current(t, r)) != string(third) {
+    t.Error("Expected: the third certificate once the pair matches")
+  }
+}
@@ -26,28 +26,138 @@ type Values struct {
     Name     string `json:"name"`
   }
 
+  // Address the API listens on, every interface if empty
   Host     string `json:"host"`
   Port     int    `json:"port"`
   Keystore string `json:"keystore"`
   CORS     bool   `json:"cors"`
   Verbose  bool   `json:"verbose"`
 
+  Server struct {
+    // Limits on reading a request, writing its response and keeping an idle
+    // connection open, in seconds, 0 for none
+    ReadHeaderTimeout int `json:"read_header_timeout"`
+    ReadTimeout       int `json:"read_timeout"`
+    WriteTimeout      int `json:"write_timeout"`
+    IdleTimeout       int `json:"idle_timeout"`
+    // Seconds given to requests in flight to finish when shutting down
+    ShutdownTimeout   int `json:"shutdown_timeout"`
+  }
+
+  TLS struct {
+    // PEM certificate (with any intermediates) and key files. HTTPS is
+    // served if both are set, and they are reloaded when they change.
+    Cert           string `json:"cert"`
+    Key            string `json:"key"`
+    // Seconds between checks for a changed certificate
+    ReloadInterval int    `json:"reload_interval"`
+  }
+
+  Auth struct {
+    // Key used to sign access tokens, the keystore if empty
+    TokenKey        string `json:"token_key"`
+    // Lifetimes of access and refresh tokens, in seconds
+    AccessTokenTTL  int    `json:"access_token_ttl"`
+    RefreshTokenTTL int    `json:"refresh_token_ttl"`
+  }
+
+  Search struct {
+    // Minimum trigram similarity (0-1) for a fuzzy headword match
+    FuzzyThreshold float64 `json:"fuzzy_threshold"`
+    // Maximum number of "did you mean" suggestions
+    Suggestions    int     `json:"suggestions"`
+  }
+
+  Media struct {
+    // Directory in which uploaded audio is stored
+    Path         string `json:"path"`
+    // Largest audio clip that may be uploaded, in bytes
+    MaxAudioSize int64  `json:"max_audio_size"`
+  }
+
+  Import struct {
+    // Largest body the import endpoint accepts, in bytes
+    MaxSize int64 `json:"max_size"`
+  }
+
+  Bundles struct {
+    // Language pairs whose offline bundles are regenerated on a schedule
+    Pairs []struct {
+      HeadwordLanguage   string `json:"hw_lang"`
+      DefinitionLanguage string `json:"def_lang"`
+    } `json:"pairs"`
+    // Seconds between regenerations, 0 to only generate bundles on demand
+    Interval int `json:"interval"`
+  }
+
+  Orthography struct {
+    // Languages whose text is stored in the canonical orthography and may be
+    // written and read in any transliteration scheme
+    Languages []string `json:"languages"`
+  }
+
+  Pagination struct {
+    // Page size used when a client doesn't ask for one
+    DefaultLimit int `json:"default_limit"`
+    // Largest page size a client may ask for
+    MaxLimit     int `json:"max_limit"`
+  }
+
   Endpoints struct {
-    Index    Endpoint
-    Status   Endpoint
-    Search   Endpoint
-    Entry    Endpoint
-    Register Endpoint
-    Login    Endpoint
-    Tag      Endpoint
-    Fetch    Endpoint
-    Random   Endpoint
+    Index     Endpoint
+    Status    Endpoint
+    Health    Endpoint
+    Ready     Endpoint
+    Search    Endpoint
+    Entry     Endpoint
+    Register  Endpoint
+    Login     Endpoint
+    Tag       Endpoint
+    Fetch     Endpoint
+    Random    Endpoint
+    Audio     Endpoint
+    Relation  Endpoint
+    Translate Endpoint
+    Token     Endpoint
+    Keys      Endpoint
+    Role      Endpoint
+    History   Endpoint
+    Proposal  Endpoint
+    Review    Endpoint
+    Import    Endpoint
+    Export    Endpoint
+    Bundle    Endpoint
+    Suggest   Endpoint
+    Translit  Endpoint
+    Metrics   Endpoint
   }
 }
 
+// Defaults returns the values used for any setting missing from the config file
+func Defaults() Values {
+  var conf Values
+  conf.Server.ReadHeaderTimeout = 10
+  conf.Server.ReadTimeout = 60
+  conf.Server.WriteTimeout = 120
+  conf.Server.IdleTimeout = 120
+  conf.Server.ShutdownTimeout = 30
+  conf.TLS.ReloadInterval = 60
+  conf.Auth.AccessTokenTTL = 15 * 60
+  conf.Auth.RefreshTokenTTL = 30 * 24 * 60 * 60
+  conf.Search.FuzzyThreshold = 0.3
+  conf.Search.Suggestions = 5
+  conf.Pagination.DefaultLimit = 50
+  conf.Pagination.MaxLimit = 200
+  conf.Media.Path = "media"
+  conf.Media.MaxAudioSize = 10 << 20
+  conf.Import.MaxSize = 32 << 20
+  conf.Orthography.Languages = []string{"yge"}
+  return conf
+}
+
 // Demarshals the provided JSON object into a Values struct
 func Load(file string) (config Values, err error) {
-  var conf Values
+  conf := Defaults()
   configFile, err := os.Open(file)
   defer configFile.Close()
   if err != nil {
@@ -1,6 +1,10 @@
 package crypto
 
-import "testing"
+import (
+  "strings"
+  "testing"
+  "time"
+)
 
 func TestHashPassword(t *testing.T) {
   tables := []struct {
@@ -25,4 +29,48 @@ func TestHashPassword(t *testing.T) {
         true, b)
     }
   }
-}
\ No newline at end of file
+}
+
+func TestToken(t *testing.T) {
+  a, err := Token(16)
+  if err != nil {
+    t.Fatalf("Error occurred generating token: %v", err)
+  }
+  b, _ := Token(16)
+  if len(a) != 32 {
+    t.Errorf("Wrong token length. Expected: %d, got: %d", 32, len(a))
+  }
+  if a == b {
+    t.Errorf("Expected: different tokens, got: %s twice", a)
+  }
+}
+func TestSignVerify(t *testing.T) {
+  key := []byte("secret")
+  now := time.Unix(1500000000, 0)
+  token, err := Sign(Claims{Subject: "42", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()}, key)
+  if err != nil {
+    t.Fatalf("Error occurred signing token: %v", err)
+  }
+
+  claims, err := Verify(token, key, now)
+  if err != nil || claims.Subject != "42" {
+    t.Errorf("Expected: subject 42, got: %+v, %v", claims, err)
+  }
+
+  tests := []struct {
+    token string
+    key   string
+    now   time.Time
+    err   error
+  }{
+    {token, "wrong", now, ErrInvalidToken},
+    {token, "secret", now.Add(time.Hour), ErrExpiredToken},
+    {"e30." + token[strings.Index(token, ".")+1:], "secret", now, ErrInvalidToken},
+    {"garbage", "secret", now, ErrInvalidToken},
+  }
+  for _, test := range tests {
+    if _, err := Verify(test.token, []byte(test.key), test.now); err != test.err {
+      t.Errorf("Verify(%q): expected %v, got %v", test.token, test.err, err)
+    }
+  }
+}
@@ -6,19 +6,31 @@
 package crypto
 
 import (
+  "crypto/rand"
+  "encoding/hex"
   "time"
   "golang.org/x/crypto/bcrypt"
-  "github.com/yugur/api/util"
+  "github.com/yugur/api/metrics"
 )
 
 func HashPassword(password string) (string, error) {
-  defer util.TrackTime(time.Now(), "HashPassword")
+  defer metrics.Since(metrics.Bcrypt.WithLabelValues("hash"), time.Now())
   bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
   return string(bytes), err
 }
 
 func CompareHash(password, hash string) bool {
-  defer util.TrackTime(time.Now(), "CompareHash")
+  defer metrics.Since(metrics.Bcrypt.WithLabelValues("compare"), time.Now())
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// Token returns a random hex string made from n bytes of cryptographically
+// secure random data.
+func Token(n int) (string, error) {
+  b := make([]byte, n)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package crypto
+
+import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "strings"
+  "time"
+)
+
+var (
+  // ErrInvalidToken is raised for tokens that are malformed or weren't
+  // signed with the given key.
+  ErrInvalidToken = errors.New("invalid token")
+  // ErrExpiredToken is raised for correctly signed tokens that have expired.
+  ErrExpiredToken = errors.New("token has expired")
+)
+
+// Claims are the contents of a signed token.
+type Claims struct {
+  // The user the token was issued to
+  Subject string `json:"sub"`
+  // Unix times at which the token was issued and expires
+  IssuedAt  int64 `json:"iat"`
+  ExpiresAt int64 `json:"exp"`
+}
+
+// Sign returns a token holding the claims, signed with HMAC-SHA256.
+// Tokens are the base64url encoded claims and signature, separated by a dot.
+func Sign(claims Claims, key []byte) (string, error) {
+  payload, err := json.Marshal(claims)
+  if err != nil {
+    return "", err
+  }
+  body := base64.RawURLEncoding.EncodeToString(payload)
+  return body + "." + base64.RawURLEncoding.EncodeToString(mac(body, key)), nil
+}
+
+// Verify checks the signature of a token made by Sign and that it hasn't
+// expired at the given time, and returns its claims.
+func Verify(token string, key []byte, now time.Time) (*Claims, error) {
+  parts := strings.Split(token, ".")
+  if len(parts) != 2 {
+    return nil, ErrInvalidToken
+  }
+  signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+  if err != nil || !hmac.Equal(signature, mac(parts[0], key)) {
+    return nil, ErrInvalidToken
+  }
+
+  payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+  if err != nil {
+    return nil, ErrInvalidToken
+  }
+  claims := new(Claims)
+  if err := json.Unmarshal(payload, claims); err != nil {
+    return nil, ErrInvalidToken
+  }
+  if now.Unix() >= claims.ExpiresAt {
+    return nil, ErrExpiredToken
+  }
+  return claims, nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash of a random token, for
+// storing tokens such as API keys without keeping the token itself. Unlike
+// passwords, random tokens are long enough not to need a slow hash.
+func HashToken(token string) string {
+  sum := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(sum[:])
+}
+
+func mac(body string, key []byte) []byte {
+  h := hmac.New(sha256.New, key)
+  h.Write([]byte(body))
+  return h.Sum(nil)
+}
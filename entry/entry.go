@@ -5,6 +5,17 @@
 // Provides a dictionary entry type and related functions and methods.
 package entry
 
+import (
+  "strconv"
+  "strings"
+)
+
+/*
+  Entry is a headword with one or more senses.
+  Wordtype and Definition are a flattened view of the senses for clients that
+  don't know about them: the wordtype of the first sense and every definition,
+  numbered if there is more than one. See Normalize.
+*/
 type Entry struct {
   ID         string `json:"id"`
   Headword   string `json:"headword"`
@@ -13,6 +24,158 @@ type Entry struct {
 
   Headword_Language   string `json:"hw_lang"`
   Definition_Language string `json:"def_lang"`
+
+  Etymology string   `json:"etymology,omitempty"`
+  Senses    []*Sense `json:"senses,omitempty"`
+
+  // Pronunciation of the headword in IPA and in an informal respelling
+  IPA      string   `json:"ipa,omitempty"`
+  Phonetic string   `json:"phonetic,omitempty"`
+  Audio    []*Audio `json:"audio,omitempty"`
+
+  Relations []*Relation `json:"relations,omitempty"`
+}
+
+// Sense is one meaning of a headword.
+type Sense struct {
+  Wordtype   string     `json:"wordtype"`
+  Definition string     `json:"definition"`
+  // Register and usage labels, e.g. "formal", "archaic", "dialectal"
+  Labels     []string   `json:"labels,omitempty"`
+  Examples   []*Example `json:"examples,omitempty"`
+}
+
+// Example is a usage example of a sense, optionally with a translation into
+// the definition language.
+type Example struct {
+  Text        string `json:"text"`
+  Translation string `json:"translation,omitempty"`
+}
+
+// Audio is a recording of the headword being spoken. Clips are uploaded
+// separately from the entry and are read only here.
+type Audio struct {
+  ID          string `json:"id"`
+  URL         string `json:"url,omitempty"`
+  ContentType string `json:"content_type"`
+  Speaker     string `json:"speaker,omitempty"`
+}
+
+// Kinds of relation between entries
+const (
+  Synonym     = "synonym"
+  Antonym     = "antonym"
+  SeeAlso     = "see_also"
+  Translation = "translation"
+  // DerivedFrom relates a word to the word it derives from, and Derivative
+  // is the same relation seen from the other end.
+  DerivedFrom = "derived_from"
+  Derivative  = "derivative"
+)
+
+// Relation links an entry to another entry. Like audio, relations are
+// managed separately from the entry and are read only here.
+type Relation struct {
+  Type     string `json:"type"`
+  ID       string `json:"id"`
+  Headword string `json:"headword"`
+  Language string `json:"hw_lang"`
+}
+
+// Symmetric reports whether a relation reads the same from both ends.
+func Symmetric(kind string) bool {
+  switch kind {
+  case Synonym, Antonym, SeeAlso, Translation:
+    return true
+  }
+  return false
+}
+
+// Inverse returns the kind of a relation seen from its other end, or "" if
+// kind isn't a known relation.
+func Inverse(kind string) string {
+  switch kind {
+  case DerivedFrom:
+    return Derivative
+  case Derivative:
+    return DerivedFrom
+  }
+  if Symmetric(kind) {
+    return kind
+  }
+  return ""
+}
+
+// Normalize reconciles the flat fields of an entry with its senses. An entry
+// without senses is given a single sense from its wordtype and definition;
+// otherwise the flat fields are rebuilt from the senses.
+func (e *Entry) Normalize() {
+  if len(e.Senses) == 0 {
+    if e.Wordtype != "" || e.Definition != "" {
+      e.Senses = []*Sense{{Wordtype: e.Wordtype, Definition: e.Definition}}
+    }
+    return
+  }
+
+  e.Wordtype = e.Senses[0].Wordtype
+  if len(e.Senses) == 1 {
+    e.Definition = e.Senses[0].Definition
+    return
+  }
+
+  definitions := make([]string, len(e.Senses))
+  for i, sense := range e.Senses {
+    definitions[i] = strconv.Itoa(i+1) + ". " + sense.Definition
+  }
+  e.Definition = strings.Join(definitions, " ")
+}
+
+// Flat returns a copy of the entry with only the fields of the original flat
+// entry model.
+func (e *Entry) Flat() *Entry {
+  return &Entry{
+    ID:                  e.ID,
+    Headword:            e.Headword,
+    Wordtype:            e.Wordtype,
+    Definition:          e.Definition,
+    Headword_Language:   e.Headword_Language,
+    Definition_Language: e.Definition_Language,
+  }
+}
+
+// Copy returns a deep copy of the entry.
+func (e *Entry) Copy() *Entry {
+  c := *e
+  if e.Audio != nil {
+    c.Audio = make([]*Audio, len(e.Audio))
+    for i, audio := range e.Audio {
+      a := *audio
+      c.Audio[i] = &a
+    }
+  }
+  if e.Relations != nil {
+    c.Relations = make([]*Relation, len(e.Relations))
+    for i, relation := range e.Relations {
+      r := *relation
+      c.Relations[i] = &r
+    }
+  }
+  if e.Senses == nil {
+    return &c
+  }
+
+  c.Senses = make([]*Sense, len(e.Senses))
+  for i, sense := range e.Senses {
+    s := *sense
+    s.Labels = append([]string(nil), sense.Labels...)
+    s.Examples = make([]*Example, len(sense.Examples))
+    for j, example := range sense.Examples {
+      x := *example
+      s.Examples[j] = &x
+    }
+    c.Senses[i] = &s
+  }
+  return &c
 }
 
 func Set(entries ...*Entry) []*Entry {
@@ -33,10 +196,139 @@ func Set(entries ...*Entry) []*Entry {
 }
 
 func (e1 *Entry) Equals(e2 *Entry) bool {
+  if len(e1.Senses) != len(e2.Senses) {
+    return false
+  }
+  for i := range e1.Senses {
+    if !e1.Senses[i].Equals(e2.Senses[i]) {
+      return false
+    }
+  }
   return e1.ID                  == e2.ID &&
          e1.Headword            == e2.Headword &&
          e1.Wordtype            == e2.Wordtype &&
          e1.Definition          == e2.Definition &&
          e1.Headword_Language   == e2.Headword_Language &&
-         e1.Definition_Language == e2.Definition_Language
-}
\ No newline at end of file
+         e1.Definition_Language == e2.Definition_Language &&
+         e1.Etymology           == e2.Etymology &&
+         e1.IPA                 == e2.IPA &&
+         e1.Phonetic            == e2.Phonetic
+}
+
+func (s1 *Sense) Equals(s2 *Sense) bool {
+  if s1.Wordtype != s2.Wordtype || s1.Definition != s2.Definition ||
+     len(s1.Labels) != len(s2.Labels) || len(s1.Examples) != len(s2.Examples) {
+    return false
+  }
+  for i := range s1.Labels {
+    if s1.Labels[i] != s2.Labels[i] {
+      return false
+    }
+  }
+  for i := range s1.Examples {
+    if *s1.Examples[i] != *s2.Examples[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// Change is a field that differs between two versions of an entry.
+// Fields of senses are named by position, e.g. "senses[1].definition". A
+// sense that only exists in one version is a single change to "senses[i]".
+type Change struct {
+  Field string      `json:"field"`
+  Old   interface{} `json:"old"`
+  New   interface{} `json:"new"`
+}
+
+// Diff lists the fields that changed from e1 to e2, in the order they are
+// declared. IDs, audio and relations are not compared.
+func Diff(e1, e2 *Entry) []Change {
+  var changes []Change
+  add := func(field string, old, new interface{}) {
+    changes = append(changes, Change{Field: field, Old: old, New: new})
+  }
+  compare := func(field, old, new string) {
+    if old != new {
+      add(field, old, new)
+    }
+  }
+
+  compare("headword", e1.Headword, e2.Headword)
+  compare("wordtype", e1.Wordtype, e2.Wordtype)
+  compare("definition", e1.Definition, e2.Definition)
+  compare("hw_lang", e1.Headword_Language, e2.Headword_Language)
+  compare("def_lang", e1.Definition_Language, e2.Definition_Language)
+  compare("etymology", e1.Etymology, e2.Etymology)
+
+  for i := 0; i < len(e1.Senses) || i < len(e2.Senses); i++ {
+    field := "senses[" + strconv.Itoa(i) + "]"
+    switch {
+    case i >= len(e1.Senses):
+      add(field, nil, e2.Senses[i])
+      continue
+    case i >= len(e2.Senses):
+      add(field, e1.Senses[i], nil)
+      continue
+    }
+
+    s1, s2 := e1.Senses[i], e2.Senses[i]
+    compare(field+".wordtype", s1.Wordtype, s2.Wordtype)
+    compare(field+".definition", s1.Definition, s2.Definition)
+    if !(&Sense{Labels: s1.Labels}).Equals(&Sense{Labels: s2.Labels}) {
+      add(field+".labels", s1.Labels, s2.Labels)
+    }
+    if !(&Sense{Examples: s1.Examples}).Equals(&Sense{Examples: s2.Examples}) {
+      add(field+".examples", s1.Examples, s2.Examples)
+    }
+  }
+
+  compare("ipa", e1.IPA, e2.IPA)
+  compare("phonetic", e1.Phonetic, e2.Phonetic)
+  return changes
+}
+
+// Match is an entry found by a search along with how well it matched.
+// The entry's fields are flattened into the match when encoded as JSON.
+type Match struct {
+  *Entry
+  Rank       float64 `json:"rank,omitempty"`
+  Snippet    string  `json:"snippet,omitempty"`
+  Similarity float64 `json:"similarity,omitempty"`
+}
+
+// Matches wraps entries which have no ranking information.
+func Matches(entries ...*Entry) []*Match {
+  matches := make([]*Match, 0, len(entries))
+  for _, e := range entries {
+    matches = append(matches, &Match{Entry: e})
+  }
+  return matches
+}
+
+// MatchSet is Set for matches. The first match for each entry is kept, in
+// order, and takes the highest rank and similarity and the first snippet of
+// any of its duplicates.
+func MatchSet(matches ...*Match) []*Match {
+  var set []*Match
+  index := make(map[string]*Match)
+  for _, m := range matches {
+    if first, ok := index[m.ID]; ok {
+      if m.Rank > first.Rank {
+        first.Rank = m.Rank
+      }
+      if m.Similarity > first.Similarity {
+        first.Similarity = m.Similarity
+      }
+      if first.Snippet == "" {
+        first.Snippet = m.Snippet
+      }
+      continue
+    }
+    c := *m
+    index[m.ID] = &c
+    set = append(set, &c)
+  }
+  return set
+}
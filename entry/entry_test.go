@@ -11,14 +11,14 @@ func TestEquals(t *testing.T) {
   }{
     {
       "positive",
-      Entry{"1", "dog", "noun", "man's best friend", "en-AU", "en-AU"},
-      Entry{"1", "dog", "noun", "man's best friend", "en-AU", "en-AU"},
+      Entry{ID: "1", Headword: "dog", Wordtype: "noun", Definition: "man's best friend", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+      Entry{ID: "1", Headword: "dog", Wordtype: "noun", Definition: "man's best friend", Headword_Language: "en-AU", Definition_Language: "en-AU"},
       true,
     },
     {
       "negative",
-      Entry{"1", "dog", "noun", "man's best friend", "en-AU", "en-AU"},
-      Entry{"2", "cat", "noun", "not man's best friend", "en-AU", "en-AU"},
+      Entry{ID: "1", Headword: "dog", Wordtype: "noun", Definition: "man's best friend", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+      Entry{ID: "2", Headword: "cat", Wordtype: "noun", Definition: "not man's best friend", Headword_Language: "en-AU", Definition_Language: "en-AU"},
       false,
     },
     {
@@ -30,13 +30,37 @@ func TestEquals(t *testing.T) {
     {
       "nil negative",
       Entry{},
-      Entry{"1", "dog", "noun", "man's best friend", "en-AU", "en-AU"},
+      Entry{ID: "1", Headword: "dog", Wordtype: "noun", Definition: "man's best friend", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+      false,
+    },
+    {
+      "senses positive",
+      Entry{ID: "1", Senses: []*Sense{{Wordtype: "noun", Definition: "fire", Labels: []string{"formal"}, Examples: []*Example{{"ot", "fire"}}}}},
+      Entry{ID: "1", Senses: []*Sense{{Wordtype: "noun", Definition: "fire", Labels: []string{"formal"}, Examples: []*Example{{"ot", "fire"}}}}},
+      true,
+    },
+    {
+      "senses negative",
+      Entry{ID: "1", Senses: []*Sense{{Wordtype: "noun", Definition: "fire", Examples: []*Example{{"ot", "fire"}}}}},
+      Entry{ID: "1", Senses: []*Sense{{Wordtype: "noun", Definition: "fire", Examples: []*Example{{"ot", "flame"}}}}},
+      false,
+    },
+    {
+      "etymology negative",
+      Entry{ID: "1", Etymology: "From Old Turkic"},
+      Entry{ID: "1"},
+      false,
+    },
+    {
+      "pronunciation negative",
+      Entry{ID: "1", IPA: "ot"},
+      Entry{ID: "1", IPA: "ɔt"},
       false,
     },
     {
       "partial negative",
-      Entry{"1", "dog", "noun", "man's best friend", "en-AU", "en-AU"},
-      Entry{"1", "dg", "noun", "man's best friend", "en-AU", "en-AU"},
+      Entry{ID: "1", Headword: "dog", Wordtype: "noun", Definition: "man's best friend", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+      Entry{ID: "1", Headword: "dg", Wordtype: "noun", Definition: "man's best friend", Headword_Language: "en-AU", Definition_Language: "en-AU"},
       false,
     },
   }
@@ -87,4 +111,142 @@ func TestSet(t *testing.T) {
       t.Errorf("entrySet failed to create a set. Expected: %d occurrence(s), got %d occurrence(s).", 1, count)
     }
   }
-}
\ No newline at end of file
+}
+
+func TestMatchSet(t *testing.T) {
+  dog := &Entry{ID: "1", Headword: "dog"}
+  cat := &Entry{ID: "2", Headword: "cat"}
+
+  result := MatchSet(
+    &Match{Entry: dog},
+    &Match{Entry: cat, Rank: 0.1},
+    &Match{Entry: dog, Rank: 0.5, Snippet: "man's best <mark>friend</mark>"},
+    &Match{Entry: cat, Rank: 0.2, Snippet: "not man's best friend"},
+    &Match{Entry: dog, Similarity: 0.4},
+  )
+
+  if len(result) != 2 {
+    t.Fatalf("MatchSet failed to create a set. Expected: %d matches, got: %d.", 2, len(result))
+  }
+  if result[0].ID != "1" || result[1].ID != "2" {
+    t.Errorf("MatchSet changed the order of matches. Expected: 1, 2, got: %s, %s.", result[0].ID, result[1].ID)
+  }
+  if result[0].Rank != 0.5 || result[0].Similarity != 0.4 || result[0].Snippet != "man's best <mark>friend</mark>" {
+    t.Errorf("MatchSet failed to merge duplicates, got: %+v", result[0])
+  }
+  if result[1].Rank != 0.2 || result[1].Snippet != "not man's best friend" {
+    t.Errorf("MatchSet failed to merge duplicates, got: %+v", result[1])
+  }
+}
+
+
+func TestNormalize(t *testing.T) {
+  tables := []struct {
+    name       string
+    e          Entry
+    wordtype   string
+    definition string
+    senses     int
+  }{
+    {
+      "flat",
+      Entry{Wordtype: "noun", Definition: "man's best friend"},
+      "noun", "man's best friend", 1,
+    },
+    {
+      "empty",
+      Entry{Headword: "dog"},
+      "", "", 0,
+    },
+    {
+      "single sense",
+      Entry{Wordtype: "verb", Senses: []*Sense{{Wordtype: "noun", Definition: "man's best friend"}}},
+      "noun", "man's best friend", 1,
+    },
+    {
+      "multiple senses",
+      Entry{Senses: []*Sense{{Wordtype: "noun", Definition: "world"}, {Wordtype: "noun", Definition: "era"}}},
+      "noun", "1. world 2. era", 2,
+    },
+  }
+
+  for _, table := range tables {
+    table.e.Normalize()
+    if table.e.Wordtype != table.wordtype || table.e.Definition != table.definition || len(table.e.Senses) != table.senses {
+      t.Errorf(
+        `Wrong normalization for table %q
+        Expected: %q, %q, %d senses, got: %q, %q, %d senses.`,
+        table.name, table.wordtype, table.definition, table.senses,
+        table.e.Wordtype, table.e.Definition, len(table.e.Senses))
+    }
+  }
+}
+
+func TestCopy(t *testing.T) {
+  e := &Entry{ID: "1", Senses: []*Sense{{Definition: "fire", Labels: []string{"formal"}, Examples: []*Example{{Text: "ot"}}}}, Relations: []*Relation{{Type: Synonym, ID: "2"}}}
+  c := e.Copy()
+  if !c.Equals(e) {
+    t.Fatalf("Copy is not equal to the original.")
+  }
+
+  c.Senses[0].Labels[0] = "informal"
+  c.Senses[0].Examples[0].Text = "ott"
+  if c.Equals(e) {
+    t.Errorf("Copy shares senses with the original.")
+  }
+
+  c.Relations[0].ID = "3"
+  if e.Relations[0].ID != "2" {
+    t.Errorf("Copy shares relations with the original.")
+  }
+}
+
+func TestInverse(t *testing.T) {
+  tests := []struct {
+    kind    string
+    inverse string
+  }{
+    {Synonym, Synonym},
+    {Translation, Translation},
+    {DerivedFrom, Derivative},
+    {Derivative, DerivedFrom},
+    {"cousin", ""},
+  }
+  for _, test := range tests {
+    if got := Inverse(test.kind); got != test.inverse {
+      t.Errorf("Inverse(%q): expected %q, got %q", test.kind, test.inverse, got)
+    }
+  }
+}
+
+func TestDiff(t *testing.T) {
+  e1 := &Entry{
+    ID:       "1",
+    Headword: "fire",
+    Senses:   []*Sense{{Wordtype: "noun", Definition: "flame", Labels: []string{"formal"}}},
+  }
+  e2 := e1.Copy()
+  if changes := Diff(e1, e2); len(changes) != 0 {
+    t.Errorf("Expected: no changes between copies, got: %+v", changes)
+  }
+
+  e2.ID = "2"
+  e2.Headword = "fyre"
+  e2.Senses[0].Labels = []string{"archaic"}
+  e2.Senses = append(e2.Senses, &Sense{Wordtype: "verb", Definition: "to dismiss"})
+  e2.IPA = "faɪə"
+
+  changes := Diff(e1, e2)
+  fields := []string{"headword", "senses[0].labels", "senses[1]", "ipa"}
+  if len(changes) != len(fields) {
+    t.Fatalf("Expected: %d changes, got: %+v", len(fields), changes)
+  }
+  for i, field := range fields {
+    if changes[i].Field != field {
+      t.Errorf("Expected: change %d to %s, got: %s", i, field, changes[i].Field)
+    }
+  }
+  if changes[0].Old != "fire" || changes[0].New != "fyre" || changes[2].Old != nil {
+    t.Errorf("Wrong values, got: %+v", changes)
+  }
+}
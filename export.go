@@ -0,0 +1,411 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "encoding/csv"
+  "encoding/xml"
+  "io"
+  "strconv"
+
+  d "github.com/yugur/api/entry"
+)
+
+// Formats served by the export endpoint, besides formatCSV
+const (
+  // LIFT 0.13, the Lexicon Interchange FormaT read by FLEx and WeSay
+  formatLIFT = "lift"
+  // TEI Lex-0, the TEI dictionary baseline
+  formatTEI = "tei"
+)
+
+// How many entries are read from the store at a time while exporting. A
+// variable so that tests can export in several batches.
+var exportBatch = 500
+
+// Columns written by a CSV export, in order. These can be read back by the
+// import endpoint.
+var exportColumns = []string{"id", "headword", "wordtype", "definition", "hw_lang", "def_lang", "etymology", "ipa", "phonetic"}
+
+/*
+  exporter writes a dictionary in some format. Begin is called once before
+  the first entry and End once after the last, so that entries can be written
+  as they are read rather than held in memory.
+*/
+type exporter interface {
+  Begin() error
+  Entry(e *d.Entry) error
+  End() error
+}
+
+// exportFormats describes each export format: its media type, the extension
+// of the file it is downloaded as and how to make an exporter writing to w.
+var exportFormats = map[string]struct {
+  ContentType string
+  Extension   string
+  New         func(w io.Writer) exporter
+}{
+  formatLIFT: {"application/xml; charset=utf-8", ".lift", func(w io.Writer) exporter { return &liftExporter{enc: xml.NewEncoder(w), w: w} }},
+  formatTEI:  {"application/tei+xml; charset=utf-8", ".tei.xml", func(w io.Writer) exporter { return &teiExporter{enc: xml.NewEncoder(w), w: w} }},
+  formatCSV:  {"text/csv; charset=utf-8", ".csv", func(w io.Writer) exporter { return &csvExporter{w: csv.NewWriter(w)} }},
+}
+
+/*
+  exportEntries calls fn with every entry matching f, in order of ID, with
+  human names as for any other response. Entries are read a page at a time
+  and after is called after each page, e.g. to flush a response.
+*/
+func exportEntries(f entryFilter, fn func(e *d.Entry) error, after func()) error {
+  // The total would be counted again for every page
+  page := pageRequest{Limit: exportBatch, Sort: sortID, NoTotal: true}
+  for {
+    entries, next, _, err := data.EntryPage(f, page)
+    if err == errUnknownFilter {
+      return nil
+    } else if err != nil {
+      return err
+    }
+    if _, err := asOutgoing(entries...); err != nil {
+      return err
+    }
+    for _, e := range entries {
+      if err := fn(e); err != nil {
+        return err
+      }
+    }
+    after()
+
+    if next == "" || len(entries) == 0 {
+      return nil
+    }
+    page.After = &pageCursor{Sort: sortID, ID: entries[len(entries)-1].ID}
+  }
+}
+
+//---------------------------------------------------------
+//---- CSV
+//---------------------------------------------------------
+
+type csvExporter struct {
+  w *csv.Writer
+}
+
+func (x *csvExporter) Begin() error {
+  return x.w.Write(exportColumns)
+}
+
+func (x *csvExporter) Entry(e *d.Entry) error {
+  return x.w.Write([]string{
+    e.ID,
+    e.Headword,
+    e.Wordtype,
+    e.Definition,
+    e.Headword_Language,
+    e.Definition_Language,
+    e.Etymology,
+    e.IPA,
+    e.Phonetic,
+  })
+}
+
+func (x *csvExporter) End() error {
+  x.w.Flush()
+  return x.w.Error()
+}
+
+//---------------------------------------------------------
+//---- LIFT
+//---------------------------------------------------------
+
+// A text in a given writing system
+type liftForm struct {
+  Lang string `xml:"lang,attr"`
+  Text string `xml:"text"`
+}
+
+// Elements holding one or more forms
+type liftMultiText struct {
+  Forms []liftForm `xml:"form"`
+}
+
+type liftEntry struct {
+  XMLName       xml.Name           `xml:"entry"`
+  ID            string             `xml:"id,attr"`
+  LexicalUnit   liftMultiText      `xml:"lexical-unit"`
+  Pronunciation *liftPronunciation `xml:"pronunciation"`
+  Notes         []liftNote         `xml:"note"`
+  Senses        []liftSense        `xml:"sense"`
+  Relations     []liftRelation     `xml:"relation"`
+}
+
+type liftPronunciation struct {
+  Forms []liftForm  `xml:"form"`
+  Media []liftMedia `xml:"media"`
+}
+
+type liftMedia struct {
+  Href string `xml:"href,attr"`
+}
+
+type liftNote struct {
+  Type  string     `xml:"type,attr"`
+  Forms []liftForm `xml:"form"`
+}
+
+type liftSense struct {
+  ID              string        `xml:"id,attr"`
+  Order           int           `xml:"order,attr"`
+  GrammaticalInfo *liftValue    `xml:"grammatical-info"`
+  Definition      liftMultiText `xml:"definition"`
+  Traits          []liftTrait   `xml:"trait"`
+  Examples        []liftExample `xml:"example"`
+}
+
+type liftValue struct {
+  Value string `xml:"value,attr"`
+}
+
+type liftTrait struct {
+  Name  string `xml:"name,attr"`
+  Value string `xml:"value,attr"`
+}
+
+type liftExample struct {
+  Forms       []liftForm     `xml:"form"`
+  Translation *liftMultiText `xml:"translation"`
+}
+
+type liftRelation struct {
+  Type string `xml:"type,attr"`
+  Ref  string `xml:"ref,attr"`
+}
+
+type liftExporter struct {
+  enc *xml.Encoder
+  w   io.Writer
+}
+
+func (x *liftExporter) Begin() error {
+  _, err := io.WriteString(x.w, xml.Header+`<lift version="0.13" producer="Yugur API">`+"\n")
+  return err
+}
+
+func (x *liftExporter) Entry(e *d.Entry) error {
+  hw, def := e.Headword_Language, e.Definition_Language
+  entry := liftEntry{
+    ID:          e.ID,
+    LexicalUnit: liftMultiText{[]liftForm{{hw, e.Headword}}},
+  }
+
+  if e.IPA != "" || e.Phonetic != "" || len(e.Audio) > 0 {
+    p := new(liftPronunciation)
+    if e.IPA != "" {
+      p.Forms = append(p.Forms, liftForm{hw + "-fonipa", e.IPA})
+    }
+    if e.Phonetic != "" {
+      p.Forms = append(p.Forms, liftForm{hw + "-x-phonetic", e.Phonetic})
+    }
+    for _, audio := range e.Audio {
+      p.Media = append(p.Media, liftMedia{audio.URL})
+    }
+    entry.Pronunciation = p
+  }
+  if e.Etymology != "" {
+    entry.Notes = append(entry.Notes, liftNote{"etymology", []liftForm{{def, e.Etymology}}})
+  }
+
+  for i, sense := range e.Senses {
+    s := liftSense{
+      ID:         e.ID + "_" + strconv.Itoa(i+1),
+      Order:      i,
+      Definition: liftMultiText{[]liftForm{{def, sense.Definition}}},
+    }
+    if sense.Wordtype != "" {
+      s.GrammaticalInfo = &liftValue{sense.Wordtype}
+    }
+    for _, label := range sense.Labels {
+      s.Traits = append(s.Traits, liftTrait{"usage-type", label})
+    }
+    for _, example := range sense.Examples {
+      ex := liftExample{Forms: []liftForm{{hw, example.Text}}}
+      if example.Translation != "" {
+        ex.Translation = &liftMultiText{[]liftForm{{def, example.Translation}}}
+      }
+      s.Examples = append(s.Examples, ex)
+    }
+    entry.Senses = append(entry.Senses, s)
+  }
+
+  for _, relation := range e.Relations {
+    entry.Relations = append(entry.Relations, liftRelation{relation.Type, relation.ID})
+  }
+  if err := x.enc.Encode(entry); err != nil {
+    return err
+  }
+  _, err := io.WriteString(x.w, "\n")
+  return err
+}
+
+func (x *liftExporter) End() error {
+  _, err := io.WriteString(x.w, "</lift>\n")
+  return err
+}
+
+//---------------------------------------------------------
+//---- TEI Lex-0
+//---------------------------------------------------------
+
+// teiHeader is the minimal header required of a TEI document.
+const teiHeader = `<teiHeader><fileDesc>` +
+  `<titleStmt><title>Yugur dictionary</title></titleStmt>` +
+  `<publicationStmt><p>Exported by the Yugur API</p></publicationStmt>` +
+  `<sourceDesc><p>Born digital</p></sourceDesc>` +
+  `</fileDesc></teiHeader>`
+
+type teiEntry struct {
+  XMLName   xml.Name   `xml:"entry"`
+  ID        string     `xml:"http://www.w3.org/XML/1998/namespace id,attr"`
+  Lang      string     `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+  Form      teiForm    `xml:"form"`
+  Etymology string     `xml:"etym,omitempty"`
+  Senses    []teiSense `xml:"sense"`
+  Refs      []teiXr    `xml:"xr"`
+}
+
+type teiForm struct {
+  Type          string    `xml:"type,attr"`
+  Orthography   string    `xml:"orth"`
+  Pronunciation []teiPron `xml:"pron"`
+}
+
+type teiPron struct {
+  Notation string `xml:"notation,attr"`
+  Text     string `xml:",chardata"`
+}
+
+type teiSense struct {
+  ID         string     `xml:"http://www.w3.org/XML/1998/namespace id,attr"`
+  N          int        `xml:"n,attr"`
+  GramGrp    *teiGram   `xml:"gramGrp"`
+  Usage      []teiUsage `xml:"usg"`
+  Definition teiText    `xml:"def"`
+  Examples   []teiCit   `xml:"cit"`
+}
+
+type teiGram struct {
+  Gram teiTyped `xml:"gram"`
+}
+
+type teiTyped struct {
+  Type string `xml:"type,attr"`
+  Text string `xml:",chardata"`
+}
+
+type teiUsage struct {
+  Text string `xml:",chardata"`
+}
+
+type teiText struct {
+  Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+  Text string `xml:",chardata"`
+}
+
+type teiCit struct {
+  Type        string  `xml:"type,attr"`
+  Lang        string  `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+  Quote       string  `xml:"quote"`
+  Translation *teiCit `xml:"cit"`
+}
+
+type teiXr struct {
+  Type    string `xml:"type,attr"`
+  Subtype string `xml:"subtype,attr,omitempty"`
+  Ref     teiRef `xml:"ref"`
+}
+
+type teiRef struct {
+  Target string `xml:"target,attr"`
+  Text   string `xml:",chardata"`
+}
+
+// teiRelations maps kinds of relation to TEI Lex-0 cross reference types.
+// Anything else is a "related" cross reference with the kind as its subtype.
+var teiRelations = map[string]string{
+  d.Synonym: "synonymy",
+  d.Antonym: "antonymy",
+}
+
+type teiExporter struct {
+  enc *xml.Encoder
+  w   io.Writer
+}
+
+func (x *teiExporter) Begin() error {
+  _, err := io.WriteString(x.w, xml.Header+`<TEI xmlns="http://www.tei-c.org/ns/1.0">`+teiHeader+"\n<text><body>\n")
+  return err
+}
+
+func (x *teiExporter) Entry(e *d.Entry) error {
+  def := e.Definition_Language
+  entry := teiEntry{
+    ID:        teiID(e.ID),
+    Lang:      e.Headword_Language,
+    Form:      teiForm{Type: "lemma", Orthography: e.Headword},
+    Etymology: e.Etymology,
+  }
+  if e.IPA != "" {
+    entry.Form.Pronunciation = append(entry.Form.Pronunciation, teiPron{"IPA", e.IPA})
+  }
+  if e.Phonetic != "" {
+    entry.Form.Pronunciation = append(entry.Form.Pronunciation, teiPron{"phonetic", e.Phonetic})
+  }
+
+  for i, sense := range e.Senses {
+    s := teiSense{
+      ID:         teiID(e.ID) + "." + strconv.Itoa(i+1),
+      N:          i + 1,
+      Definition: teiText{def, sense.Definition},
+    }
+    if sense.Wordtype != "" {
+      s.GramGrp = &teiGram{teiTyped{"pos", sense.Wordtype}}
+    }
+    for _, label := range sense.Labels {
+      s.Usage = append(s.Usage, teiUsage{label})
+    }
+    for _, example := range sense.Examples {
+      cit := teiCit{Type: "example", Quote: example.Text}
+      if example.Translation != "" {
+        cit.Translation = &teiCit{Type: "translation", Lang: def, Quote: example.Translation}
+      }
+      s.Examples = append(s.Examples, cit)
+    }
+    entry.Senses = append(entry.Senses, s)
+  }
+
+  for _, relation := range e.Relations {
+    xr := teiXr{Type: teiRelations[relation.Type], Ref: teiRef{"#" + teiID(relation.ID), relation.Headword}}
+    if xr.Type == "" {
+      xr.Type, xr.Subtype = "related", relation.Type
+    }
+    entry.Refs = append(entry.Refs, xr)
+  }
+
+  if err := x.enc.Encode(entry); err != nil {
+    return err
+  }
+  _, err := io.WriteString(x.w, "\n")
+  return err
+}
+
+func (x *teiExporter) End() error {
+  _, err := io.WriteString(x.w, "</body></text>\n</TEI>\n")
+  return err
+}
+
+// teiID makes an entry ID into an XML identifier, which can't start with a
+// digit.
+func teiID(id string) string {
+  return "e" + id
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// fuzzy provides approximate string matching.
+//
+// Similarity follows the pg_trgm extension so that results are comparable
+// whether or not they come from Postgres.
+package fuzzy
+
+import (
+  "strings"
+  "unicode"
+)
+
+// Trigrams returns the set of trigrams in s as pg_trgm would extract them.
+// Each word is lowercased and padded with two spaces before and one after.
+func Trigrams(s string) map[string]bool {
+  set := make(map[string]bool)
+  for _, word := range strings.FieldsFunc(strings.ToLower(s), notWord) {
+    runes := []rune("  " + word + " ")
+    for i := 0; i+3 <= len(runes); i++ {
+      set[string(runes[i:i+3])] = true
+    }
+  }
+  return set
+}
+
+// Similarity returns a number between 0 and 1 indicating how similar a and b
+// are, as the number of shared trigrams over the number of distinct trigrams.
+func Similarity(a, b string) float64 {
+  ta, tb := Trigrams(a), Trigrams(b)
+  if len(ta) == 0 || len(tb) == 0 {
+    return 0
+  }
+
+  shared := 0
+  for t := range ta {
+    if tb[t] {
+      shared++
+    }
+  }
+  return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+func notWord(r rune) bool {
+  return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
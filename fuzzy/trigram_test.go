@@ -0,0 +1,48 @@
+package fuzzy
+
+import (
+  "math"
+  "testing"
+)
+
+func TestTrigrams(t *testing.T) {
+  expected := []string{"  c", " ca", "cat", "at "}
+
+  result := Trigrams("Cat")
+  if len(result) != len(expected) {
+    t.Fatalf("Wrong trigram count. Expected: %d, got: %d (%v).", len(expected), len(result), result)
+  }
+  for _, trigram := range expected {
+    if !result[trigram] {
+      t.Errorf("Missing trigram %q in %v.", trigram, result)
+    }
+  }
+}
+
+func TestSimilarity(t *testing.T) {
+  tables := []struct {
+    a string
+    b string
+    s float64
+  }{
+    {"fire", "fire", 1},
+    {"fire", "FIRE", 1},
+    {"fire", "", 0},
+    {"fire", "zeal", 0},
+    // "  f", " fi" shared out of 8 distinct trigrams
+    {"fire", "fier", 2.0 / 8.0},
+    // "  w", " wo", "wor", "ord" shared out of 11 distinct trigrams
+    {"word", "two words", 4.0 / 11.0},
+  }
+
+  for _, table := range tables {
+    s1 := Similarity(table.a, table.b)
+    s2 := Similarity(table.b, table.a)
+    if math.Abs(s1-table.s) > 1e-9 || math.Abs(s2-table.s) > 1e-9 {
+      t.Errorf(
+        `Wrong similarity for %q and %q.
+        Expected: %f, got: %f and %f.`,
+        table.a, table.b, table.s, s1, s2)
+    }
+  }
+}
@@ -11,31 +11,41 @@ import (
   "net/http"
   "html/template"
   "fmt"
-  "log"
+  "io"
+  "log/slog"
+  "mime"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
   "time"
 
   "github.com/gorilla/sessions"
+  "github.com/yugur/api/blob"
   "github.com/yugur/api/crypto"
+  "github.com/yugur/api/metrics"
+  "github.com/yugur/api/translit"
   "github.com/yugur/api/util"
   d "github.com/yugur/api/entry"
 )
 
-//---------------------------------------------------------
-//---- Database Structs
-//---------------------------------------------------------
-
-type User struct {
-  UID      string `json:"uid"`
-  Username string `json:"username"`
-  Hash     string `json:"hash"`
-}
+// Cookie session store, recreated with the configured key by setup
+var sessionStore = sessions.NewCookieStore([]byte(conf.Keystore))
 
-type Tag struct {
-  ID       string    `json:"id"`
-  Name     string `json:"name"`
-}
-
-var store = sessions.NewCookieStore([]byte(conf.Keystore))
+const (
+  // The most entries the random endpoint will serve in a single request
+  maxRandom = 50
+  // The most similar headwords considered by the search endpoint
+  maxFuzzy = 20
+  // The most candidates the translate endpoint will serve
+  maxTranslations = 50
+  // Weight of translations found in definitions relative to those found by
+  // headword, so that a definition never outranks an exact headword match
+  reverseWeight = 0.9
+  // How many headwords the suggest endpoint serves by default, and at most
+  defaultSuggestions = 10
+  maxSuggestions     = 50
+)
 
 //---------------------------------------------------------
 //---- Endpoint Handlers
@@ -45,17 +55,6 @@ var store = sessions.NewCookieStore([]byte(conf.Keystore))
 //---- General Handlers
 //----
 
-// statusHandler may be used to confirm the server's current status.
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-  switch r.Method {
-  case http.MethodGet:
-    return
-  default:
-    // Unsupported method
-    http.Error(w, http.StatusText(405), 405)
-  }
-}
-
 // notImplemented is a simple stub for incomplete handlers.
 func notImplemented(w http.ResponseWriter, r *http.Request) {
   switch r.Method {
@@ -63,7 +62,7 @@ func notImplemented(w http.ResponseWriter, r *http.Request) {
     w.Write([]byte("Not Implemented"))
   default:
     // Unsupported method
-    http.Error(w, http.StatusText(405), 405)
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
   }
 }
 
@@ -71,12 +70,13 @@ func notImplemented(w http.ResponseWriter, r *http.Request) {
 func indexHandler(w http.ResponseWriter, r *http.Request) {
   switch r.Method {
   case http.MethodGet:
-    session, err := store.Get(r, "uid")
+    session, err := sessionStore.Get(r, "uid")
     if err != nil {
-      http.Error(w, http.StatusText(500), 500)
+      util.WriteProblem(w, r, util.Internal(err))
+      return
     }
     if val, ok := session.Values["uid"].(string); ok {
-      log.Println("User ID cookie: ", val)
+      util.Logger(r.Context()).Debug("session", "uid", val)
       switch val {
         case "": 
           http.Redirect(w, r, "/login", http.StatusFound)
@@ -89,7 +89,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
     }
   default:
     // Unsupported method
-    http.Error(w, http.StatusText(405), 405)
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
   }
 }
 
@@ -113,53 +113,61 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
     // Parse form values
     err := r.ParseForm()
     if err != nil {
-      http.Error(w, http.StatusText(403), 403)
+      util.WriteProblem(w, r, util.BadRequest(util.CodeInvalidBody, err.Error()))
+      return
     }
 
     // Read required fields
     username := r.PostFormValue("username")
     password := r.PostFormValue("password")
     email := r.PostFormValue("email")
-    if username == "" || password == "" || email == "" {
-      http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+    var missing []util.Field
+    for _, field := range []struct{ name, value string }{{"username", username}, {"password", password}, {"email", email}} {
+      if field.value == "" {
+        missing = append(missing, util.Field{Name: field.name, Code: util.FieldRequired, Message: field.name + " is required"})
+      }
+    }
+    if len(missing) > 0 {
+      util.WriteProblem(w, r, util.BadRequest(util.CodeValidationFailed, "the registration is missing required fields", missing...))
       return
     }
 
     // Check whether the user already exists in database
-    var exists bool
-    err = db.QueryRow("SELECT 1 FROM users WHERE username = $1", username).Scan(&exists)
-    if err != nil && err != sql.ErrNoRows {
-      fmt.Fprintf(w, "User %s already exists.\n", username)
+    _, err = data.UserByName(username)
+    if err == nil {
+      util.WriteProblem(w, r, util.Conflict("user "+strconv.Quote(username)+" already exists"))
+      return
+    } else if err != sql.ErrNoRows {
+      util.WriteProblem(w, r, util.Internal(err))
       return
     }
 
     // Generate hash for new user
     hash, err := crypto.HashPassword(password)
     if err != nil {
-      log.Println(err)
-    }
-
-    // Create a timestamp for the user's join date
-    joindate := time.Now()
-
-    // Insert new user into database
-    result, err := db.Exec("INSERT INTO users(username, hash, email, dob, gender, joindate, language, fluency) VALUES($1, $2, $3, $4, $5, $6, $7, $8)", username, hash, email, nil, nil, joindate, nil, nil)
-    if err != nil {
-      log.Printf(err.Error())
-      http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+      util.WriteProblem(w, r, util.Internal(err))
       return
     }
 
-    rowsAffected, err := result.RowsAffected()
+    // Insert new user into database, with a timestamp for their join date
+    user := &User{
+      Username: username,
+      Hash:     hash,
+      Email:    email,
+      Joindate: time.Now(),
+    }
+    uid, err := data.InsertUser(user)
     if err != nil {
-      http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+      util.WriteProblem(w, r, util.Internal(err))
       return
     }
 
-    fmt.Fprintf(w, "d.Entry %s created successfully (%d rows affected)\n", username, rowsAffected)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]string{"uid": uid, "username": username})
   default:
     // Unsupported method
-    http.Error(w, http.StatusText(405), 405)
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
   }
 }
 
@@ -181,47 +189,210 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
     // Parse form values
     err := r.ParseForm()
     if err != nil {
-      http.Error(w, http.StatusText(403), 403)
+      util.WriteProblem(w, r, util.BadRequest(util.CodeInvalidBody, err.Error()))
+      return
     }
     username := r.PostFormValue("username")
     password := r.PostFormValue("password")
 
-    // Retrieve the matching user from database
-    row := db.QueryRow("SELECT uid, username, hash FROM users WHERE username = $1", username)
-    user := new(User)
-    err = row.Scan(&user.UID, &user.Username, &user.Hash)
+    // Retrieve the matching user from database and compare the existing hash
+    // with given credentials. An unknown user and a wrong password are
+    // refused alike so as not to reveal which usernames exist.
+    user, err := data.UserByName(username)
+    if err == nil && !crypto.CompareHash(password, user.Hash) {
+      err = sql.ErrNoRows
+    }
     if err == sql.ErrNoRows {
-      http.NotFound(w, r)
+      util.Logger(r.Context()).Info("login failed", "username", username)
+      util.WriteProblem(w, r, util.Unauthorized("invalid username or password"))
       return
     } else if err != nil {
-      http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-      return
-    }
-
-    // Compare existing hash with given credentials
-    valid := crypto.CompareHash(password, user.Hash)
-    if !valid {
-      log.Printf("Failed login attempt: username=%s, password=%s", username, password)
+      util.WriteProblem(w, r, util.Internal(err))
       return
     }
-    log.Printf("Successful login attempt: username=%s, password=%s", username, password)
+    util.Logger(r.Context()).Info("login", "username", username)
     // fmt.Fprintf(w, "Successfully logged in as user %s\n", username)
-    session, err := store.Get(r, "uid")
+    session, err := sessionStore.Get(r, "uid")
     if err != nil {
-      http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+      util.WriteProblem(w, r, util.Internal())
       return
     }
 
     session.Values["uid"] = user.UID
     err = session.Save(r, w)
     if err != nil {
-      http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+      util.WriteProblem(w, r, util.Internal(err))
+      return
     }
 
     http.Redirect(w, r, "/", 302)
   default:
     // Unsupported method
-    http.Error(w, http.StatusText(405), 405)
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+/*
+  tokenHandler issues access tokens for clients that can't use cookies, such
+  as mobile apps and scripts. On POST, 'grant_type' is either "password", with
+  'username' and 'password', or "refresh_token", with a 'refresh_token' from a
+  previous response. Responds with a short lived signed 'access_token' to send
+  as an 'Authorization: Bearer' header and a 'refresh_token' that can be used
+  once to get new tokens.
+*/
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+    return
+  }
+
+  var user *User
+  var err error
+  switch r.PostFormValue("grant_type") {
+  case "password":
+    user, err = data.UserByName(r.PostFormValue("username"))
+    if err == nil && !crypto.CompareHash(r.PostFormValue("password"), user.Hash) {
+      err = sql.ErrNoRows
+    }
+    if err == sql.ErrNoRows {
+      tokenError(w, r, "invalid_grant", "wrong username or password")
+      return
+    }
+  case "refresh_token":
+    var uid string
+    uid, err = data.TakeRefreshToken(crypto.HashToken(r.PostFormValue("refresh_token")), time.Now())
+    if err == nil {
+      user, err = data.UserByID(uid)
+    }
+    if err == sql.ErrNoRows {
+      tokenError(w, r, "invalid_grant", "unknown or expired refresh token")
+      return
+    }
+  default:
+    tokenError(w, r, "unsupported_grant_type", "expected password or refresh_token")
+    return
+  }
+  if err != nil {
+    util.WriteProblem(w, r, util.Internal(err))
+    return
+  }
+
+  tokens, err := issueTokens(user)
+  if err != nil {
+    util.WriteProblem(w, r, util.Internal(err))
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Cache-Control", "no-store")
+  json.NewEncoder(w).Encode(tokens)
+}
+
+/*
+  keysHandler manages the API keys of the authenticated user. API keys don't
+  expire and are meant for service accounts running scripts.
+  On GET it lists the user's keys.
+  On POST it creates a key called 'name'. The key itself is only ever shown in
+  this response, under 'key'.
+  On DELETE it revokes the key 'id'.
+*/
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+  user := currentUser(r)
+  if user == nil {
+    authError(w, r, "invalid_token", "authentication required")
+    return
+  }
+
+  switch r.Method {
+  case http.MethodGet:
+    keys, err := data.UserAPIKeys(user.UID)
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    if keys == nil {
+      keys = []*apiKey{}
+    }
+    json.NewEncoder(w).Encode(keys)
+  case http.MethodPost:
+    name := r.FormValue("name")
+    if name == "" {
+      util.WriteProblem(w, r, util.InvalidParameter("name", util.FieldRequired, "name is required"))
+      return
+    }
+
+    token, err := crypto.Token(24)
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    token = apiKeyPrefix + token
+
+    k := &apiKey{UID: user.UID, Name: name, Hash: crypto.HashToken(token)}
+    if k.ID, err = data.InsertAPIKey(k); err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(struct {
+      ID   string `json:"id"`
+      Name string `json:"name"`
+      Key  string `json:"key"`
+    }{k.ID, k.Name, token})
+  case http.MethodDelete:
+    rowsAffected, err := data.DeleteAPIKey(r.FormValue("id"), user.UID)
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    if rowsAffected == 0 {
+      util.WriteProblem(w, r, util.NotFound("no API key with id "+strconv.Quote(r.FormValue("id"))))
+    }
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+/*
+  roleHandler manages the roles of users.
+  On GET it returns the username and role of the authenticated user.
+  On PUT it gives the user 'username' the role 'role' (viewer, contributor,
+  editor or admin). Only admins may change roles.
+*/
+func roleHandler(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    user := currentUser(r)
+    if user == nil {
+      authError(w, r, "invalid_token", "authentication required")
+      return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"username": user.Username, "role": user.Role})
+  case http.MethodPut:
+    role := r.FormValue("role")
+    if _, ok := roleRank[role]; !ok {
+      util.WriteProblem(w, r, util.InvalidParameter("role", util.FieldInvalid, "role must be viewer, contributor, editor or admin"))
+      return
+    }
+
+    user, err := data.UserByName(r.FormValue("username"))
+    if err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.NotFound("no user "+strconv.Quote(r.FormValue("username"))))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+
+    if _, err := data.SetRole(user.UID, role); err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"username": user.Username, "role": role})
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
   }
 }
 
@@ -229,235 +400,1384 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 //---- Dictionary Handlers
 //----
 
-// searchHandler returns a collection of unique entries given some query 'q'.
+// searchResponse is the body returned by searchHandler.
+type searchResponse struct {
+  Results    []*d.Match `json:"results"`
+  DidYouMean []string   `json:"did_you_mean,omitempty"`
+  NextCursor string     `json:"next_cursor,omitempty"`
+  Total      int        `json:"total"`
+}
+
+/*
+  searchHandler returns a collection of unique entries given some query 'q'.
+  Results are ordered as exact headword matches, similar headwords, tag and
+  wordtype matches, and finally definition matches ranked by relevance.
+  Headword matches carry a 'similarity' between 0 and 1. Definition matches
+  carry a 'rank' and a 'snippet' of the definition with the matching words
+  wrapped in <mark></mark>. Headwords similar to the query are also suggested
+  in 'did_you_mean'.
+  Results are paginated, see paginatedResults. They may be sorted by 'id' or
+  'headword' instead of relevance.
+  Yugur headwords may be searched for in the transliteration 'scheme', in
+  which headwords are then rendered.
+*/
 func searchHandler(w http.ResponseWriter, r *http.Request) {
   switch r.Method {
   case http.MethodGet:
-    var entries []*d.Entry
+    var matches []*d.Match
+    response := searchResponse{DidYouMean: []string{}}
 
-    query := r.FormValue("q")
+    page, err := parsePage(r, sortRelevance, sortRelevance, sortID, sortHeadword)
+    if err != nil {
+      util.WriteProblem(w, r, asProblem(err))
+      return
+    }
 
-    headwordResults, err := headwordSearch(query)
+    scheme, err := schemeParam(r)
     if err != nil {
-      headwordResults = nil
+      util.WriteProblem(w, r, asProblem(err))
+      return
+    }
+
+    query := r.FormValue("q")
+    // Headwords are also looked up as if the query were written in the
+    // client's scheme, which would mangle queries in other languages if
+    // they were only looked up that way
+    headwords := []string{query}
+    if canonical := transliterate(query, scheme, translit.Canonical); canonical != query {
+      headwords = append(headwords, canonical)
+    }
+
+    for _, headword := range headwords {
+      headwordResults, err := data.HeadwordSearch(headword)
+      if err != nil {
+        headwordResults = nil
+      }
+      for _, m := range d.Matches(headwordResults...) {
+        m.Similarity = 1
+        matches = append(matches, m)
+      }
     }
-    entries = append(entries, headwordResults...)
 
     if len(query) > 1 {
-      tagResults, err := tagSearch(query)
+      var fuzzyResults []*d.Match
+      for _, headword := range headwords {
+        results, err := data.FuzzyHeadwordSearch(headword, entryFilter{}, conf.Search.FuzzyThreshold, maxFuzzy)
+        if err != nil {
+          util.Logger(r.Context()).Error("fuzzy headword search failed", "error", err)
+          results = nil
+        }
+        fuzzyResults = append(fuzzyResults, results...)
+      }
+      sort.SliceStable(fuzzyResults, func(i, j int) bool {
+        return fuzzyResults[i].Similarity > fuzzyResults[j].Similarity
+      })
+      matches = append(matches, fuzzyResults...)
+      response.DidYouMean = suggestions(headwords, fuzzyResults, conf.Search.Suggestions, scheme)
+
+      tagResults, err := data.TagSearch(query)
       if err != nil {
         tagResults = nil
       }
-      entries = append(entries, tagResults...)
+      matches = append(matches, d.Matches(tagResults...)...)
 
-      wordtypeResults, err := wordtypeSearch(query)
+      wordtypeResults, err := data.WordtypeSearch(query)
       if err != nil {
         wordtypeResults = nil
       }
-      entries = append(entries, wordtypeResults...)
+      matches = append(matches, d.Matches(wordtypeResults...)...)
 
-      definitionResults, err := definitionSearch(query)
+      definitionResults, err := data.DefinitionSearch(query, entryFilter{})
       if err != nil {
-        log.Println(err)
-        wordtypeResults = nil
+        util.Logger(r.Context()).Error("definition search failed", "error", err)
+        definitionResults = nil
       }
-      entries = append(entries, definitionResults...)
+      matches = append(matches, definitionResults...)
     }
 
-    entries = d.Set(entries...)
+    matches = d.MatchSet(matches...)
+    response.Total = len(matches)
+    metrics.SearchResults.WithLabelValues("search").Observe(float64(response.Total))
+    response.Results, response.NextCursor = paginate(matches, page)
 
-    response, err := asOutgoing(entries...)
-    if err != nil {
-      util.Error(util.Internal(w, r))
-      return
+    for _, m := range response.Results {
+      if _, err := asOutgoing(m.Entry); err != nil {
+        util.WriteProblem(w, r, util.Internal())
+        return
+      }
+      toScheme(scheme, m.Entry)
     }
-    
+
     json.NewEncoder(w).Encode(response)
   default:
     // Unsupported method
-    http.Error(w, http.StatusText(405), 405)
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+// translation is a candidate translation of a word, with the entry in which
+// it was found.
+type translation struct {
+  Text string `json:"text"`
+  // How the translation was found: "definition" of an entry whose headword
+  // matched, "headword" of an entry whose definition matched, or "relation"
+  // for a translation equivalent of an entry whose headword matched
+  Source string   `json:"source"`
+  Score  float64  `json:"score"`
+  Entry  *d.Entry `json:"entry"`
+}
+
+/*
+  translateHandler returns candidate translations of the word 'q' from the
+  language 'from' into the language 'to', best first.
+  Entries with a headword in 'from' similar to the word contribute their
+  definitions in 'to' and their translation equivalents in 'to'. Entries with
+  a headword in 'to' defined in 'from' contribute their headword if the word
+  appears in their definition. Candidates are scored between 0 and 1 by
+  headword similarity or, for definition matches, by their rank relative to
+  the best.
+*/
+func translateHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+    return
+  }
+
+  query, from, to := r.FormValue("q"), r.FormValue("from"), r.FormValue("to")
+  if query == "" || from == "" || to == "" || from == to {
+    util.WriteProblem(w, r, util.BadRequest(util.CodeInvalidParameter, "q, from and to are required, and from and to must differ"))
+    return
+  }
+  scheme, err := schemeParam(r)
+  if err != nil {
+    util.WriteProblem(w, r, asProblem(err))
+    return
+  }
+  if orthographic(from) {
+    query = transliterate(query, scheme, translit.Canonical)
+  }
+  toID, err := data.LocaleID(to)
+  if err == sql.ErrNoRows {
+    util.WriteProblem(w, r, util.InvalidParameter("to", util.FieldUnknown, "unknown language "+strconv.Quote(to)))
+    return
+  } else if err != nil {
+    util.WriteProblem(w, r, util.Internal())
+    return
+  }
+
+  var candidates []*translation
+  add := func(text, source string, score float64, e *d.Entry) {
+    candidates = append(candidates, &translation{Text: text, Source: source, Score: score, Entry: e})
+  }
+
+  // Headwords in the source language, defined in the target language or
+  // related to translation equivalents in it
+  forward, err := data.FuzzyHeadwordSearch(query, entryFilter{Headword_Language: from}, conf.Search.FuzzyThreshold, maxFuzzy)
+  if err == errUnknownFilter {
+    util.WriteProblem(w, r, util.InvalidParameter("from", util.FieldUnknown, "unknown language "+strconv.Quote(from)))
+    return
+  } else if err != nil {
+    util.WriteProblem(w, r, util.Internal(err))
+    return
+  }
+  for _, m := range forward {
+    if m.Definition_Language == toID {
+      for _, sense := range m.Senses {
+        add(sense.Definition, "definition", m.Similarity, m.Entry)
+      }
+    }
+    for _, relation := range m.Relations {
+      if relation.Type == d.Translation && relation.Language == toID {
+        add(relation.Headword, "relation", m.Similarity, m.Entry)
+      }
+    }
+  }
+
+  // Headwords in the target language whose definitions contain the word
+  reverse, err := data.DefinitionSearch(query, entryFilter{Headword_Language: to, Definition_Language: from})
+  if err != nil {
+    util.WriteProblem(w, r, util.Internal(err))
+    return
+  }
+  for _, m := range reverse {
+    // Scaled by the best rank, unless ts_rank gave nothing to scale by
+    score := reverseWeight
+    if reverse[0].Rank > 0 {
+      score = reverseWeight * m.Rank / reverse[0].Rank
+    }
+    add(m.Headword, "headword", score, m.Entry)
+  }
+
+  // Best first, keeping only the best scoring candidate for each text
+  sort.SliceStable(candidates, func(i, j int) bool {
+    return candidates[i].Score > candidates[j].Score
+  })
+  results := []*translation{}
+  seen := make(map[string]bool)
+  for _, c := range candidates {
+    key := strings.ToLower(c.Text)
+    if seen[key] || len(results) >= maxTranslations {
+      continue
+    }
+    seen[key] = true
+    results = append(results, c)
+  }
+
+  outgoing := make(map[*d.Entry]bool)
+  for _, c := range results {
+    // Every candidate is in the target language
+    c.Text = inScheme(scheme, to, c.Text)
+    if outgoing[c.Entry] {
+      continue
+    }
+    outgoing[c.Entry] = true
+    if _, err := asOutgoing(c.Entry); err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    toScheme(scheme, c.Entry)
   }
+
+  metrics.SearchResults.WithLabelValues("translate").Observe(float64(len(results)))
+  json.NewEncoder(w).Encode(results)
 }
 
-// entryHandler provides Create, Read, Update and Delete access to entries.
+/*
+  entryHandler provides Create, Read, Update and Delete access to entries.
+  Entries may be written either flat, with a single wordtype and definition,
+  or with a list of senses. On GET, 'flat' omits senses and etymology for
+  clients which only understand flat entries.
+  Headwords and examples are written and read in the transliteration
+  'scheme', if given, and stored in the canonical orthography.
+*/
 func entryHandler(w http.ResponseWriter, r *http.Request) {
   switch r.Method {
   case http.MethodGet:
     // Serve the entry
     query := r.FormValue("q")
 
-    entry, err := idSearch(query)
+    scheme, err := schemeParam(r)
     if err != nil {
-      util.Error(util.NotFound(w, r))
+      util.WriteProblem(w, r, asProblem(err))
+      break
+    }
+
+    entry, err := data.IDSearch(query)
+    if err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.NotFound("no entry with id "+strconv.Quote(query)))
+      break
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
       break
     }
 
     response, err := asOutgoing(entry...)
     if err != nil {
-      util.Error(util.Internal(w, r))
+      util.WriteProblem(w, r, util.Internal())
       break
     }
-    
+    toScheme(scheme, response...)
+
+    if flat, _ := strconv.ParseBool(r.FormValue("flat")); flat {
+      for i, e := range response {
+        response[i] = e.Flat()
+      }
+    }
+
     json.NewEncoder(w).Encode(response)
   case http.MethodPost:
     // Create a new entry
-    e := new(d.Entry)
-
-    err := json.NewDecoder(r.Body).Decode(&e)
+    e, err := decodeEntry(r)
     if err != nil {
-      util.Error(util.BadRequest(w, r))
+      util.WriteProblem(w, r, asProblem(err))
       break
     }
 
-    // d.Entry headwords cannot be nil
-    if e.Headword == "" {
-      util.Error(util.BadRequest(w, r))
+    scheme, err := schemeParam(r)
+    if err != nil {
+      util.WriteProblem(w, r, asProblem(err))
       break
     }
+    fromScheme(scheme, e)
 
     request, err := asIncoming(e)
     if err != nil {
-      util.Error(util.BadRequest(w, r))
+      util.WriteProblem(w, r, asProblem(err))
       break
     }
 
-    _, err = insertEntry(request...)
+    _, err = data.InsertEntry(authorID(r), request...)
     if err != nil {
-      util.Error(util.BadRequest(w, r))
+      util.WriteProblem(w, r, asProblem(err))
     }
   case http.MethodPut:
     // Update an existing entry
-    e := new(d.Entry)
-
-    err := json.NewDecoder(r.Body).Decode(&e)
+    e, err := decodeEntry(r)
     if err != nil {
-      util.Error(util.BadRequest(w, r))
+      util.WriteProblem(w, r, asProblem(err))
       break
     }
 
-    // d.Entry headwords cannot be nil
-    if e.Headword == "" {
-      util.Error(util.BadRequest(w, r))
+    scheme, err := schemeParam(r)
+    if err != nil {
+      util.WriteProblem(w, r, asProblem(err))
       break
     }
+    fromScheme(scheme, e)
+    flat := len(e.Senses) == 0
 
     request, err := asIncoming(e)
     if err != nil {
-      util.Error(util.BadRequest(w, r))
+      util.WriteProblem(w, r, asProblem(err))
       break
     }
+    if flat {
+      if err := keepSenses(e); err != nil {
+        util.WriteProblem(w, r, asProblem(err))
+        break
+      }
+    }
 
-    _, err = insertEntry(request...)
+    _, err = data.InsertEntry(authorID(r), request...)
     if err != nil {
-      util.Error(util.BadRequest(w, r))
+      util.WriteProblem(w, r, asProblem(err))
     }
   case http.MethodDelete:
     // Remove an existing entry
     query := r.FormValue("q")
     if query == "" {
-      util.Error(util.BadRequest(w, r))
+      util.WriteProblem(w, r, util.InvalidParameter("q", util.FieldRequired, "q is required"))
+      break
+    }
+
+    audio, err := data.EntryAudio(query)
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal())
       break
     }
 
-    _, err := deleteEntry(query)
+    _, err = data.DeleteEntry(authorID(r), query)
     if err != nil {
-      util.Error(util.Internal(w, r))
+      util.WriteProblem(w, r, util.Internal())
+      break
     }
+    removeBlobs(audio...)
   default:
     // Unsupported method
-    http.Error(w, http.StatusText(405), 405)
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+/*
+  keepSenses keeps the senses of the stored entry when it is updated with only
+  the flat fields, which can't describe more than one sense. The flat
+  wordtype and definition must then be left out or unchanged from the stored
+  entry, otherwise the update is refused with 409 Conflict. e is in database
+  identifiers, see asIncoming.
+*/
+func keepSenses(e *d.Entry) error {
+  if e.ID == "" {
+    return nil
+  }
+  stored, err := data.IDSearch(e.ID)
+  if err == sql.ErrNoRows {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  current := stored[0]
+  if len(current.Senses) < 2 {
+    return nil
+  }
+  current.Normalize()
+
+  unchanged := e.Wordtype == current.Wordtype && e.Definition == current.Definition
+  omitted := e.Wordtype == "" && e.Definition == ""
+  if !unchanged && !omitted {
+    return util.Conflict("entry " + strconv.Quote(e.ID) + " has " + strconv.Itoa(len(current.Senses)) + " senses, send senses to change them")
   }
+  e.Senses = current.Senses
+  e.Normalize()
+  return nil
 }
 
-// fetchHandler provides an index of the entire dictionary for testing purposes.
+// fetchHandler provides a paginated index of the entire dictionary.
+// It may be filtered by 'hw_lang', 'def_lang', 'wordtype' and 'tag'.
 func fetchHandler(w http.ResponseWriter, r *http.Request) {
   switch r.Method {
   case http.MethodGet:
-    entries, err := index()
-    if err != nil {
-      util.Error(util.Internal(w, r))
-    }
-
-    response, err := asOutgoing(entries...)
-    if err != nil {
-      util.Error(util.Internal(w, r))
-      return
+    filter := entryFilter{
+      Headword_Language:   r.FormValue("hw_lang"),
+      Definition_Language: r.FormValue("def_lang"),
+      Wordtype:            r.FormValue("wordtype"),
+      Tag:                 r.FormValue("tag"),
     }
-
-    json.NewEncoder(w).Encode(response)
+    paginatedResults(w, r, filter)
   default:
     // Unsupported method
-    http.Error(w, http.StatusText(405), 405)
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
   }
 }
 
-// Search by category, returns all entries associated with the requested tag
-func tagSearchHandler(w http.ResponseWriter, r *http.Request) {
+/*
+  randomHandler serves a random selection of entries.
+  By default a single entry is returned; up to maxRandom may be requested with
+  'n'. Results can be narrowed with 'hw_lang', 'def_lang', 'wordtype' and 'tag'.
+  If 'daily' is set, the handler instead serves the "word of the day" for the
+  current date (or 'date' as YYYY-MM-DD) which is the same for every client.
+*/
+func randomHandler(w http.ResponseWriter, r *http.Request) {
   switch r.Method {
   case http.MethodGet:
     var entries []*d.Entry
+    var err error
 
-    query := r.FormValue("q")
-
-    entries, err := tagSearch(query)
-    if err != nil {
-      entries = nil
+    filter := entryFilter{
+      Headword_Language:   r.FormValue("hw_lang"),
+      Definition_Language: r.FormValue("def_lang"),
+      Wordtype:            r.FormValue("wordtype"),
+      Tag:                 r.FormValue("tag"),
     }
 
-    response, err := asOutgoing(entries...)
-    if err != nil {
-      util.Error(util.Internal(w, r))
-      return
-    }
-    
-    json.NewEncoder(w).Encode(response)
-  case http.MethodPost:
-    // Add a new tag relationship
-    entryID := r.FormValue("entry")
-    tagID, err := getTagID(r.FormValue("tag"))
+    scheme, err := schemeParam(r)
     if err != nil {
-      http.Error(w, http.StatusText(400), 400)
+      util.WriteProblem(w, r, asProblem(err))
       return
     }
 
-    result, err := db.Exec("INSERT INTO entry_tags VALUES($1, $2)", tagID, entryID)
-    if err != nil {
-      http.Error(w, http.StatusText(500), 500)
-      return
+    daily, _ := strconv.ParseBool(r.FormValue("daily"))
+    if daily {
+      day := time.Now().UTC()
+      if date := r.FormValue("date"); date != "" {
+        day, err = time.Parse("2006-01-02", date)
+        if err != nil {
+          util.WriteProblem(w, r, util.InvalidParameter("date", util.FieldInvalid, "date must be given as YYYY-MM-DD"))
+          return
+        }
+      }
+      entries, err = data.DailySearch(filter, day)
+    } else {
+      n := 1
+      if count := r.FormValue("n"); count != "" {
+        n, err = strconv.Atoi(count)
+        if err != nil || n < 1 {
+          util.WriteProblem(w, r, util.InvalidParameter("n", util.FieldInvalid, "n must be a positive integer"))
+          return
+        }
+      }
+      if n > maxRandom {
+        n = maxRandom
+      }
+      entries, err = data.RandomSearch(filter, n)
     }
 
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-      http.Error(w, http.StatusText(500), 500)
-      return
-    }
-    fmt.Fprintf(w, "Tag Id %d added to entry %d successfully (%d rows affected)\n", tagID, entryID, rowsAffected) 
-  case http.MethodDelete:
-    // Remove a tag relationship
-    entryID := r.FormValue("entry")
-    tagID, err := getTagID(r.FormValue("tag"))
-    if err != nil {
-      http.Error(w, http.StatusText(400), 400)
+    if err == errUnknownFilter {
+      util.WriteProblem(w, r, asProblem(err))
       return
-    }
-
-    result, err := db.Exec("DELETE FROM entry_tags WHERE tag_id = $1 AND entry_id = $2", tagID, entryID)
-    if err != nil {
-      http.Error(w, http.StatusText(500), 500)
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
       return
     }
 
-    rowsAffected, err := result.RowsAffected()
+    response, err := asOutgoing(entries...)
     if err != nil {
-      http.Error(w, http.StatusText(500), 500)
+      util.WriteProblem(w, r, util.Internal())
       return
     }
+    toScheme(scheme, response...)
 
-    if (rowsAffected == 0) {
-      fmt.Fprintf(w, "Tag %s doesn't exist in entry %s (%d rows affected)\n", tagID, entryID, rowsAffected)
-    } else {
-      fmt.Fprintf(w, "Tag %s deleted successfully from entry %s (%d rows affected)\n", tagID, entryID, rowsAffected);
-    }
+    json.NewEncoder(w).Encode(response)
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+// Audio formats accepted for upload and the file extension used to store them
+var audioTypes = map[string]string{
+  "audio/aac":  ".aac",
+  "audio/flac": ".flac",
+  "audio/mp4":  ".m4a",
+  "audio/mpeg": ".mp3",
+  "audio/ogg":  ".ogg",
+  "audio/wav":  ".wav",
+  "audio/webm": ".webm",
+}
+
+/*
+  audioHandler manages recordings of headwords being spoken.
+  On GET it streams the clip 'id' with its content type, honouring Range
+  requests so that clients can seek.
+  On POST it stores a new clip for the entry 'entry', uploaded as the
+  multipart form file 'audio' along with an optional 'speaker'.
+  On DELETE it removes the clip 'id'.
+*/
+func audioHandler(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    f, err := data.AudioFile(r.FormValue("id"))
+    if err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.NotFound("no audio with id "+strconv.Quote(r.FormValue("id"))))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+
+    content, modified, err := blobs.Open(f.Key)
+    if err == blob.ErrNotFound {
+      util.WriteProblem(w, r, util.NotFound("no audio with id "+strconv.Quote(r.FormValue("id"))))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+    defer content.Close()
+
+    w.Header().Set("Content-Type", f.ContentType)
+    http.ServeContent(w, r, f.Key, modified, content)
+  case http.MethodPost:
+    // Allow some room for the rest of the form
+    r.Body = http.MaxBytesReader(w, r.Body, conf.Media.MaxAudioSize+1<<16)
+
+    file, header, err := r.FormFile("audio")
+    if err != nil {
+      util.WriteProblem(w, r, util.InvalidParameter("audio", util.FieldRequired, "audio must be uploaded as a multipart file"))
+      return
+    }
+    defer file.Close()
+    if header.Size > conf.Media.MaxAudioSize {
+      util.WriteProblem(w, r, util.TooLarge(fmt.Sprintf("audio may be at most %d bytes", conf.Media.MaxAudioSize)))
+      return
+    }
+
+    entryID := r.FormValue("entry")
+    if _, err := data.IDSearch(entryID); err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.NotFound("no entry with id "+strconv.Quote(entryID)))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+
+    contentType, err := audioType(file, header.Header.Get("Content-Type"))
+    if err != nil {
+      util.WriteProblem(w, r, util.UnsupportedMediaType(err.Error()))
+      return
+    }
+
+    key, err := crypto.Token(16)
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    key += audioTypes[contentType]
+
+    size, err := blobs.Put(key, file)
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+
+    f := &audioFile{
+      EntryID:     entryID,
+      Key:         key,
+      ContentType: contentType,
+      Speaker:     r.FormValue("speaker"),
+      Size:        size,
+    }
+    f.ID, err = data.InsertAudio(f)
+    if err != nil {
+      blobs.Delete(key)
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+
+    info := f.info()
+    info.URL = audioURL(f.ID)
+    json.NewEncoder(w).Encode(info)
+  case http.MethodDelete:
+    id := r.FormValue("id")
+    f, err := data.AudioFile(id)
+    if err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.NotFound("no audio with id "+strconv.Quote(id)))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+
+    if _, err := data.DeleteAudio(id); err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    removeBlobs(f)
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+/*
+  relationHandler manages the typed links between entries.
+  On GET it lists the relations of the entry 'entry'.
+  On POST it links 'entry' to 'related' with the relation 'type' (synonym,
+  antonym, see_also, translation, derived_from or derivative) and on DELETE
+  it removes that link. Symmetric relations may be given from either end.
+  Both return the updated relations of 'entry'.
+*/
+func relationHandler(w http.ResponseWriter, r *http.Request) {
+  entryID := r.FormValue("entry")
+
+  switch r.Method {
+  case http.MethodGet:
+  case http.MethodPost, http.MethodDelete:
+    relatedID, kind := r.FormValue("related"), r.FormValue("type")
+    if d.Inverse(kind) == "" {
+      util.WriteProblem(w, r, util.InvalidParameter("type", util.FieldUnknown, "unknown relation type "+strconv.Quote(kind)))
+      return
+    }
+    if entryID == relatedID {
+      util.WriteProblem(w, r, util.InvalidParameter("related", util.FieldInvalid, "an entry can't be related to itself"))
+      return
+    }
+
+    entries, err := data.IDSearch(entryID, relatedID)
+    if err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.NotFound("no entry with id "+strconv.Quote(entryID)+" or "+strconv.Quote(relatedID)))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    // Translation equivalents must be in different languages
+    if kind == d.Translation && entries[0].Headword_Language == entries[1].Headword_Language {
+      util.WriteProblem(w, r, util.InvalidParameter("related", util.FieldInvalid, "translation equivalents must be in different languages"))
+      return
+    }
+
+    link := canonicalRelation(entryID, relatedID, kind)
+    if r.Method == http.MethodPost {
+      _, err = data.AddRelation(link)
+    } else {
+      var rowsAffected int64
+      rowsAffected, err = data.RemoveRelation(link)
+      if err == nil && rowsAffected == 0 {
+        util.WriteProblem(w, r, util.NotFound("no such relation"))
+        return
+      }
+    }
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+    return
+  }
+
+  if _, err := data.IDSearch(entryID); err == sql.ErrNoRows {
+    util.WriteProblem(w, r, util.NotFound("no entry with id "+strconv.Quote(entryID)))
+    return
+  } else if err != nil {
+    util.WriteProblem(w, r, util.Internal(err))
+    return
+  }
+  relations, err := data.Relations(entryID)
+  if err != nil {
+    util.WriteProblem(w, r, util.Internal())
+    return
+  }
+  if err := outgoingRelations(relations...); err != nil {
+    util.WriteProblem(w, r, util.Internal())
+    return
+  }
+  if relations == nil {
+    relations = []*d.Relation{}
+  }
+  json.NewEncoder(w).Encode(relations)
+}
+
+/*
+  historyHandler serves the revisions of entries.
+  On GET with 'entry' it lists the revisions of the entry, newest first. With
+  'revision' it returns a single revision and its snapshot of the entry. With
+  'entry' and 'from' it lists the fields that changed between the revisions
+  'from' and 'to' of the entry, 'to' being the latest if it isn't given.
+  On POST it restores the entry to its snapshot in 'revision', recreating it
+  if it has since been deleted.
+*/
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    entryID := r.FormValue("entry")
+    if id := r.FormValue("revision"); id != "" {
+      rev, err := data.Revision(id)
+      if err == sql.ErrNoRows {
+        util.WriteProblem(w, r, util.NotFound("no revision with id "+strconv.Quote(id)))
+        return
+      } else if err != nil {
+        util.WriteProblem(w, r, util.Internal())
+        return
+      }
+      if _, err := asOutgoing(rev.Entry); err != nil {
+        util.WriteProblem(w, r, util.Internal())
+        return
+      }
+      json.NewEncoder(w).Encode(rev)
+      return
+    }
+
+    revisions, err := data.Revisions(entryID)
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    if len(revisions) == 0 {
+      util.WriteProblem(w, r, util.NotFound("no revisions of entry "+strconv.Quote(entryID)))
+      return
+    }
+    if r.FormValue("from") == "" {
+      json.NewEncoder(w).Encode(revisions)
+      return
+    }
+
+    to := r.FormValue("to")
+    if to == "" {
+      to = revisions[0].ID
+    }
+    var snapshots []*d.Entry
+    for _, id := range []string{r.FormValue("from"), to} {
+      rev, err := data.Revision(id)
+      if err == sql.ErrNoRows || (err == nil && rev.EntryID != entryID) {
+        util.WriteProblem(w, r, util.NotFound("no revision with id "+strconv.Quote(id)+" of entry "+strconv.Quote(entryID)))
+        return
+      } else if err != nil {
+        util.WriteProblem(w, r, util.Internal())
+        return
+      }
+      snapshots = append(snapshots, rev.Entry)
+    }
+    if _, err := asOutgoing(snapshots...); err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+
+    changes := d.Diff(snapshots[0], snapshots[1])
+    if changes == nil {
+      changes = []d.Change{}
+    }
+    json.NewEncoder(w).Encode(struct {
+      From    string     `json:"from"`
+      To      string     `json:"to"`
+      Changes []d.Change `json:"changes"`
+    }{r.FormValue("from"), to, changes})
+  case http.MethodPost:
+    rev, err := data.Revision(r.FormValue("revision"))
+    if err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.NotFound("no revision with id "+strconv.Quote(r.FormValue("revision"))))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+
+    if err := data.RestoreEntry(authorID(r), rev.Entry); err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+    restored, err := asOutgoing(rev.Entry)
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    json.NewEncoder(w).Encode(restored)
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+/*
+  proposalHandler lets contributors propose changes to entries for an editor
+  to review, see reviewHandler.
+  On GET with 'id' it returns a single proposal. Otherwise editors get the
+  review queue, the proposals with 'status' (default "pending"), and
+  everyone else gets their own proposals. Editors may add 'mine=true' to see
+  their own. Proposals are listed oldest first.
+  On POST it proposes the entry in the body: an edit to the entry with that
+  ID, or a new entry if it has none.
+  On PUT it replaces the entry of the proposal 'id' and resubmits it for
+  review. Only the author may revise a proposal and only until it has been
+  approved or rejected.
+*/
+func proposalHandler(w http.ResponseWriter, r *http.Request) {
+  user := currentUser(r)
+  if user == nil {
+    authError(w, r, "invalid_token", "authentication required")
+    return
+  }
+
+  switch r.Method {
+  case http.MethodGet:
+    if id := r.FormValue("id"); id != "" {
+      p, err := data.Proposal(id)
+      if err == sql.ErrNoRows || (err == nil && p.AuthorID != user.UID && !hasRole(user, roleEditor)) {
+        util.WriteProblem(w, r, util.NotFound("no proposal with id "+strconv.Quote(id)))
+        return
+      } else if err != nil {
+        util.WriteProblem(w, r, util.Internal())
+        return
+      }
+      writeProposal(w, r, p)
+      return
+    }
+
+    var proposals []*proposal
+    var err error
+    if hasRole(user, roleEditor) && r.FormValue("mine") != "true" {
+      status := r.FormValue("status")
+      if status == "" {
+        status = statusPending
+      }
+      proposals, err = data.Proposals(status, "")
+    } else {
+      proposals, err = data.Proposals(r.FormValue("status"), user.UID)
+    }
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    for _, p := range proposals {
+      if _, err := asOutgoing(p.Entry); err != nil {
+        util.WriteProblem(w, r, util.Internal())
+        return
+      }
+    }
+    if proposals == nil {
+      proposals = []*proposal{}
+    }
+    json.NewEncoder(w).Encode(proposals)
+  case http.MethodPost, http.MethodPut:
+    var p *proposal
+    if r.Method == http.MethodPut {
+      var err error
+      p, err = data.Proposal(r.FormValue("id"))
+      if err == sql.ErrNoRows || (err == nil && p.AuthorID != user.UID) {
+        util.WriteProblem(w, r, util.NotFound("no proposal with id "+strconv.Quote(r.FormValue("id"))))
+        return
+      } else if err != nil {
+        util.WriteProblem(w, r, util.Internal())
+        return
+      }
+      if p.Status != statusPending && p.Status != statusChangesRequested {
+        util.WriteProblem(w, r, util.Conflict("the proposal has already been "+p.Status))
+        return
+      }
+    }
+
+    e, err := decodeEntry(r)
+    if err != nil {
+      util.WriteProblem(w, r, asProblem(err))
+      return
+    }
+    // An edit is based on the entry as it is now
+    var base string
+    if e.ID != "" {
+      if _, err := data.IDSearch(e.ID); err == sql.ErrNoRows {
+        util.WriteProblem(w, r, util.NotFound("no entry with id "+strconv.Quote(e.ID)))
+        return
+      } else if err != nil {
+        util.WriteProblem(w, r, util.Internal())
+        return
+      }
+      revisions, err := data.Revisions(e.ID)
+      if err != nil {
+        util.WriteProblem(w, r, util.Internal(err))
+        return
+      }
+      if len(revisions) > 0 {
+        base = revisions[0].ID
+      }
+    }
+    if _, err := asIncoming(e); err != nil {
+      util.WriteProblem(w, r, asProblem(err))
+      return
+    }
+
+    if r.Method == http.MethodPost {
+      p = &proposal{EntryID: e.ID, BaseRevision: base, AuthorID: user.UID, Entry: e, Status: statusPending}
+      id, err := data.InsertProposal(p)
+      if err != nil {
+        util.WriteProblem(w, r, util.Internal(err))
+        return
+      }
+      p, _ = data.Proposal(id)
+    } else {
+      // A proposal can't be moved to another entry
+      if e.ID != p.EntryID {
+        util.WriteProblem(w, r, util.Conflict("a proposal can't be moved to another entry"))
+        return
+      }
+
+      p.Entry, p.BaseRevision, p.Status, p.Comment, p.ReviewerID = e, base, statusPending, "", ""
+      rowsAffected, err := data.UpdateProposal(p, statusPending, statusChangesRequested)
+      if err != nil {
+        util.WriteProblem(w, r, util.Internal(err))
+        return
+      }
+      // Reviewed since it was read above
+      if rowsAffected == 0 {
+        util.WriteProblem(w, r, util.Conflict("the proposal has been reviewed in the meantime"))
+        return
+      }
+      p, _ = data.Proposal(p.ID)
+    }
+    writeProposal(w, r, p)
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+/*
+  reviewHandler lets editors decide on proposals. On POST it makes the
+  'decision' on the pending proposal 'id': "approve" applies the proposed
+  entry as its author would have, "reject" closes it and "request_changes"
+  returns it to its author to revise. Rejections and requests for changes
+  must give a 'comment' for the author.
+*/
+func reviewHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+    return
+  }
+  reviewer := currentUser(r)
+  if reviewer == nil {
+    authError(w, r, "invalid_token", "authentication required")
+    return
+  }
+
+  p, err := data.Proposal(r.FormValue("id"))
+  if err == sql.ErrNoRows {
+    util.WriteProblem(w, r, util.NotFound("no proposal with id "+strconv.Quote(r.FormValue("id"))))
+    return
+  } else if err != nil {
+    util.WriteProblem(w, r, util.Internal())
+    return
+  }
+  if p.Status != statusPending {
+    util.WriteProblem(w, r, util.Conflict("only pending proposals can be reviewed"))
+    return
+  }
+
+  p.Comment = r.FormValue("comment")
+  p.ReviewerID = reviewer.UID
+  switch r.FormValue("decision") {
+  case "approve":
+    p.Status = statusApproved
+  case "reject":
+    p.Status = statusRejected
+  case "request_changes":
+    p.Status = statusChangesRequested
+  default:
+    util.WriteProblem(w, r, util.InvalidParameter("decision", util.FieldInvalid, "decision must be approve, reject or request_changes"))
+    return
+  }
+  if p.Status != statusApproved && p.Comment == "" {
+    util.WriteProblem(w, r, util.InvalidParameter("comment", util.FieldRequired, "a comment is required unless approving"))
+    return
+  }
+
+  // The proposal must still be pending when the decision is saved, so that
+  // concurrent reviews can't both take effect
+  var rowsAffected int64
+  if p.Status == statusApproved {
+    rowsAffected, err = data.ApproveProposal(p)
+  } else {
+    rowsAffected, err = data.UpdateProposal(p, statusPending)
+  }
+  if err == errEntryDeleted || err == errEntryChanged {
+    util.WriteProblem(w, r, util.Conflict(err.Error()))
+    return
+  } else if err != nil {
+    util.WriteProblem(w, r, util.Internal(err))
+    return
+  }
+  if rowsAffected == 0 {
+    util.WriteProblem(w, r, util.Conflict("only pending proposals can be reviewed"))
+    return
+  }
+  p, _ = data.Proposal(p.ID)
+  writeProposal(w, r, p)
+}
+
+/*
+  importHandler imports many entries at once. On POST it reads entries from
+  the body in the 'format' given, or else implied by the Content-Type: "csv"
+  with a header row naming the columns, "jsonl" with one JSON entry per line
+  or "text" with five lines per entry as used by scripts/populate.sh.
+  Either every entry is written, in a single transaction, or none are: if
+  any row is invalid the response is 422 Unprocessable Entity and lists the
+  problem with each row. With 'dry_run=true' rows are only validated.
+  Headwords and examples may be written in the transliteration 'scheme'.
+*/
+func importHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+    return
+  }
+
+  format := importFormat(r.URL.Query().Get("format"))
+  if format == "" {
+    format = importFormat(r.Header.Get("Content-Type"))
+  }
+  if format == "" {
+    util.WriteProblem(w, r, util.UnsupportedMediaType("format must be csv, jsonl or text, given by format or the Content-Type"))
+    return
+  }
+  scheme, err := schemeParam(r)
+  if err != nil {
+    util.WriteProblem(w, r, asProblem(err))
+    return
+  }
+
+  r.Body = http.MaxBytesReader(w, r.Body, conf.Import.MaxSize)
+  rows, errs, err := parseImport(r.Body, format)
+  if _, ok := err.(*http.MaxBytesError); ok {
+    util.WriteProblem(w, r, util.TooLarge(fmt.Sprintf("imports may be at most %d bytes", conf.Import.MaxSize)))
+    return
+  } else if err != nil {
+    util.WriteProblem(w, r, util.BadRequest(util.CodeInvalidBody, err.Error()))
+    return
+  }
+
+  for _, row := range rows {
+    fromScheme(scheme, row.Entry)
+  }
+
+  dryRun := r.URL.Query().Get("dry_run") == "true"
+  result, err := importEntries(authorID(r), rows, errs, dryRun)
+  if err != nil {
+    util.WriteProblem(w, r, util.Internal(err))
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  if len(result.Errors) > 0 {
+    w.WriteHeader(http.StatusUnprocessableEntity)
+  }
+  json.NewEncoder(w).Encode(result)
+}
+
+/*
+  suggestHandler completes the prefix 'q' with up to 'limit' headwords,
+  for suggestions as the user types. Suggestions may be limited to the
+  headword language 'hw_lang' and definition language 'def_lang'. Exact
+  matches come first, then shorter headwords. The prefix may be written,
+  and headwords are rendered, in the transliteration 'scheme'.
+*/
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+    return
+  }
+
+  limit := defaultSuggestions
+  if value := r.FormValue("limit"); value != "" {
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 1 {
+      util.WriteProblem(w, r, util.InvalidParameter("limit", util.FieldInvalid, "limit must be a positive integer"))
+      return
+    }
+    limit = n
+  }
+  if limit > maxSuggestions {
+    limit = maxSuggestions
+  }
+
+  scheme, err := schemeParam(r)
+  if err != nil {
+    util.WriteProblem(w, r, asProblem(err))
+    return
+  }
+
+  var suggestions []*suggestion
+  if prefix := strings.TrimSpace(r.FormValue("q")); prefix != "" {
+    filter := entryFilter{
+      Headword_Language:   r.FormValue("hw_lang"),
+      Definition_Language: r.FormValue("def_lang"),
+    }
+    // As in searchHandler, the prefix is completed both as it is and as
+    // if it were written in the client's scheme
+    prefixes := []string{prefix}
+    if canonical := transliterate(prefix, scheme, translit.Canonical); canonical != prefix {
+      prefixes = append([]string{canonical}, prefixes...)
+    }
+    seen := make(map[suggestion]bool)
+    for _, p := range prefixes {
+      results, err := data.SuggestHeadwords(p, filter, limit)
+      if err == errUnknownFilter {
+        util.WriteProblem(w, r, asProblem(err))
+        return
+      } else if err != nil {
+        util.WriteProblem(w, r, util.Internal(err))
+        return
+      }
+      for _, sg := range results {
+        key := suggestion{Headword: sg.Headword, Language: sg.Language}
+        if !seen[key] && len(suggestions) < limit {
+          seen[key] = true
+          suggestions = append(suggestions, sg)
+        }
+      }
+    }
+  }
+  for _, sg := range suggestions {
+    code, err := data.LocaleCode(sg.Language)
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+    sg.Language = code
+    sg.Headword = inScheme(scheme, code, sg.Headword)
+  }
+  if suggestions == nil {
+    suggestions = []*suggestion{}
+  }
+  metrics.SearchResults.WithLabelValues("suggest").Observe(float64(len(suggestions)))
+
+  // Suggestions are requested on every keystroke, so let clients reuse them
+  w.Header().Set("Cache-Control", "public, max-age=60")
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(suggestions)
+}
+
+/*
+  exportHandler downloads the dictionary in the 'format' given: "lift",
+  "tei" (TEI Lex-0) or "csv". Like fetchHandler it may be filtered by
+  'hw_lang', 'def_lang', 'wordtype' and 'tag'. Entries are streamed as they
+  are read so that the whole dictionary is never held in memory. An error
+  part way through can only be logged, leaving the download truncated.
+*/
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+    return
+  }
+  format, ok := exportFormats[r.FormValue("format")]
+  if !ok {
+    util.WriteProblem(w, r, util.InvalidParameter("format", util.FieldInvalid, "format must be lift, tei or csv"))
+    return
+  }
+  filter := entryFilter{
+    Headword_Language:   r.FormValue("hw_lang"),
+    Definition_Language: r.FormValue("def_lang"),
+    Wordtype:            r.FormValue("wordtype"),
+    Tag:                 r.FormValue("tag"),
+  }
+
+  w.Header().Set("Content-Type", format.ContentType)
+  w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+    "filename": "yugur" + format.Extension,
+  }))
+  flush := func() {
+    if f, ok := w.(http.Flusher); ok {
+      f.Flush()
+    }
+  }
+
+  x := format.New(w)
+  err := x.Begin()
+  if err == nil {
+    err = exportEntries(filter, x.Entry, flush)
+  }
+  if err == nil {
+    err = x.End()
+  }
+  if err != nil {
+    util.Logger(r.Context()).Error("export failed", "format", r.FormValue("format"), "error", err)
+  }
+}
+
+/*
+  bundleHandler serves offline dictionaries for a language pair, see
+  generateBundle. On GET with 'hw_lang' and 'def_lang' it returns the
+  manifest of the latest bundles, if they have been generated; clients poll
+  its version, or send its ETag in If-None-Match, to know when to download
+  them again. On GET with 'file' it downloads a file of a bundle. On POST
+  with 'hw_lang' and 'def_lang' it regenerates the bundles.
+*/
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+  if key := r.FormValue("file"); key != "" && r.Method == http.MethodGet {
+    parts := strings.SplitN(key, ".", 3)
+    if len(parts) != 3 || parts[0] != "bundle" || !strings.HasPrefix(parts[1], "v") {
+      util.WriteProblem(w, r, util.NotFound("no bundle file "+strconv.Quote(key)))
+      return
+    }
+    content, modified, err := blobs.Open(key)
+    if err == blob.ErrNotFound || err == blob.ErrBadKey {
+      util.WriteProblem(w, r, util.NotFound("no bundle file "+strconv.Quote(key)))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+    defer content.Close()
+
+    // Files are never changed, only replaced by a new version
+    w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": parts[2]}))
+    http.ServeContent(w, r, parts[2], modified, content)
+    return
+  }
+
+  if r.Method != http.MethodGet && r.Method != http.MethodPost {
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+    return
+  }
+
+  hw, def := r.FormValue("hw_lang"), r.FormValue("def_lang")
+  for _, param := range []string{"hw_lang", "def_lang"} {
+    if r.FormValue(param) == "" {
+      util.WriteProblem(w, r, util.InvalidParameter(param, util.FieldRequired, param+" is required"))
+      return
+    }
+  }
+  for _, code := range []string{hw, def} {
+    if _, err := data.LocaleID(code); err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.NotFound("unknown language "+strconv.Quote(code)))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal())
+      return
+    }
+  }
+
+  var m *bundleManifest
+  var err error
+  if r.Method == http.MethodGet {
+    // Generating is left to editors and the schedule, see scheduleBundles
+    m, err = loadBundle(hw, def)
+    if err == blob.ErrNotFound {
+      util.WriteProblem(w, r, util.NotFound("no bundle has been generated for "+hw+" to "+def+" yet"))
+      return
+    }
+  } else {
+    m, err = generateBundle(hw, def)
+  }
+  if err != nil {
+    util.WriteProblem(w, r, util.Internal(err))
+    return
+  }
+
+  etag := `"` + strconv.Itoa(m.Version) + "-" + m.Checksum[:16] + `"`
+  w.Header().Set("ETag", etag)
+  if r.Method == http.MethodGet && r.Header.Get("If-None-Match") == etag {
+    w.WriteHeader(http.StatusNotModified)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(m)
+}
+
+// transliteration is the body returned by transliterateHandler.
+type transliteration struct {
+  Text string `json:"text"`
+  From string `json:"from"`
+  To   string `json:"to"`
+}
+
+/*
+  transliterateHandler converts 'text' from the transliteration scheme
+  'from' to 'to'. Without any text it lists the schemes instead.
+*/
+func transliterateHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  text := r.FormValue("text")
+  if text == "" {
+    json.NewEncoder(w).Encode(translit.Schemes())
+    return
+  }
+
+  from, to := r.FormValue("from"), r.FormValue("to")
+  if from == "" {
+    from = translit.Canonical
+  }
+  if to == "" {
+    to = translit.Canonical
+  }
+  for _, param := range []struct{ name, scheme string }{{"from", from}, {"to", to}} {
+    if !translit.Valid(param.scheme) {
+      util.WriteProblem(w, r, util.InvalidParameter(param.name, util.FieldUnknown, "unknown orthography "+strconv.Quote(param.scheme)))
+      return
+    }
+  }
+  converted, err := translit.Convert(text, from, to)
+  if err != nil {
+    util.WriteProblem(w, r, util.Internal())
+    return
+  }
+  json.NewEncoder(w).Encode(transliteration{Text: converted, From: from, To: to})
+}
+
+// tagChange is the body returned when a tag is added to or removed from an
+// entry. Changed is 0 if the entry already had, or didn't have, the tag.
+type tagChange struct {
+  Entry   string `json:"entry"`
+  Tag     string `json:"tag"`
+  Changed int64  `json:"changed"`
+}
+
+/*
+  tagSearchHandler searches by category. On GET it returns a page of the
+  entries with the tag 'q'. On POST and DELETE it adds the tag 'tag' to, or
+  removes it from, the entry 'entry'.
+*/
+func tagSearchHandler(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    paginatedResults(w, r, entryFilter{Tag: r.FormValue("q")})
+  case http.MethodPost, http.MethodDelete:
+    entryID, tag := r.FormValue("entry"), r.FormValue("tag")
+    tagID, err := data.TagID(tag)
+    if err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.InvalidParameter("tag", util.FieldUnknown, "unknown tag "+strconv.Quote(tag)))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+    if _, err := data.IDSearch(entryID); err == sql.ErrNoRows {
+      util.WriteProblem(w, r, util.NotFound("no entry with id "+strconv.Quote(entryID)))
+      return
+    } else if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+
+    var rowsAffected int64
+    if r.Method == http.MethodPost {
+      rowsAffected, err = data.AddTag(tagID, entryID)
+    } else {
+      rowsAffected, err = data.RemoveTag(tagID, entryID)
+    }
+    if err != nil {
+      util.WriteProblem(w, r, util.Internal(err))
+      return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(tagChange{Entry: entryID, Tag: tag, Changed: rowsAffected})
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
   }
 }
 
@@ -465,6 +1785,124 @@ func tagSearchHandler(w http.ResponseWriter, r *http.Request) {
 //---- HTTP Helper Functions
 //---------------------------------------------------------
 
+/*
+  paginatedResults serves a page of the entries matching filter.
+  Clients may ask for up to the configured maximum of entries with 'limit',
+  order them by 'sort' ("id" or "headword", prefixed with "-" to reverse) and
+  continue from a previous page by passing its 'next_cursor' as 'cursor'.
+  Filters naming unknown values match nothing. Headwords are rendered in the
+  transliteration 'scheme'.
+*/
+func paginatedResults(w http.ResponseWriter, r *http.Request, filter entryFilter) {
+  page, err := parsePage(r, sortID, sortID, sortHeadword)
+  if err != nil {
+    util.WriteProblem(w, r, asProblem(err))
+    return
+  }
+  scheme, err := schemeParam(r)
+  if err != nil {
+    util.WriteProblem(w, r, asProblem(err))
+    return
+  }
+
+  entries, next, total, err := data.EntryPage(filter, page)
+  if err != nil && err != errUnknownFilter {
+    util.WriteProblem(w, r, util.Internal(err))
+    return
+  }
+
+  results, err := asOutgoing(entries...)
+  if err != nil {
+    util.WriteProblem(w, r, util.Internal())
+    return
+  }
+  toScheme(scheme, results...)
+  if results == nil {
+    results = []*d.Entry{}
+  }
+
+  json.NewEncoder(w).Encode(pageResponse{Results: results, NextCursor: next, Total: total})
+}
+
+// audioType works out the content type of an uploaded clip from its contents,
+// falling back to the type declared by the client for containers that can't
+// be told apart by sniffing. Raises an error for anything but known audio.
+func audioType(file io.ReadSeeker, declared string) (string, error) {
+  head := make([]byte, 512)
+  n, err := io.ReadFull(file, head)
+  if err != nil && err != io.ErrUnexpectedEOF {
+    return "", err
+  }
+  if _, err := file.Seek(0, io.SeekStart); err != nil {
+    return "", err
+  }
+
+  sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+  declared, _, _ = mime.ParseMediaType(declared)
+  switch sniffed {
+  case "application/ogg":
+    sniffed = "audio/ogg"
+  case "audio/wave":
+    sniffed = "audio/wav"
+  case "application/octet-stream", "video/webm", "video/mp4":
+    sniffed = declared
+  }
+
+  if _, ok := audioTypes[sniffed]; !ok {
+    return "", fmt.Errorf("unsupported audio type %q", sniffed)
+  }
+  return sniffed, nil
+}
+
+// audioURL returns the URL from which a clip can be streamed.
+func audioURL(id string) string {
+  return conf.Endpoints.Audio.Path + "?id=" + url.QueryEscape(id)
+}
+
+// removeBlobs deletes the stored data of audio clips, logging any failures.
+func removeBlobs(files ...*audioFile) {
+  for _, f := range files {
+    if err := blobs.Delete(f.Key); err != nil && err != blob.ErrNotFound {
+      slog.Warn("failed to remove audio", "key", f.Key, "error", err)
+    }
+  }
+}
+
+// writeProposal serves a proposal with the human names of its entry.
+func writeProposal(w http.ResponseWriter, r *http.Request, p *proposal) {
+  if _, err := asOutgoing(p.Entry); err != nil {
+    util.WriteProblem(w, r, util.Internal())
+    return
+  }
+  json.NewEncoder(w).Encode(p)
+}
+
+// suggestions returns up to n distinct headwords from the matches that differ
+// from the queries, in order, rendered in scheme.
+func suggestions(queries []string, matches []*d.Match, n int, scheme string) []string {
+  result := []string{}
+  seen := make(map[string]bool)
+  for _, query := range queries {
+    seen[strings.ToLower(query)] = true
+  }
+  for _, m := range matches {
+    if len(result) >= n {
+      break
+    }
+    key := strings.ToLower(m.Headword)
+    if seen[key] {
+      continue
+    }
+    seen[key] = true
+    headword := m.Headword
+    if code, err := data.LocaleCode(m.Headword_Language); err == nil {
+      headword = inScheme(scheme, code, headword)
+    }
+    result = append(result, headword)
+  }
+  return result
+}
+
 // render uses html/template to serve a template page.
 func render(w http.ResponseWriter, filename string, data interface{}) {
   tmpl, err := template.ParseFiles(filename)
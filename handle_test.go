@@ -0,0 +1,1878 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "encoding/xml"
+  "errors"
+  "log"
+  "log/slog"
+  "io"
+  "mime/multipart"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/gorilla/sessions"
+  "github.com/yugur/api/blob"
+  "github.com/yugur/api/config"
+  "github.com/yugur/api/crypto"
+  d "github.com/yugur/api/entry"
+  "github.com/yugur/api/metrics"
+  "github.com/yugur/api/migrations"
+  "github.com/yugur/api/util"
+  "golang.org/x/crypto/bcrypt"
+)
+
+// newTestStore returns a memStore holding a copy of the demo dictionary.
+func newTestStore(t *testing.T) *memStore {
+  conf = config.Defaults()
+  s := newMemStore()
+
+  for _, lang := range [][2]string{{"English (AU)", "en-AU"}, {"Western Yugur", "yge"}} {
+    if _, err := s.CreateLanguage(lang[0], lang[1]); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, wordtype := range []string{"noun", "verb", "adjective"} {
+    if _, err := s.CreateWordtype(wordtype); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, tag := range []string{"fire", "flame"} {
+    if _, err := s.CreateTag(tag); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  data = s
+  entries, err := asIncoming(
+    &d.Entry{Headword: "fire", Wordtype: "noun", Definition: "Burning fuel or other material: a cooking fire; a forest fire.", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+    &d.Entry{Headword: "fire", Wordtype: "noun", Definition: "Burning intensity of feeling; ardor.", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+    &d.Entry{Headword: "zeal", Wordtype: "noun", Definition: "great energy or enthusiasm in pursuit of a cause or an objective.", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+  )
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := s.InsertEntry("", entries...); err != nil {
+    t.Fatal(err)
+  }
+
+  // Tag zeal with "fire", as in scripts/demo.sql
+  zeal, _ := s.HeadwordSearch("zeal")
+  tagID, _ := s.TagID("fire")
+  if _, err := s.AddTag(tagID, zeal[0].ID); err != nil {
+    t.Fatal(err)
+  }
+  return s
+}
+
+// serve records the response of handler to a request for target.
+func serve(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+  w := httptest.NewRecorder()
+  handler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+  return w
+}
+
+func decodeEntries(t *testing.T, w *httptest.ResponseRecorder) []*d.Entry {
+  var entries []*d.Entry
+  if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+    t.Fatalf("Failed to decode response: %v", err)
+  }
+  return entries
+}
+
+func decodePage(t *testing.T, w *httptest.ResponseRecorder) []*d.Entry {
+  var response struct {
+    Results []*d.Entry `json:"results"`
+  }
+  if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+    t.Fatalf("Failed to decode response: %v", err)
+  }
+  return response.Results
+}
+
+func decodeSearch(t *testing.T, w *httptest.ResponseRecorder) searchResponse {
+  var response searchResponse
+  if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+    t.Fatalf("Failed to decode response: %v", err)
+  }
+  return response
+}
+
+func TestSearchHandler(t *testing.T) {
+  newTestStore(t)
+
+  tables := []struct {
+    query string
+    count int
+  }{
+    {"fire", 3},
+    {"zeal", 1},
+    {"z", 1},
+    {"noun", 3},
+    {"ardor", 1},
+    {"nothing", 0},
+  }
+
+  for _, table := range tables {
+    w := serve(searchHandler, http.MethodGet, "/search?q="+table.query, "")
+    if w.Code != http.StatusOK {
+      t.Fatalf("Search for %q failed with status %d.", table.query, w.Code)
+    }
+    entries := decodeSearch(t, w).Results
+    if len(entries) != table.count {
+      t.Errorf("Wrong result count for %q. Expected: %d, got: %d.", table.query, table.count, len(entries))
+    }
+    for _, e := range entries {
+      if e.Wordtype != "noun" || e.Headword_Language != "en-AU" {
+        t.Errorf("Entry %s was not converted to human names, got: %+v", e.ID, e)
+      }
+    }
+  }
+}
+
+func TestEntryHandler(t *testing.T) {
+  newTestStore(t)
+
+  body := `{"headword": "ot", "wordtype": "noun", "definition": "fire", "hw_lang": "yge", "def_lang": "en-AU"}`
+  w := serve(entryHandler, http.MethodPost, "/entry", body)
+  if w.Code != http.StatusOK {
+    t.Fatalf("Create failed with status %d.", w.Code)
+  }
+
+  results, _ := data.HeadwordSearch("ot")
+  if len(results) != 1 {
+    t.Fatalf("Expected: %d created entry, got: %d.", 1, len(results))
+  }
+  id := results[0].ID
+
+  w = serve(entryHandler, http.MethodGet, "/entry?q="+id, "")
+  entries := decodeEntries(t, w)
+  if len(entries) != 1 || entries[0].Headword != "ot" || entries[0].Headword_Language != "yge" {
+    t.Errorf("Wrong entry returned, got: %+v", entries)
+  }
+
+  w = serve(entryHandler, http.MethodPost, "/entry", `{"headword": "ot", "wordtype": "particle"}`)
+  if w.Code != http.StatusBadRequest {
+    t.Errorf("Expected: status %d for an unknown wordtype, got: %d.", http.StatusBadRequest, w.Code)
+  }
+
+  w = serve(entryHandler, http.MethodDelete, "/entry?q="+id, "")
+  if w.Code != http.StatusOK {
+    t.Fatalf("Delete failed with status %d.", w.Code)
+  }
+  w = serve(entryHandler, http.MethodGet, "/entry?q="+id, "")
+  if w.Code != http.StatusNotFound {
+    t.Errorf("Expected: status %d after delete, got: %d.", http.StatusNotFound, w.Code)
+  }
+}
+
+func TestTagSearchHandler(t *testing.T) {
+  newTestStore(t)
+
+  entries := decodePage(t, serve(tagSearchHandler, http.MethodGet, "/tag?q=fire", ""))
+  if len(entries) != 1 || entries[0].Headword != "zeal" {
+    t.Errorf("Expected: zeal tagged with fire, got: %+v", entries)
+  }
+
+  fire, _ := data.HeadwordSearch("fire")
+  w := serve(tagSearchHandler, http.MethodPost, "/tag?tag=flame&entry="+fire[0].ID, "")
+  var change tagChange
+  if err := json.NewDecoder(w.Body).Decode(&change); err != nil {
+    t.Fatal(err)
+  }
+  if want := (tagChange{Entry: fire[0].ID, Tag: "flame", Changed: 1}); change != want {
+    t.Errorf("Expected: %+v, got: %+v", want, change)
+  }
+  if entries := decodePage(t, serve(tagSearchHandler, http.MethodGet, "/tag?q=flame", "")); len(entries) != 1 {
+    t.Errorf("Expected: %d entry tagged with flame, got: %d.", 1, len(entries))
+  }
+
+  serve(tagSearchHandler, http.MethodDelete, "/tag?tag=flame&entry="+fire[0].ID, "")
+  if entries := decodePage(t, serve(tagSearchHandler, http.MethodGet, "/tag?q=flame", "")); len(entries) != 0 {
+    t.Errorf("Expected: %d entries tagged with flame, got: %d.", 0, len(entries))
+  }
+
+  if entries := decodePage(t, serve(tagSearchHandler, http.MethodGet, "/tag?q=unknown", "")); len(entries) != 0 {
+    t.Errorf("Expected: %d entries for an unknown tag, got: %d.", 0, len(entries))
+  }
+
+  for _, tc := range []struct {
+    method, target string
+    status         int
+  }{
+    {http.MethodPost, "/tag?tag=flame&entry=999", http.StatusNotFound},
+    {http.MethodDelete, "/tag?tag=flame&entry=999", http.StatusNotFound},
+    {http.MethodPost, "/tag?tag=unknown&entry=" + fire[0].ID, http.StatusBadRequest},
+    {http.MethodPut, "/tag?tag=flame&entry=" + fire[0].ID, http.StatusMethodNotAllowed},
+  } {
+    if w := serve(tagSearchHandler, tc.method, tc.target, ""); w.Code != tc.status {
+      t.Errorf("%s %s: expected: %d, got: %d", tc.method, tc.target, tc.status, w.Code)
+    }
+  }
+}
+
+func TestFetchHandlerPagination(t *testing.T) {
+  newTestStore(t)
+
+  tables := []struct {
+    sort      string
+    headwords []string
+  }{
+    {"id", []string{"fire", "fire", "zeal"}},
+    {"-id", []string{"zeal", "fire", "fire"}},
+    {"headword", []string{"fire", "fire", "zeal"}},
+    {"-headword", []string{"zeal", "fire", "fire"}},
+  }
+
+  for _, table := range tables {
+    var headwords []string
+    seen := make(map[string]bool)
+    cursor := ""
+    for pages := 0; pages < 10; pages++ {
+      w := serve(fetchHandler, http.MethodGet, "/fetch?limit=2&sort="+table.sort+"&cursor="+cursor, "")
+      var response struct {
+        Results    []*d.Entry
+        NextCursor string `json:"next_cursor"`
+        Total      int
+      }
+      if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+        t.Fatalf("Failed to decode response: %v", err)
+      }
+      if response.Total != 3 || len(response.Results) > 2 {
+        t.Fatalf("Wrong page for sort %q. Expected: total %d, at most %d results, got: %d, %d.", table.sort, 3, 2, response.Total, len(response.Results))
+      }
+      for _, e := range response.Results {
+        if seen[e.ID] {
+          t.Errorf("Entry %s repeated across pages for sort %q.", e.ID, table.sort)
+        }
+        seen[e.ID] = true
+        headwords = append(headwords, e.Headword)
+      }
+      if cursor = response.NextCursor; cursor == "" {
+        break
+      }
+    }
+    if strings.Join(headwords, ",") != strings.Join(table.headwords, ",") {
+      t.Errorf("Wrong order for sort %q. Expected: %v, got: %v.", table.sort, table.headwords, headwords)
+    }
+  }
+
+  for _, target := range []string{"/fetch?limit=0", "/fetch?sort=relevance", "/fetch?cursor=nonsense"} {
+    if w := serve(fetchHandler, http.MethodGet, target, ""); w.Code != http.StatusBadRequest {
+      t.Errorf("Expected: status %d for %s, got: %d.", http.StatusBadRequest, target, w.Code)
+    }
+  }
+
+  conf.Pagination.MaxLimit = 1
+  if entries := decodePage(t, serve(fetchHandler, http.MethodGet, "/fetch?limit=100", "")); len(entries) != 1 {
+    t.Errorf("Expected: page size capped at %d, got: %d.", 1, len(entries))
+  }
+}
+
+func TestSearchHandlerPagination(t *testing.T) {
+  newTestStore(t)
+
+  first := decodeSearch(t, serve(searchHandler, http.MethodGet, "/search?q=fire&limit=2", ""))
+  if first.Total != 3 || len(first.Results) != 2 || first.NextCursor == "" {
+    t.Fatalf("Wrong first page, got: total %d, %d results, cursor %q.", first.Total, len(first.Results), first.NextCursor)
+  }
+  second := decodeSearch(t, serve(searchHandler, http.MethodGet, "/search?q=fire&limit=2&cursor="+first.NextCursor, ""))
+  if len(second.Results) != 1 || second.NextCursor != "" || second.Results[0].Headword != "zeal" {
+    t.Errorf("Wrong second page, got: %d results, cursor %q.", len(second.Results), second.NextCursor)
+  }
+
+  // Cursors are tied to their sort order
+  w := serve(searchHandler, http.MethodGet, "/search?q=fire&sort=headword&cursor="+first.NextCursor, "")
+  if w.Code != http.StatusBadRequest {
+    t.Errorf("Expected: status %d for a mismatched cursor, got: %d.", http.StatusBadRequest, w.Code)
+  }
+
+  // Cursors with an ID that isn't an entry ID are refused
+  tampered := base64.RawURLEncoding.EncodeToString([]byte(`{"s":"id","i":"x'"}`))
+  w = serve(fetchHandler, http.MethodGet, "/fetch?cursor="+tampered, "")
+  var p util.Problem
+  if err := json.NewDecoder(w.Body).Decode(&p); err != nil || w.Code != http.StatusBadRequest || len(p.Fields) != 1 || p.Fields[0].Name != "cursor" {
+    t.Errorf("Expected: status %d for a tampered cursor, got: %d %+v.", http.StatusBadRequest, w.Code, p)
+  }
+}
+
+func TestRandomHandler(t *testing.T) {
+  newTestStore(t)
+
+  w := serve(randomHandler, http.MethodGet, "/random?n=2", "")
+  if entries := decodeEntries(t, w); len(entries) != 2 {
+    t.Errorf("Expected: %d random entries, got: %d.", 2, len(entries))
+  }
+
+  w = serve(randomHandler, http.MethodGet, "/random?n=10&tag=fire", "")
+  entries := decodeEntries(t, w)
+  if len(entries) != 1 || entries[0].Headword != "zeal" {
+    t.Errorf("Expected: only zeal for tag fire, got: %+v", entries)
+  }
+
+  first := decodeEntries(t, serve(randomHandler, http.MethodGet, "/random?daily=true&date=2017-09-20", ""))
+  for i := 0; i < 5; i++ {
+    again := decodeEntries(t, serve(randomHandler, http.MethodGet, "/random?daily=true&date=2017-09-20", ""))
+    if len(first) != 1 || len(again) != 1 || first[0].ID != again[0].ID {
+      t.Fatalf("Word of the day changed between requests: %+v, %+v", first, again)
+    }
+  }
+
+  for _, target := range []string{"/random?n=0", "/random?hw_lang=xx", "/random?daily=true&date=today"} {
+    w = serve(randomHandler, http.MethodGet, target, "")
+    if w.Code != http.StatusBadRequest {
+      t.Errorf("Expected: status %d for %s, got: %d.", http.StatusBadRequest, target, w.Code)
+    }
+  }
+}
+
+func TestSearchHandlerSnippets(t *testing.T) {
+  newTestStore(t)
+
+  w := serve(searchHandler, http.MethodGet, "/search?q=Feeling+ARDOR", "")
+  matches := decodeSearch(t, w).Results
+  if len(matches) != 1 {
+    t.Fatalf("Expected: %d match, got: %d.", 1, len(matches))
+  }
+  expected := "Burning intensity of <mark>feeling</mark>; <mark>ardor</mark>."
+  if matches[0].Snippet != expected || matches[0].Rank <= 0 {
+    t.Errorf("Wrong snippet or rank. Expected: %q, got: %q (rank %f).", expected, matches[0].Snippet, matches[0].Rank)
+  }
+
+  // Definitions are escaped, as they are written by users
+  entries, _ := asIncoming(&d.Entry{Headword: "blaze", Wordtype: "noun", Definition: `a <b>bright</b> fire <img src=x onerror="alert(1)">`, Headword_Language: "en-AU", Definition_Language: "en-AU"})
+  data.InsertEntry("", entries...)
+  matches = decodeSearch(t, serve(searchHandler, http.MethodGet, "/search?q=bright", "")).Results
+  expected = "a &lt;b&gt;<mark>bright</mark>&lt;/b&gt; fire &lt;img src=x onerror=&#34;alert(1)&#34;&gt;"
+  if len(matches) != 1 || matches[0].Snippet != expected {
+    t.Errorf("Expected: the escaped snippet %q, got: %+v", expected, matches)
+  }
+
+  // As are snippets highlighted by ts_headline
+  headline := "a <b>" + markStart + "bright" + markStop + "</b> fire"
+  if snippet := markSnippet(headline); snippet != "a &lt;b&gt;<mark>bright</mark>&lt;/b&gt; fire" {
+    t.Errorf("Expected: an escaped headline, got: %q", snippet)
+  }
+  if !strings.Contains(headlineOptions, `StartSel="`+markStart+`"`) || !strings.Contains(headlineOptions, `StopSel="`+markStop+`"`) {
+    t.Errorf("Expected: ts_headline to mark words with markStart and markStop, got: %q", headlineOptions)
+  }
+}
+
+func TestSearchHandlerFuzzy(t *testing.T) {
+  newTestStore(t)
+
+  response := decodeSearch(t, serve(searchHandler, http.MethodGet, "/search?q=fires", ""))
+  if len(response.DidYouMean) != 1 || response.DidYouMean[0] != "fire" {
+    t.Errorf("Expected: did you mean [fire], got: %v", response.DidYouMean)
+  }
+  if len(response.Results) != 2 {
+    t.Fatalf("Expected: %d similar entries, got: %d.", 2, len(response.Results))
+  }
+  for _, m := range response.Results {
+    if m.Headword != "fire" || m.Similarity <= conf.Search.FuzzyThreshold || m.Similarity >= 1 {
+      t.Errorf("Wrong similar entry, got: %+v (similarity %f)", m.Entry, m.Similarity)
+    }
+  }
+
+  // Headwords are compared by their keys, whatever the width, case or script
+  entries, _ := asIncoming(&d.Entry{Headword: "şar", Wordtype: "noun", Definition: "ball", Headword_Language: "yge", Definition_Language: "en-AU"})
+  data.InsertEntry("", entries...)
+  for query, want := range map[string]string{"ＦＩＲＥＳ": "fire", "Fïres": "fire", "шары": "şar"} {
+    response := decodeSearch(t, serve(searchHandler, http.MethodGet, "/search?q="+url.QueryEscape(query), ""))
+    if len(response.DidYouMean) != 1 || response.DidYouMean[0] != want {
+      t.Errorf("Expected: did you mean [%s] for %s, got: %v", want, query, response.DidYouMean)
+    }
+  }
+
+  response = decodeSearch(t, serve(searchHandler, http.MethodGet, "/search?q=fire", ""))
+  if len(response.DidYouMean) != 0 {
+    t.Errorf("Expected: no suggestions for an exact match, got: %v", response.DidYouMean)
+  }
+  if response.Results[0].Similarity != 1 {
+    t.Errorf("Expected: similarity %d for an exact match, got: %f", 1, response.Results[0].Similarity)
+  }
+}
+
+func TestEntryHandlerSenses(t *testing.T) {
+  newTestStore(t)
+
+  body := `{
+    "headword": "fire",
+    "hw_lang": "en-AU",
+    "def_lang": "en-AU",
+    "etymology": "From Old English fȳr",
+    "senses": [
+      {"wordtype": "noun", "definition": "Burning fuel.", "examples": [{"text": "a forest fire"}]},
+      {"wordtype": "verb", "definition": "To dismiss.", "labels": ["informal"]}
+    ]
+  }`
+  w := serve(entryHandler, http.MethodPost, "/entry", body)
+  if w.Code != http.StatusOK {
+    t.Fatalf("Create failed with status %d.", w.Code)
+  }
+
+  results, _ := data.DefinitionSearch("dismiss", entryFilter{})
+  if len(results) != 1 {
+    t.Fatalf("Expected: definitions of every sense to be searchable, got: %d results.", len(results))
+  }
+  id := results[0].ID
+
+  entries := decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?q="+id, ""))
+  e := entries[0]
+  if e.Wordtype != "noun" || e.Definition != "1. Burning fuel. 2. To dismiss." || e.Etymology != "From Old English fȳr" {
+    t.Errorf("Wrong flattened fields, got: %+v", e)
+  }
+  if len(e.Senses) != 2 || e.Senses[1].Wordtype != "verb" || e.Senses[1].Labels[0] != "informal" || e.Senses[0].Examples[0].Text != "a forest fire" {
+    t.Errorf("Wrong senses, got: %+v, %+v", e.Senses[0], e.Senses[1])
+  }
+
+  w = serve(entryHandler, http.MethodGet, "/entry?flat=true&q="+id, "")
+  if strings.Contains(w.Body.String(), "senses") || strings.Contains(w.Body.String(), "etymology") {
+    t.Errorf("Expected: no senses or etymology in a flat entry, got: %s", w.Body.String())
+  }
+
+  // Flat updates keep the senses if they leave the flat fields as they were,
+  // and are refused if they change them
+  flat := `{"id": "` + id + `", "headword": "blaze", "hw_lang": "en-AU", "def_lang": "en-AU", "wordtype": "noun", "definition": "1. Burning fuel. 2. To dismiss."}`
+  if w := serve(entryHandler, http.MethodPut, "/entry", flat); w.Code != http.StatusOK {
+    t.Fatalf("Flat update failed with status %d.", w.Code)
+  }
+  entries = decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?q="+id, ""))
+  if entries[0].Headword != "blaze" || len(entries[0].Senses) != 2 || entries[0].Senses[1].Labels[0] != "informal" {
+    t.Errorf("Expected: the senses kept by a flat update, got: %+v", entries[0])
+  }
+  flat = `{"id": "` + id + `", "headword": "blaze", "hw_lang": "en-AU", "def_lang": "en-AU", "wordtype": "noun", "definition": "Burning fuel."}`
+  if w := serve(entryHandler, http.MethodPut, "/entry", flat); w.Code != http.StatusConflict {
+    t.Errorf("Expected: status 409 changing the definition of several senses, got: %d", w.Code)
+  }
+  if entries := decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?q="+id, "")); len(entries[0].Senses) != 2 {
+    t.Errorf("Expected: the senses kept after a refused update, got: %+v", entries[0].Senses)
+  }
+
+  // Flat entries become a single sense
+  zeal, _ := data.HeadwordSearch("zeal")
+  entries = decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?q="+zeal[0].ID, ""))
+  if len(entries[0].Senses) != 1 || entries[0].Senses[0].Definition != entries[0].Definition {
+    t.Errorf("Expected: a single sense for a flat entry, got: %+v", entries[0].Senses)
+  }
+}
+
+func TestAudioHandler(t *testing.T) {
+  newTestStore(t)
+  conf.Endpoints.Audio.Path = "/audio"
+  blobs = blob.NewMemory()
+
+  fire, _ := data.HeadwordSearch("fire")
+  entryID := fire[0].ID
+
+  // A minimal WAV header followed by silence
+  clip := append([]byte("RIFF\x24\x00\x00\x00WAVEfmt "), make([]byte, 64)...)
+  upload := func(name string, content []byte) *httptest.ResponseRecorder {
+    body := new(bytes.Buffer)
+    form := multipart.NewWriter(body)
+    form.WriteField("entry", entryID)
+    form.WriteField("speaker", "Ayi")
+    part, _ := form.CreateFormFile("audio", name)
+    part.Write(content)
+    form.Close()
+
+    r := httptest.NewRequest(http.MethodPost, "/audio", body)
+    r.Header.Set("Content-Type", form.FormDataContentType())
+    w := httptest.NewRecorder()
+    audioHandler(w, r)
+    return w
+  }
+
+  if w := upload("notes.txt", []byte("not audio at all")); w.Code != http.StatusUnsupportedMediaType {
+    t.Errorf("Expected: status 415 for a text file, got: %d", w.Code)
+  }
+
+  w := upload("fire.wav", clip)
+  if w.Code != http.StatusOK {
+    t.Fatalf("Upload failed with status %d: %s", w.Code, w.Body.String())
+  }
+  var info d.Audio
+  json.NewDecoder(w.Body).Decode(&info)
+  if info.ContentType != "audio/wav" || info.URL != "/audio?id="+info.ID {
+    t.Errorf("Wrong audio info, got: %+v", info)
+  }
+
+  entries := decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?q="+entryID, ""))
+  if len(entries[0].Audio) != 1 || entries[0].Audio[0].URL != info.URL || entries[0].Audio[0].Speaker != "Ayi" {
+    t.Errorf("Expected: the clip listed on its entry, got: %+v", entries[0].Audio)
+  }
+
+  r := httptest.NewRequest(http.MethodGet, info.URL, nil)
+  r.Header.Set("Range", "bytes=0-3")
+  w = httptest.NewRecorder()
+  audioHandler(w, r)
+  if w.Code != http.StatusPartialContent || w.Body.String() != "RIFF" {
+    t.Errorf("Expected: the first four bytes of the clip, got: %d %q", w.Code, w.Body.String())
+  }
+  if w.Header().Get("Content-Type") != "audio/wav" {
+    t.Errorf("Expected: Content-Type audio/wav, got: %s", w.Header().Get("Content-Type"))
+  }
+
+  serve(audioHandler, http.MethodDelete, info.URL, "")
+  if w := serve(audioHandler, http.MethodGet, info.URL, ""); w.Code != http.StatusNotFound {
+    t.Errorf("Expected: status 404 after deleting, got: %d", w.Code)
+  }
+}
+
+func TestEntryHandlerPronunciation(t *testing.T) {
+  newTestStore(t)
+
+  body := `{"headword": "ot", "wordtype": "noun", "definition": "fire", "hw_lang": "yge", "def_lang": "en-AU", "ipa": "ot", "phonetic": "OHT"}`
+  if w := serve(entryHandler, http.MethodPost, "/entry", body); w.Code != http.StatusOK {
+    t.Fatalf("Create failed with status %d.", w.Code)
+  }
+
+  results, _ := data.HeadwordSearch("ot")
+  entries := decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?q="+results[0].ID, ""))
+  if entries[0].IPA != "ot" || entries[0].Phonetic != "OHT" {
+    t.Errorf("Expected: pronunciation to round trip, got: %q, %q", entries[0].IPA, entries[0].Phonetic)
+  }
+}
+
+// failingStore is a store whose entry lookups fail, as with a lost connection.
+type failingStore struct {
+  *memStore
+}
+
+func (s failingStore) IDSearch(ids ...string) ([]*d.Entry, error) {
+  return nil, errors.New("connection reset")
+}
+
+func TestIDSearchErrors(t *testing.T) {
+  s := newTestStore(t)
+
+  // Unknown ids are not found, but failed lookups are not the client's fault
+  for _, target := range []string{"/entry?q=404", "/relation?entry=404"} {
+    handler := entryHandler
+    if strings.HasPrefix(target, "/relation") {
+      handler = relationHandler
+    }
+    data = s
+    if w := serve(handler, http.MethodGet, target, ""); w.Code != http.StatusNotFound {
+      t.Errorf("GET %s: expected status 404, got: %d", target, w.Code)
+    }
+    data = failingStore{s}
+    if w := serve(handler, http.MethodGet, target, ""); w.Code != http.StatusInternalServerError {
+      t.Errorf("GET %s: expected status 500 when the lookup fails, got: %d", target, w.Code)
+    }
+  }
+}
+
+func TestRelationHandler(t *testing.T) {
+  newTestStore(t)
+
+  fire, _ := data.HeadwordSearch("fire")
+  zeal, _ := data.HeadwordSearch("zeal")
+  fireID, zealID := fire[1].ID, zeal[0].ID
+
+  decodeRelations := func(w *httptest.ResponseRecorder) []*d.Relation {
+    var relations []*d.Relation
+    if err := json.NewDecoder(w.Body).Decode(&relations); err != nil {
+      t.Fatalf("Failed to decode response: %v", err)
+    }
+    return relations
+  }
+
+  // Symmetric relations are visible from both ends, whichever end added them
+  w := serve(relationHandler, http.MethodPost, "/relation?type=synonym&entry="+zealID+"&related="+fireID, "")
+  if w.Code != http.StatusOK {
+    t.Fatalf("Add failed with status %d.", w.Code)
+  }
+  serve(relationHandler, http.MethodPost, "/relation?type=synonym&entry="+fireID+"&related="+zealID, "")
+  relations := decodeRelations(serve(relationHandler, http.MethodGet, "/relation?entry="+fireID, ""))
+  if len(relations) != 1 || relations[0].Type != d.Synonym || relations[0].Headword != "zeal" || relations[0].Language != "en-AU" {
+    t.Errorf("Expected: a single synonym zeal, got: %+v", relations)
+  }
+
+  // Derivations read the other way round from the other end
+  serve(relationHandler, http.MethodPost, "/relation?type=derived_from&entry="+zealID+"&related="+fire[0].ID, "")
+  entries := decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?q="+fire[0].ID, ""))
+  if len(entries[0].Relations) != 1 || entries[0].Relations[0].Type != d.Derivative || entries[0].Relations[0].ID != zealID {
+    t.Errorf("Expected: zeal listed as a derivative, got: %+v", entries[0].Relations)
+  }
+
+  tests := []struct {
+    target string
+    code   int
+  }{
+    {"/relation?type=cousin&entry=" + fireID + "&related=" + zealID, http.StatusBadRequest},
+    {"/relation?type=synonym&entry=" + fireID + "&related=" + fireID, http.StatusBadRequest},
+    {"/relation?type=translation&entry=" + fireID + "&related=" + zealID, http.StatusBadRequest},
+    {"/relation?type=synonym&entry=" + fireID + "&related=9999", http.StatusNotFound},
+  }
+  for _, test := range tests {
+    if w := serve(relationHandler, http.MethodPost, test.target, ""); w.Code != test.code {
+      t.Errorf("POST %s: expected status %d, got: %d", test.target, test.code, w.Code)
+    }
+  }
+
+  serve(relationHandler, http.MethodDelete, "/relation?type=synonym&entry="+zealID+"&related="+fireID, "")
+  if relations := decodeRelations(serve(relationHandler, http.MethodGet, "/relation?entry="+fireID, "")); len(relations) != 0 {
+    t.Errorf("Expected: no relations after deleting, got: %+v", relations)
+  }
+
+  // Deleting an entry removes its relations
+  serve(entryHandler, http.MethodDelete, "/entry?q="+zealID, "")
+  entries = decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?q="+fire[0].ID, ""))
+  if len(entries[0].Relations) != 0 {
+    t.Errorf("Expected: relations of a deleted entry to go, got: %+v", entries[0].Relations)
+  }
+}
+
+func TestTranslateHandler(t *testing.T) {
+  newTestStore(t)
+
+  entries, _ := asIncoming(
+    &d.Entry{Headword: "ot", Wordtype: "noun", Definition: "fire", Headword_Language: "yge", Definition_Language: "en-AU"},
+    &d.Entry{Headword: "jalin", Wordtype: "noun", Definition: "flame of a fire", Headword_Language: "yge", Definition_Language: "en-AU"},
+  )
+  if _, err := data.InsertEntry("", entries...); err != nil {
+    t.Fatal(err)
+  }
+
+  decodeTranslations := func(w *httptest.ResponseRecorder) []*translation {
+    var results []*translation
+    if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+      t.Fatalf("Failed to decode response: %v", err)
+    }
+    return results
+  }
+
+  // Forward: the definitions of yge headwords
+  results := decodeTranslations(serve(translateHandler, http.MethodGet, "/translate?q=ot&from=yge&to=en-AU", ""))
+  if len(results) == 0 || results[0].Text != "fire" || results[0].Source != "definition" || results[0].Score != 1 {
+    t.Errorf("Expected: fire as the first translation of ot, got: %+v", results)
+  }
+
+  // Reverse: yge headwords defined with the word, best match first
+  results = decodeTranslations(serve(translateHandler, http.MethodGet, "/translate?q=fire&from=en-AU&to=yge", ""))
+  if len(results) != 2 || results[0].Text != "ot" || results[1].Text != "jalin" || results[0].Source != "headword" {
+    t.Errorf("Expected: ot then jalin, got: %+v", results)
+  }
+  if results[0].Entry.Headword_Language != "yge" {
+    t.Errorf("Expected: entries with human names, got: %+v", results[0].Entry)
+  }
+
+  // Translation equivalents outrank definition matches
+  fire, _ := data.HeadwordSearch("fire")
+  serve(relationHandler, http.MethodPost, "/relation?type=translation&entry="+fire[0].ID+"&related="+entries[1].ID, "")
+  results = decodeTranslations(serve(translateHandler, http.MethodGet, "/translate?q=fire&from=en-AU&to=yge", ""))
+  if len(results) != 2 || results[0].Text != "jalin" || results[0].Source != "relation" {
+    t.Errorf("Expected: jalin first by relation, got: %+v", results)
+  }
+
+  for _, target := range []string{"/translate?q=fire&from=en-AU", "/translate?q=fire&from=en-AU&to=en-AU", "/translate?q=fire&from=xx&to=yge"} {
+    if w := serve(translateHandler, http.MethodGet, target, ""); w.Code != http.StatusBadRequest {
+      t.Errorf("GET %s: expected status 400, got: %d", target, w.Code)
+    }
+  }
+
+  // ts_rank may rank every definition match 0
+  data = unrankedStore{data.(*memStore)}
+  results = decodeTranslations(serve(translateHandler, http.MethodGet, "/translate?q=flame&from=en-AU&to=yge", ""))
+  if len(results) != 1 || results[0].Text != "jalin" || results[0].Score != reverseWeight {
+    t.Errorf("Expected: jalin for unranked matches, got: %+v", results)
+  }
+}
+
+// unrankedStore is a store whose definition matches all have a rank of 0.
+type unrankedStore struct {
+  *memStore
+}
+
+func (s unrankedStore) DefinitionSearch(query string, f entryFilter) ([]*d.Match, error) {
+  matches, err := s.memStore.DefinitionSearch(query, f)
+  for _, m := range matches {
+    m.Rank = 0
+  }
+  return matches, err
+}
+
+// newTestUser adds a user with a cheaply hashed password.
+func newTestUser(t *testing.T, username, password string) *User {
+  hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+  if err != nil {
+    t.Fatal(err)
+  }
+  user := &User{Username: username, Hash: string(hash), Email: username + "@example.com", Joindate: time.Now()}
+  if user.UID, err = data.InsertUser(user); err != nil {
+    t.Fatal(err)
+  }
+  return user
+}
+
+// whoami serves a request through authenticate and reports the user found.
+func whoami(r *http.Request) (*User, *httptest.ResponseRecorder) {
+  var user *User
+  w := httptest.NewRecorder()
+  authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    user = currentUser(r)
+  })).ServeHTTP(w, r)
+  return user, w
+}
+
+func TestTokenHandler(t *testing.T) {
+  newTestStore(t)
+  conf.Keystore = "test-key"
+  alice := newTestUser(t, "alice", "hunter2")
+
+  token := func(form url.Values) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    w := httptest.NewRecorder()
+    tokenHandler(w, r)
+    return w
+  }
+
+  w := token(url.Values{"grant_type": {"password"}, "username": {"alice"}, "password": {"wrong"}})
+  if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+    t.Errorf("Expected: invalid_grant for a wrong password, got: %d %s", w.Code, w.Body.String())
+  }
+
+  w = token(url.Values{"grant_type": {"password"}, "username": {"alice"}, "password": {"hunter2"}})
+  var tokens tokenResponse
+  if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+    t.Fatalf("Expected: tokens, got: %d %+v", w.Code, tokens)
+  }
+
+  r := httptest.NewRequest(http.MethodGet, "/", nil)
+  r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+  if user, _ := whoami(r); user == nil || user.UID != alice.UID {
+    t.Errorf("Expected: alice from the access token, got: %+v", user)
+  }
+
+  r.Header.Set("Authorization", "Bearer "+tokens.AccessToken+"x")
+  if _, w := whoami(r); w.Code != http.StatusUnauthorized {
+    t.Errorf("Expected: status 401 for a bad token, got: %d", w.Code)
+  }
+  if user, _ := whoami(httptest.NewRequest(http.MethodGet, "/", nil)); user != nil {
+    t.Errorf("Expected: an anonymous request, got: %+v", user)
+  }
+
+  // Refresh tokens can only be used once
+  w = token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+  if w.Code != http.StatusOK {
+    t.Errorf("Refresh failed with status %d.", w.Code)
+  }
+  w = token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+  if w.Code != http.StatusBadRequest {
+    t.Errorf("Expected: status 400 reusing a refresh token, got: %d", w.Code)
+  }
+}
+
+func TestKeysHandler(t *testing.T) {
+  newTestStore(t)
+  alice := newTestUser(t, "alice", "hunter2")
+
+  as := func(user *User, method, target string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, nil)
+    if user != nil {
+      r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+    }
+    w := httptest.NewRecorder()
+    keysHandler(w, r)
+    return w
+  }
+
+  if w := as(nil, http.MethodPost, "/keys?name=populate"); w.Code != http.StatusUnauthorized {
+    t.Errorf("Expected: status 401 without a user, got: %d", w.Code)
+  }
+
+  var created struct {
+    ID  string `json:"id"`
+    Key string `json:"key"`
+  }
+  json.NewDecoder(as(alice, http.MethodPost, "/keys?name=populate").Body).Decode(&created)
+
+  r := httptest.NewRequest(http.MethodGet, "/", nil)
+  r.Header.Set("Authorization", "Bearer "+created.Key)
+  if user, _ := whoami(r); user == nil || user.UID != alice.UID {
+    t.Errorf("Expected: alice from the API key, got: %+v", user)
+  }
+
+  w := as(alice, http.MethodGet, "/keys")
+  if strings.Contains(w.Body.String(), created.Key) || !strings.Contains(w.Body.String(), "last_used") {
+    t.Errorf("Expected: the key listed as used without the key itself, got: %s", w.Body.String())
+  }
+
+  as(alice, http.MethodDelete, "/keys?id="+created.ID)
+  if _, w := whoami(r); w.Code != http.StatusUnauthorized {
+    t.Errorf("Expected: status 401 with a revoked key, got: %d", w.Code)
+  }
+}
+
+func TestAuthorize(t *testing.T) {
+  newTestStore(t)
+  conf.Endpoints.Entry.Path = "/entry"
+  conf.Endpoints.Role.Path = "/role"
+  conf.Keystore = "test-key"
+  handler := authenticate(authorize(accessRules(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+  tokens := make(map[string]string)
+  for _, role := range []string{roleViewer, roleContributor, roleEditor, roleAdmin} {
+    user := newTestUser(t, role, "password")
+    data.SetRole(user.UID, role)
+    user.Role = role
+    issued, err := issueTokens(user)
+    if err != nil {
+      t.Fatal(err)
+    }
+    tokens[role] = issued.AccessToken
+  }
+
+  tests := []struct {
+    method string
+    target string
+    role   string
+    code   int
+  }{
+    {http.MethodGet, "/entry?q=1", "", http.StatusOK},
+    {http.MethodPost, "/entry", "", http.StatusUnauthorized},
+    {http.MethodPost, "/entry", roleViewer, http.StatusForbidden},
+    {http.MethodPost, "/entry", roleContributor, http.StatusForbidden},
+    {http.MethodPost, "/entry", roleEditor, http.StatusOK},
+    {http.MethodPut, "/entry", roleContributor, http.StatusForbidden},
+    {http.MethodPut, "/entry", roleEditor, http.StatusOK},
+    {http.MethodDelete, "/entry", roleAdmin, http.StatusOK},
+    {http.MethodPut, "/role", roleEditor, http.StatusForbidden},
+    {http.MethodPut, "/role", roleAdmin, http.StatusOK},
+  }
+  for _, test := range tests {
+    r := httptest.NewRequest(test.method, test.target, nil)
+    if test.role != "" {
+      r.Header.Set("Authorization", "Bearer "+tokens[test.role])
+    }
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    if w.Code != test.code {
+      t.Errorf("%s %s as %q: expected status %d, got: %d", test.method, test.target, test.role, test.code, w.Code)
+    }
+    if w.Code >= 400 && w.Header().Get("Content-Type") != util.ProblemContentType {
+      t.Errorf("%s %s as %q: expected problem details, got: %s", test.method, test.target, test.role, w.Header().Get("Content-Type"))
+    }
+  }
+
+  // The OAuth error is only given in the challenge, the problem has its own code
+  for _, test := range []struct {
+    header    string
+    status    int
+    code      string
+    challenge string
+  }{
+    {"", http.StatusUnauthorized, util.CodeUnauthorized, `Bearer error="invalid_token"`},
+    {"Basic YWxpY2U6cGFzc3dvcmQ=", http.StatusUnauthorized, util.CodeUnauthorized, `Bearer error="invalid_request"`},
+    {"Bearer " + tokens[roleViewer], http.StatusForbidden, util.CodeForbidden, ""},
+  } {
+    r := httptest.NewRequest(http.MethodPost, "/entry", nil)
+    if test.header != "" {
+      r.Header.Set("Authorization", test.header)
+    }
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    var p util.Problem
+    if err := json.NewDecoder(w.Body).Decode(&p); err != nil || w.Code != test.status || p.Code != test.code {
+      t.Errorf("%q: expected: a %d %s problem, got: %d %+v", test.header, test.status, test.code, w.Code, p)
+    }
+    if challenge := w.Header().Get("WWW-Authenticate"); challenge != test.challenge {
+      t.Errorf("%q: expected challenge %q, got: %q", test.header, test.challenge, challenge)
+    }
+  }
+}
+
+func TestRoleHandler(t *testing.T) {
+  newTestStore(t)
+  newTestUser(t, "alice", "password")
+
+  if w := serve(roleHandler, http.MethodPut, "/role?username=alice&role=overlord", ""); w.Code != http.StatusBadRequest {
+    t.Errorf("Expected: status 400 for an unknown role, got: %d", w.Code)
+  }
+  serve(roleHandler, http.MethodPut, "/role?username=alice&role=editor", "")
+  if user, _ := data.UserByName("alice"); user.Role != roleEditor {
+    t.Errorf("Expected: alice to be an editor, got: %s", user.Role)
+  }
+}
+
+func TestHistoryHandler(t *testing.T) {
+  newTestStore(t)
+  alice := newTestUser(t, "alice", "password")
+
+  as := func(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, strings.NewReader(body))
+    r = r.WithContext(context.WithValue(r.Context(), userKey, alice))
+    w := httptest.NewRecorder()
+    handler(w, r)
+    return w
+  }
+  decodeRevisions := func(w *httptest.ResponseRecorder) []*revision {
+    var revisions []*revision
+    if err := json.NewDecoder(w.Body).Decode(&revisions); err != nil {
+      t.Fatalf("Failed to decode response: %v", err)
+    }
+    return revisions
+  }
+
+  zeal, _ := data.HeadwordSearch("zeal")
+  id := zeal[0].ID
+  as(entryHandler, http.MethodPut, "/entry", `{"id": "`+id+`", "headword": "zeal", "wordtype": "noun", "definition": "fervour", "hw_lang": "en-AU", "def_lang": "en-AU"}`)
+  as(entryHandler, http.MethodDelete, "/entry?q="+id, "")
+
+  revisions := decodeRevisions(serve(historyHandler, http.MethodGet, "/history?entry="+id, ""))
+  if len(revisions) != 3 || revisions[0].Action != actionDelete || revisions[1].Action != actionUpdate || revisions[2].Action != actionCreate {
+    t.Fatalf("Expected: delete, update and create revisions, got: %+v", revisions)
+  }
+  if revisions[0].Author != "alice" || revisions[2].Author != "" {
+    t.Errorf("Wrong authors, got: %q and %q", revisions[0].Author, revisions[2].Author)
+  }
+
+  var diff struct {
+    Changes []d.Change `json:"changes"`
+  }
+  w := serve(historyHandler, http.MethodGet, "/history?entry="+id+"&from="+revisions[2].ID+"&to="+revisions[1].ID, "")
+  json.NewDecoder(w.Body).Decode(&diff)
+  if len(diff.Changes) != 2 || diff.Changes[0].Field != "definition" || diff.Changes[0].New != "fervour" {
+    t.Errorf("Expected: the definition and its sense to change, got: %+v", diff.Changes)
+  }
+
+  // Restoring the original revision brings back the deleted entry
+  if w := as(historyHandler, http.MethodPost, "/history?revision="+revisions[2].ID, ""); w.Code != http.StatusOK {
+    t.Fatalf("Restore failed with status %d.", w.Code)
+  }
+  entries := decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?q="+id, ""))
+  if !strings.HasPrefix(entries[0].Definition, "great energy") || entries[0].Wordtype != "noun" {
+    t.Errorf("Expected: the original entry, got: %+v", entries[0])
+  }
+  revisions = decodeRevisions(serve(historyHandler, http.MethodGet, "/history?entry="+id, ""))
+  if len(revisions) != 4 || revisions[0].Action != actionRestore {
+    t.Errorf("Expected: a restore revision, got: %+v", revisions)
+  }
+}
+
+func TestProposalWorkflow(t *testing.T) {
+  newTestStore(t)
+  alice := newTestUser(t, "alice", "password")
+  data.SetRole(alice.UID, roleContributor)
+  alice.Role = roleContributor
+  bob := newTestUser(t, "bob", "password")
+  data.SetRole(bob.UID, roleEditor)
+  bob.Role = roleEditor
+
+  as := func(user *User, handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, strings.NewReader(body))
+    r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+    w := httptest.NewRecorder()
+    handler(w, r)
+    return w
+  }
+  decodeProposal := func(w *httptest.ResponseRecorder) *proposal {
+    p := new(proposal)
+    if err := json.NewDecoder(w.Body).Decode(p); err != nil {
+      t.Fatalf("Failed to decode response: %v", err)
+    }
+    return p
+  }
+  decodeProposals := func(w *httptest.ResponseRecorder) []*proposal {
+    var proposals []*proposal
+    if err := json.NewDecoder(w.Body).Decode(&proposals); err != nil {
+      t.Fatalf("Failed to decode response: %v", err)
+    }
+    return proposals
+  }
+
+  created := decodeProposal(as(alice, proposalHandler, http.MethodPost, "/proposal", `{"headword": "ot", "wordtype": "noun", "definition": "fire", "hw_lang": "yge", "def_lang": "en-AU"}`))
+  if created.Status != statusPending || created.Author != "alice" || created.Entry.Headword_Language != "yge" {
+    t.Fatalf("Expected: a pending proposal by alice, got: %+v", created)
+  }
+
+  // Editors see the queue, contributors see their own proposals
+  if queue := decodeProposals(as(bob, proposalHandler, http.MethodGet, "/proposal", "")); len(queue) != 1 {
+    t.Errorf("Expected: one proposal in the queue, got: %d", len(queue))
+  }
+  if mine := decodeProposals(as(bob, proposalHandler, http.MethodGet, "/proposal?mine=true", "")); len(mine) != 0 {
+    t.Errorf("Expected: no proposals by bob, got: %d", len(mine))
+  }
+
+  if w := as(bob, reviewHandler, http.MethodPost, "/review?decision=request_changes&id="+created.ID, ""); w.Code != http.StatusBadRequest {
+    t.Errorf("Expected: status 400 requesting changes without a comment, got: %d", w.Code)
+  }
+  reviewed := decodeProposal(as(bob, reviewHandler, http.MethodPost, "/review?decision=request_changes&comment=Add+the+IPA&id="+created.ID, ""))
+  if reviewed.Status != statusChangesRequested || reviewed.Comment != "Add the IPA" || reviewed.ReviewerID != bob.UID {
+    t.Errorf("Expected: changes requested by bob, got: %+v", reviewed)
+  }
+  if w := as(bob, reviewHandler, http.MethodPost, "/review?decision=approve&id="+created.ID, ""); w.Code != http.StatusConflict {
+    t.Errorf("Expected: status 409 approving a proposal awaiting changes, got: %d", w.Code)
+  }
+
+  revised := decodeProposal(as(alice, proposalHandler, http.MethodPut, "/proposal?id="+created.ID, `{"headword": "ot", "wordtype": "noun", "definition": "fire", "hw_lang": "yge", "def_lang": "en-AU", "ipa": "ot"}`))
+  if revised.Status != statusPending || revised.Entry.IPA != "ot" {
+    t.Errorf("Expected: a pending revised proposal, got: %+v", revised)
+  }
+
+  if results, _ := data.HeadwordSearch("ot"); len(results) != 0 {
+    t.Fatalf("Expected: no live entry before approval, got: %d", len(results))
+  }
+  approved := decodeProposal(as(bob, reviewHandler, http.MethodPost, "/review?decision=approve&id="+created.ID, ""))
+  results, _ := data.HeadwordSearch("ot")
+  if approved.Status != statusApproved || len(results) != 1 || approved.EntryID != results[0].ID || results[0].IPA != "ot" {
+    t.Errorf("Expected: the approved entry to be live, got: %+v, %d results", approved, len(results))
+  }
+  revisions, _ := data.Revisions(results[0].ID)
+  if len(revisions) != 1 || revisions[0].AuthorID != alice.UID {
+    t.Errorf("Expected: the entry created by alice, got: %+v", revisions)
+  }
+
+  if w := as(alice, proposalHandler, http.MethodPut, "/proposal?id="+created.ID, `{"headword": "ot"}`); w.Code != http.StatusConflict {
+    t.Errorf("Expected: status 409 revising an approved proposal, got: %d", w.Code)
+  }
+  if w := as(bob, proposalHandler, http.MethodPut, "/proposal?id="+created.ID, `{"headword": "ot"}`); w.Code != http.StatusNotFound {
+    t.Errorf("Expected: status 404 revising someone else's proposal, got: %d", w.Code)
+  }
+
+  // A revision read before the approval can't send the proposal back to pending
+  stale, _ := data.Proposal(created.ID)
+  stale.Status = statusPending
+  if n, err := data.UpdateProposal(stale, statusPending, statusChangesRequested); n != 0 || err != nil {
+    t.Errorf("Expected: no rows updated for an approved proposal, got: %d, %v", n, err)
+  }
+  if p, _ := data.Proposal(created.ID); p.Status != statusApproved {
+    t.Errorf("Expected: the proposal to stay approved, got: %s", p.Status)
+  }
+
+  // Editors approving a proposal at the same time create a single entry
+  twice := decodeProposal(as(alice, proposalHandler, http.MethodPost, "/proposal", `{"headword": "su", "wordtype": "noun", "definition": "water", "hw_lang": "yge", "def_lang": "en-AU"}`))
+  codes := make(chan int, 2)
+  for i := 0; i < 2; i++ {
+    go func() {
+      codes <- as(bob, reviewHandler, http.MethodPost, "/review?decision=approve&id="+twice.ID, "").Code
+    }()
+  }
+  if a, b := <-codes, <-codes; a+b != http.StatusOK+http.StatusConflict {
+    t.Errorf("Expected: one approval and one conflict, got: %d and %d", a, b)
+  }
+  if results, _ := data.HeadwordSearch("su"); len(results) != 1 {
+    t.Errorf("Expected: one entry from concurrent approvals, got: %d", len(results))
+  }
+
+  // An edit to an entry changed since is refused until it is revised
+  edit := decodeProposal(as(alice, proposalHandler, http.MethodPost, "/proposal", `{"id": "`+results[0].ID+`", "headword": "ot", "wordtype": "noun", "definition": "a flame", "hw_lang": "yge", "def_lang": "en-AU"}`))
+  if edit.BaseRevision == "" {
+    t.Errorf("Expected: the latest revision of the entry as the base, got: %+v", edit)
+  }
+  as(bob, entryHandler, http.MethodPut, "/entry", `{"id": "`+results[0].ID+`", "headword": "ot", "wordtype": "noun", "definition": "fire, for cooking", "hw_lang": "yge", "def_lang": "en-AU"}`)
+  if w := as(bob, reviewHandler, http.MethodPost, "/review?decision=approve&id="+edit.ID, ""); w.Code != http.StatusConflict {
+    t.Errorf("Expected: status 409 approving an edit of a changed entry, got: %d", w.Code)
+  }
+  if results, _ := data.IDSearch(results[0].ID); results[0].Definition != "fire, for cooking" {
+    t.Errorf("Expected: the editor's change kept, got: %q", results[0].Definition)
+  }
+  as(alice, proposalHandler, http.MethodPut, "/proposal?id="+edit.ID, `{"id": "`+results[0].ID+`", "headword": "ot", "wordtype": "noun", "definition": "fire; a flame", "hw_lang": "yge", "def_lang": "en-AU"}`)
+  if w := as(bob, reviewHandler, http.MethodPost, "/review?decision=approve&id="+edit.ID, ""); w.Code != http.StatusOK {
+    t.Errorf("Expected: a revised edit to be approved, got: %d", w.Code)
+  }
+
+  // An edit to an entry deleted since is refused and left pending
+  edit = decodeProposal(as(alice, proposalHandler, http.MethodPost, "/proposal", `{"id": "`+results[0].ID+`", "headword": "ot", "wordtype": "noun", "definition": "flame", "hw_lang": "yge", "def_lang": "en-AU"}`))
+  data.DeleteEntry("", results[0].ID)
+  if w := as(bob, reviewHandler, http.MethodPost, "/review?decision=approve&id="+edit.ID, ""); w.Code != http.StatusConflict {
+    t.Errorf("Expected: status 409 approving an edit of a deleted entry, got: %d", w.Code)
+  }
+  if p, _ := data.Proposal(edit.ID); p.Status != statusPending {
+    t.Errorf("Expected: the proposal to stay pending, got: %s", p.Status)
+  }
+}
+
+func TestImportHandler(t *testing.T) {
+  newTestStore(t)
+  zeal, _ := data.HeadwordSearch("zeal")
+
+  post := func(target, contentType, body string) (*httptest.ResponseRecorder, *importResult) {
+    r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+    r.Header.Set("Content-Type", contentType)
+    w := httptest.NewRecorder()
+    importHandler(w, r)
+    result := new(importResult)
+    if w.Code == http.StatusOK || w.Code == http.StatusUnprocessableEntity {
+      if err := json.NewDecoder(w.Body).Decode(result); err != nil {
+        t.Fatalf("Failed to decode response: %v", err)
+      }
+    }
+    return w, result
+  }
+  count := func(headword string) int {
+    results, _ := data.HeadwordSearch(headword)
+    return len(results)
+  }
+
+  csvBody := "headword,wordtype,definition,hw_lang,def_lang,ipa\n" +
+    "ot,noun,fire,yge,en-AU,ot\n" +
+    "su,noun,\"water, as in a river\",yge,en-AU,\n"
+  if w, result := post("/import?dry_run=true", "text/csv", csvBody); w.Code != http.StatusOK || result.Valid != 2 || result.Imported != 0 || count("ot") != 0 {
+    t.Fatalf("Expected: a dry run to validate 2 rows without importing them, got: %d %+v", w.Code, result)
+  }
+  if w, result := post("/import", "text/csv", csvBody); w.Code != http.StatusOK || result.Imported != 2 {
+    t.Fatalf("Expected: 2 entries imported, got: %d %+v", w.Code, result)
+  }
+  if results, _ := data.HeadwordSearch("su"); len(results) != 1 || results[0].Definition != "water, as in a river" {
+    t.Errorf("Expected: the quoted definition to be imported, got: %+v", results)
+  }
+
+  // One bad row stops the whole import
+  jsonl := `{"headword": "tag", "wordtype": "noun", "definition": "mountain", "hw_lang": "yge", "def_lang": "en-AU"}` + "\n" +
+    "\n" +
+    `{"headword": "kün", "wordtype": "particle", "definition": "sun", "hw_lang": "yge", "def_lang": "en-AU"}` + "\n" +
+    `{"headword": ` + "\n" +
+    `{"id": "` + zeal[0].ID + `", "headword": "zeal", "wordtype": "noun", "definition": "fervour", "hw_lang": "en-AU", "def_lang": "en-AU"}` + "\n"
+  w, result := post("/import?format=jsonl", "application/octet-stream", jsonl)
+  if w.Code != http.StatusUnprocessableEntity || result.Imported != 0 || count("tag") != 0 {
+    t.Fatalf("Expected: status 422 and nothing imported, got: %d %+v", w.Code, result)
+  }
+  if len(result.Errors) != 2 || result.Errors[0].Line != 3 || result.Errors[0].Error != `unknown wordtype "particle"` || result.Errors[1].Line != 4 {
+    t.Errorf("Expected: errors on lines 3 and 4, got: %+v", result.Errors)
+  }
+
+  text := "tag\nnoun\nmountain\nyge\nen-AU\n" +
+    "kün\nnoun\nsun\nyge\nen-AU\n\n"
+  if w, result := post("/import", "text/plain", text); w.Code != http.StatusOK || result.Imported != 2 || count("kün") != 1 {
+    t.Errorf("Expected: 2 entries imported from text, got: %d %+v", w.Code, result)
+  }
+  if _, result := post("/import", "text/plain", "tag\nnoun\nmountain\n"); len(result.Errors) != 1 || result.Errors[0].Line != 1 {
+    t.Errorf("Expected: an incomplete entry error, got: %+v", result.Errors)
+  }
+
+  if w, _ := post("/import", "application/pdf", text); w.Code != http.StatusUnsupportedMediaType {
+    t.Errorf("Expected: status 415 for an unknown format, got: %d", w.Code)
+  }
+  if w, result := post("/import", "text/csv", "headword,colour\nfire,red\n"); w.Code != http.StatusUnprocessableEntity || len(result.Errors) != 1 {
+    t.Errorf("Expected: status 422 for an unknown column, got: %d %+v", w.Code, result)
+  }
+  missing := "headword,definition,hw_lang\n" +
+    "su,water,yge\n" +
+    "tag,mountain,yge\n"
+  if w, result := post("/import", "text/csv", missing); w.Code != http.StatusUnprocessableEntity || len(result.Errors) != 1 || result.Errors[0].Line != 1 || result.Errors[0].Error != "missing columns: wordtype, def_lang" {
+    t.Errorf("Expected: status 422 and one error on line 1 for missing columns, got: %d %+v", w.Code, result)
+  }
+  malformed := "headword,wordtype,definition,hw_lang,def_lang\n" +
+    "su,noun,water,yge,en-AU\n" +
+    "ta\"g,noun,mountain,yge,en-AU\n"
+  if w, result := post("/import", "text/csv", malformed); w.Code != http.StatusUnprocessableEntity || len(result.Errors) != 1 || result.Errors[0].Line != 3 {
+    t.Errorf("Expected: status 422 and an error on line 3 for a stray quote, got: %d %+v", w.Code, result)
+  }
+}
+
+func TestExportHandler(t *testing.T) {
+  newTestStore(t)
+  defer func(batch int) { exportBatch = batch }(exportBatch)
+  exportBatch = 2
+
+  ot := &d.Entry{Headword: "ot", Headword_Language: "yge", Definition_Language: "en-AU", IPA: "ot", Etymology: "Proto-Turkic *ōt",
+    Senses: []*d.Sense{
+      {Wordtype: "noun", Definition: "fire", Labels: []string{"common"}, Examples: []*d.Example{{Text: "ot jandï", Translation: "the fire burns"}}},
+      {Wordtype: "noun", Definition: "grass"},
+    }}
+  asIncoming(ot)
+  data.InsertEntry("", ot)
+  fire, _ := data.HeadwordSearch("fire")
+  data.AddRelation(canonicalRelation(fire[0].ID, ot.ID, d.Translation))
+
+  export := func(query string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    exportHandler(w, httptest.NewRequest(http.MethodGet, "/export?"+query, nil))
+    return w
+  }
+
+  // CSV exports can be imported again
+  w := export("format=csv")
+  if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+    t.Fatalf("Expected: a CSV download, got: %d %q", w.Code, w.Header().Get("Content-Type"))
+  }
+  rows, errs, err := parseImport(w.Body, formatCSV)
+  if err != nil || len(errs) != 0 || len(rows) != 4 {
+    t.Fatalf("Expected: 4 rows exported, got: %d %v %v", len(rows), errs, err)
+  }
+  if last := rows[3].Entry; last.ID != ot.ID || last.Definition != "1. fire 2. grass" || last.IPA != "ot" || last.Headword_Language != "yge" {
+    t.Errorf("Expected: ot in the last row, got: %+v", last)
+  }
+
+  // Filtered by language pair
+  rows, _, _ = parseImport(export("format=csv&hw_lang=yge&def_lang=en-AU").Body, formatCSV)
+  if len(rows) != 1 || rows[0].Entry.Headword != "ot" {
+    t.Errorf("Expected: only ot exported, got: %d rows", len(rows))
+  }
+  rows, _, _ = parseImport(export("format=csv&tag=fire").Body, formatCSV)
+  if len(rows) != 1 || rows[0].Entry.Headword != "zeal" {
+    t.Errorf("Expected: only zeal exported, got: %d rows", len(rows))
+  }
+
+  var lift struct {
+    Entries []struct {
+      ID     string   `xml:"id,attr"`
+      Forms  []string `xml:"lexical-unit>form>text"`
+      Senses []struct {
+        Wordtype    liftValue `xml:"grammatical-info"`
+        Definitions []string  `xml:"definition>form>text"`
+        Examples    []string  `xml:"example>translation>form>text"`
+      } `xml:"sense"`
+      Relations []struct {
+        Type string `xml:"type,attr"`
+        Ref  string `xml:"ref,attr"`
+      } `xml:"relation"`
+    } `xml:"entry"`
+  }
+  if err := xml.NewDecoder(export("format=lift&hw_lang=yge").Body).Decode(&lift); err != nil {
+    t.Fatalf("Failed to decode LIFT: %v", err)
+  }
+  if len(lift.Entries) != 1 || len(lift.Entries[0].Senses) != 2 || lift.Entries[0].Senses[0].Wordtype.Value != "noun" || lift.Entries[0].Senses[0].Examples[0] != "the fire burns" {
+    t.Fatalf("Expected: ot with two senses, got: %+v", lift)
+  }
+  if r := lift.Entries[0].Relations; len(r) != 1 || r[0].Type != d.Translation || r[0].Ref != fire[0].ID {
+    t.Errorf("Expected: a translation of fire, got: %+v", r)
+  }
+
+  var tei struct {
+    Entries []struct {
+      ID   string `xml:"http://www.w3.org/XML/1998/namespace id,attr"`
+      Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+      Orth string `xml:"form>orth"`
+      Pron string `xml:"form>pron"`
+      Refs []struct {
+        Type    string `xml:"type,attr"`
+        Subtype string `xml:"subtype,attr"`
+      } `xml:"xr"`
+    } `xml:"text>body>entry"`
+  }
+  if err := xml.NewDecoder(export("format=tei&hw_lang=yge").Body).Decode(&tei); err != nil {
+    t.Fatalf("Failed to decode TEI: %v", err)
+  }
+  if len(tei.Entries) != 1 || tei.Entries[0].ID != "e"+ot.ID || tei.Entries[0].Lang != "yge" || tei.Entries[0].Pron != "ot" {
+    t.Fatalf("Expected: ot, got: %+v", tei)
+  }
+  if refs := tei.Entries[0].Refs; len(refs) != 1 || refs[0].Type != "related" || refs[0].Subtype != d.Translation {
+    t.Errorf("Expected: a related translation, got: %+v", refs)
+  }
+
+  if w := export("format=pdf"); w.Code != http.StatusBadRequest {
+    t.Errorf("Expected: status 400 for an unknown format, got: %d", w.Code)
+  }
+
+  // Exports read every page without counting the entries each time
+  pages := &pageRecorder{memStore: data.(*memStore)}
+  data = pages
+  export("format=csv")
+  if len(pages.requests) != 2 {
+    t.Fatalf("Expected: 2 pages of entries, got: %d", len(pages.requests))
+  }
+  for _, p := range pages.requests {
+    if !p.NoTotal {
+      t.Errorf("Expected: pages requested without a total, got: %+v", p)
+    }
+  }
+}
+
+// pageRecorder is a store noting the pages of entries asked of it.
+type pageRecorder struct {
+  *memStore
+  requests []pageRequest
+}
+
+func (s *pageRecorder) EntryPage(f entryFilter, p pageRequest) ([]*d.Entry, string, int, error) {
+  s.requests = append(s.requests, p)
+  return s.memStore.EntryPage(f, p)
+}
+
+func TestBundleHandler(t *testing.T) {
+  newTestStore(t)
+  blobs = blob.NewMemory()
+  conf.Endpoints.Bundle.Path = "/bundle"
+
+  request := func(method, target, etag string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, nil)
+    if etag != "" {
+      r.Header.Set("If-None-Match", etag)
+    }
+    w := httptest.NewRecorder()
+    bundleHandler(w, r)
+    return w
+  }
+  manifest := func(w *httptest.ResponseRecorder) *bundleManifest {
+    m := new(bundleManifest)
+    if err := json.NewDecoder(w.Body).Decode(m); err != nil {
+      t.Fatalf("Failed to decode response: %v", err)
+    }
+    return m
+  }
+
+  // Bundles aren't generated until an editor or the schedule asks
+  if w := request(http.MethodGet, "/bundle?hw_lang=en-AU&def_lang=en-AU", ""); w.Code != http.StatusNotFound {
+    t.Errorf("Expected: status 404 for a bundle not generated yet, got: %d", w.Code)
+  }
+  request(http.MethodPost, "/bundle?hw_lang=en-AU&def_lang=en-AU", "")
+  w := request(http.MethodGet, "/bundle?hw_lang=en-AU&def_lang=en-AU", "")
+  first := manifest(w)
+  if first.Version != 1 || first.Entries != 3 || len(first.Files) != 5 {
+    t.Fatalf("Expected: version 1 of 3 entries in 5 files, got: %+v", first)
+  }
+  etag := w.Header().Get("ETag")
+  if w := request(http.MethodGet, "/bundle?hw_lang=en-AU&def_lang=en-AU", etag); w.Code != http.StatusNotModified {
+    t.Errorf("Expected: status 304 for an unchanged bundle, got: %d", w.Code)
+  }
+
+  for _, f := range first.Files {
+    w := request(http.MethodGet, f.URL, "")
+    sum := sha256.Sum256(w.Body.Bytes())
+    if w.Code != http.StatusOK || int64(w.Body.Len()) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+      t.Errorf("Expected: %s to match its checksum, got: %d", f.Name, w.Code)
+    }
+  }
+
+  // Regenerating an unchanged dictionary keeps the version
+  if m := manifest(request(http.MethodPost, "/bundle?hw_lang=en-AU&def_lang=en-AU", "")); m.Version != 1 {
+    t.Errorf("Expected: version 1, got: %d", m.Version)
+  }
+
+  entries, _ := asIncoming(&d.Entry{Headword: "flame", Wordtype: "noun", Definition: "the glowing part of a fire", Headword_Language: "en-AU", Definition_Language: "en-AU"})
+  data.InsertEntry("", entries...)
+  second := manifest(request(http.MethodPost, "/bundle?hw_lang=en-AU&def_lang=en-AU", ""))
+  if second.Version != 2 || second.Entries != 4 {
+    t.Fatalf("Expected: version 2 of 4 entries, got: %+v", second)
+  }
+  if w := request(http.MethodGet, "/bundle?hw_lang=en-AU&def_lang=en-AU", etag); w.Code != http.StatusOK {
+    t.Errorf("Expected: status 200 for a changed bundle, got: %d", w.Code)
+  }
+  if w := request(http.MethodGet, first.Files[0].URL, ""); w.Code != http.StatusNotFound {
+    t.Errorf("Expected: the old version to be deleted, got: %d", w.Code)
+  }
+
+  if w := request(http.MethodGet, "/bundle?hw_lang=xx&def_lang=en-AU", ""); w.Code != http.StatusNotFound {
+    t.Errorf("Expected: status 404 for an unknown language, got: %d", w.Code)
+  }
+  if w := request(http.MethodGet, "/bundle?hw_lang=en-AU", ""); w.Code != http.StatusBadRequest {
+    t.Errorf("Expected: status 400 without a def_lang, got: %d", w.Code)
+  }
+  for _, method := range []string{http.MethodPut, http.MethodDelete} {
+    if w := request(method, "/bundle?hw_lang=xx", ""); w.Code != http.StatusMethodNotAllowed {
+      t.Errorf("Expected: status 405 for %s, got: %d", method, w.Code)
+    }
+  }
+  blobs.Put("secret", strings.NewReader("audio"))
+  if w := request(http.MethodGet, "/bundle?file=secret", ""); w.Code != http.StatusNotFound {
+    t.Errorf("Expected: status 404 for a blob that isn't a bundle, got: %d", w.Code)
+  }
+}
+
+func TestSuggestHandler(t *testing.T) {
+  newTestStore(t)
+  entries, _ := asIncoming(
+    &d.Entry{Headword: "firefly", Wordtype: "noun", Definition: "a beetle that glows", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+    &d.Entry{Headword: "fir", Wordtype: "noun", Definition: "an evergreen tree", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+    &d.Entry{Headword: "Fire", Wordtype: "noun", Definition: "ot", Headword_Language: "yge", Definition_Language: "en-AU"},
+    &d.Entry{Headword: "f%x", Wordtype: "noun", Definition: "not a word", Headword_Language: "en-AU", Definition_Language: "en-AU"},
+  )
+  data.InsertEntry("", entries...)
+
+  suggest := func(query string) []suggestion {
+    w := httptest.NewRecorder()
+    suggestHandler(w, httptest.NewRequest(http.MethodGet, "/suggest?"+query, nil))
+    var suggestions []suggestion
+    if err := json.NewDecoder(w.Body).Decode(&suggestions); err != nil {
+      t.Fatalf("Failed to decode response: %v", err)
+    }
+    return suggestions
+  }
+  headwords := func(suggestions []suggestion) string {
+    var words []string
+    for _, sg := range suggestions {
+      words = append(words, sg.Headword+"/"+sg.Language)
+    }
+    return strings.Join(words, " ")
+  }
+
+  tables := []struct {
+    query    string
+    expected string
+  }{
+    {"q=fir", "fir/en-AU Fire/yge fire/en-AU firefly/en-AU"},
+    {"q=FIRE", "Fire/yge fire/en-AU firefly/en-AU"},
+    {"q=fir&limit=2", "fir/en-AU Fire/yge"},
+    {"q=fir&hw_lang=yge", "Fire/yge"},
+    {"q=f%25", "f%x/en-AU"},
+    {"q=z&hw_lang=yge", ""},
+    {"q=", ""},
+  }
+  for _, table := range tables {
+    if result := headwords(suggest(table.query)); result != table.expected {
+      t.Errorf("Suggestions for %q were incorrect. Expected: %q, got: %q.", table.query, table.expected, result)
+    }
+  }
+
+  // Entries sharing a headword are suggested once
+  if s := suggest("q=fire&hw_lang=en-AU"); len(s) != 2 || s[0].Entries != 2 {
+    t.Errorf("Expected: fire with 2 entries, got: %+v", s)
+  }
+  if w := serve(suggestHandler, http.MethodGet, "/suggest?q=fir&hw_lang=xx", ""); w.Code != http.StatusBadRequest {
+    t.Errorf("Expected: status 400 for an unknown language, got: %d", w.Code)
+  }
+}
+
+func TestHeadwordNormalization(t *testing.T) {
+  newTestStore(t)
+
+  // Stored in NFC whatever form it was sent in
+  w := serve(entryHandler, http.MethodPost, "/entry", `{"headword": "o\u0308t", "wordtype": "noun", "definition": "grass", "hw_lang": "yge", "def_lang": "en-AU"}`)
+  if w.Code != http.StatusOK {
+    t.Fatalf("Failed to create entry, status %d.", w.Code)
+  }
+  serve(entryHandler, http.MethodPost, "/entry", `{"headword": "세상", "wordtype": "noun", "definition": "world", "hw_lang": "yge", "def_lang": "en-AU"}`)
+  if results, _ := data.HeadwordSearch("öt"); len(results) != 1 || results[0].Headword != "öt" {
+    t.Fatalf("Expected: öt stored in NFC, got: %+v", results)
+  }
+
+  tables := []struct {
+    query    string
+    headword string
+  }{
+    {"ÖT", "öt"},
+    {"ot", "öt"},
+    {"%D0%BE%D1%82", "öt"},
+    {"%EF%BD%86%EF%BD%89%EF%BD%92%EF%BD%85", "fire"},
+    {"%E3%85%85%E3%85%94%E3%85%85%E3%85%8F%E3%85%87", "세상"},
+  }
+  for _, table := range tables {
+    entries := decodeSearch(t, serve(searchHandler, http.MethodGet, "/search?q="+table.query, "")).Results
+    if len(entries) == 0 || entries[0].Headword != table.headword {
+      t.Errorf("Search for %q was incorrect. Expected: %q first, got: %+v.", table.query, table.headword, entries)
+    }
+  }
+
+  // Suggestions match keys too; "от" is Cyrillic
+  w = serve(suggestHandler, http.MethodGet, "/suggest?q=%D0%BE", "")
+  var suggestions []suggestion
+  json.NewDecoder(w.Body).Decode(&suggestions)
+  if len(suggestions) != 1 || suggestions[0].Headword != "öt" {
+    t.Errorf("Expected: öt suggested for о, got: %+v", suggestions)
+  }
+}
+
+func TestTransliteration(t *testing.T) {
+  newTestStore(t)
+
+  // Stored in the canonical orthography whatever scheme it was written in
+  w := serve(entryHandler, http.MethodPost, "/entry?scheme=cyrillic", `{"headword": "Жанды", "hw_lang": "yge", "def_lang": "en-AU", "senses": [{"wordtype": "verb", "definition": "to burn", "examples": [{"text": "өт жанды", "translation": "the fire burns"}]}]}`)
+  if w.Code != http.StatusOK {
+    t.Fatalf("Failed to create entry, status %d.", w.Code)
+  }
+  serve(entryHandler, http.MethodPost, "/entry?scheme=cyrillic", `{"headword": "fire", "wordtype": "noun", "definition": "ot", "hw_lang": "en-AU", "def_lang": "yge"}`)
+  stored, _ := data.HeadwordSearch("jandı")
+  if len(stored) != 1 || stored[0].Headword != "Jandı" || stored[0].Senses[0].Examples[0].Text != "öt jandı" {
+    t.Fatalf("Expected: Jandı stored in Latin, got: %+v", stored)
+  }
+
+  // Rendered in the scheme asked for
+  entries := decodeEntries(t, serve(entryHandler, http.MethodGet, "/entry?scheme=ipa&q="+stored[0].ID, ""))
+  if len(entries) != 1 || entries[0].Headword != "Dʒandɯ" || entries[0].Senses[0].Examples[0].Text != "øt dʒandɯ" {
+    t.Errorf("Expected: Dʒandɯ in IPA, got: %+v", entries)
+  }
+
+  // Searched for in any scheme, leaving other languages alone
+  tables := []struct {
+    query    string
+    headword string
+  }{
+    {"d%CA%92and%C9%AF&scheme=ipa", "Dʒandɯ"},
+    {"jandi&scheme=ipa", "Dʒandɯ"},
+    {"fire&scheme=ipa", "fire"},
+    {"fire&scheme=cyrillic", "fire"},
+  }
+  for _, table := range tables {
+    results := decodeSearch(t, serve(searchHandler, http.MethodGet, "/search?q="+table.query, "")).Results
+    if len(results) == 0 || results[0].Headword != table.headword {
+      t.Errorf("Search for %q was incorrect. Expected: %q first, got: %+v.", table.query, table.headword, results)
+    }
+  }
+
+  w = serve(suggestHandler, http.MethodGet, "/suggest?q=d%CA%92a&scheme=ipa", "")
+  var suggestions []suggestion
+  json.NewDecoder(w.Body).Decode(&suggestions)
+  if len(suggestions) != 1 || suggestions[0].Headword != "Dʒandɯ" {
+    t.Errorf("Expected: Dʒandɯ suggested, got: %+v", suggestions)
+  }
+
+  for _, handler := range []http.HandlerFunc{entryHandler, searchHandler, suggestHandler} {
+    if w := serve(handler, http.MethodGet, "/?q=fire&scheme=runic", ""); w.Code != http.StatusBadRequest {
+      t.Errorf("Expected: 400 for an unknown scheme, got: %d", w.Code)
+    }
+  }
+}
+
+func TestTransliterateHandler(t *testing.T) {
+  newTestStore(t)
+
+  var result transliteration
+  w := serve(transliterateHandler, http.MethodGet, "/transliterate?text=%C3%B6t+jand%C4%B1&to=cyrillic", "")
+  if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+    t.Fatalf("Failed to decode response: %v", err)
+  }
+  if result.Text != "өт жанды" || result.From != "latin" || result.To != "cyrillic" {
+    t.Errorf("Expected: өт жанды from latin, got: %+v", result)
+  }
+
+  var schemes []map[string]string
+  w = serve(transliterateHandler, http.MethodGet, "/transliterate", "")
+  json.NewDecoder(w.Body).Decode(&schemes)
+  if len(schemes) != 4 || schemes[0]["name"] != "ascii" {
+    t.Errorf("Expected: 4 schemes, got: %+v", schemes)
+  }
+
+  if w := serve(transliterateHandler, http.MethodGet, "/transliterate?text=ot&from=runic", ""); w.Code != http.StatusBadRequest {
+    t.Errorf("Expected: 400 for an unknown scheme, got: %d", w.Code)
+  }
+}
+
+func TestRegisterHandler(t *testing.T) {
+  newTestStore(t)
+
+  register := func() *httptest.ResponseRecorder {
+    form := url.Values{"username": {"alice"}, "password": {"password"}, "email": {"alice@example.com"}}
+    r := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    w := httptest.NewRecorder()
+    registerHandler(w, r)
+    return w
+  }
+
+  w := register()
+  var created map[string]string
+  if err := json.NewDecoder(w.Body).Decode(&created); err != nil || w.Code != http.StatusCreated || created["username"] != "alice" || created["uid"] == "" {
+    t.Errorf("Expected: status 201 with the new user, got: %d %v", w.Code, created)
+  }
+
+  w = register()
+  var p util.Problem
+  if err := json.NewDecoder(w.Body).Decode(&p); err != nil || w.Code != http.StatusConflict || p.Code != util.CodeConflict {
+    t.Errorf("Expected: a 409 problem registering alice again, got: %d %+v", w.Code, p)
+  }
+}
+
+func TestLoginHandler(t *testing.T) {
+  newTestStore(t)
+  newTestUser(t, "alice", "password")
+  defer func(store *sessions.CookieStore) { sessionStore = store }(sessionStore)
+  sessionStore = sessions.NewCookieStore([]byte("test-keystore"))
+
+  login := func(username, password string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(url.Values{"username": {username}, "password": {password}}.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    w := httptest.NewRecorder()
+    loginHandler(w, r)
+    return w
+  }
+
+  // Unknown users and wrong passwords can't be told apart
+  for _, username := range []string{"alice", "bob"} {
+    w := login(username, "wrong")
+    var p util.Problem
+    if err := json.NewDecoder(w.Body).Decode(&p); err != nil || w.Code != http.StatusUnauthorized || p.Code != util.CodeUnauthorized || p.Detail != "invalid username or password" {
+      t.Errorf("Expected: a 401 problem logging in as %s, got: %d %+v", username, w.Code, p)
+    }
+  }
+  if w := login("alice", "password"); w.Code != http.StatusFound || w.Header().Get("Set-Cookie") == "" {
+    t.Errorf("Expected: a session and a redirect on login, got: %d", w.Code)
+  }
+}
+
+func TestProblemResponses(t *testing.T) {
+  newTestStore(t)
+
+  problem := func(w *httptest.ResponseRecorder) *util.Problem {
+    if w.Header().Get("Content-Type") != util.ProblemContentType {
+      t.Fatalf("Expected: problem details, got: %s %q", w.Header().Get("Content-Type"), w.Body.String())
+    }
+    p := new(util.Problem)
+    if err := json.NewDecoder(w.Body).Decode(p); err != nil {
+      t.Fatalf("Failed to decode problem: %v", err)
+    }
+    if p.Status != w.Code || p.Type != "urn:yugur:problem:"+p.Code {
+      t.Errorf("Problem doesn't match the response: %+v", p)
+    }
+    return p
+  }
+  fields := func(p *util.Problem) string {
+    var names []string
+    for _, f := range p.Fields {
+      names = append(names, f.Name+":"+f.Code)
+    }
+    return strings.Join(names, " ")
+  }
+
+  tables := []struct {
+    method string
+    target string
+    body   string
+    code   string
+    fields string
+  }{
+    {http.MethodPost, "/entry", `{"headword": "ot", "wordtype": "particle", "hw_lang": "yge", "def_lang": "en-AU"}`, util.CodeValidationFailed, "wordtype:unknown"},
+    {http.MethodPost, "/entry", `{"headword": "ot", "hw_lang": "yge", "def_lang": "en-AU", "senses": [{"wordtype": "noun"}, {"wordtype": "particle"}]}`, util.CodeValidationFailed, "senses[1].wordtype:unknown"},
+    {http.MethodPost, "/entry", `{"headword": "ot", "wordtype": "noun", "hw_lang": "xx", "def_lang": "en-AU"}`, util.CodeValidationFailed, "hw_lang:unknown"},
+    {http.MethodPut, "/entry", `{"definition": "grass", "def_lang": "en-AU"}`, util.CodeValidationFailed, "headword:required hw_lang:required"},
+    {http.MethodPost, "/entry", `{"headword": 5}`, util.CodeValidationFailed, "headword:invalid"},
+    {http.MethodPost, "/entry", `{"headword": "ot",`, util.CodeInvalidBody, ""},
+    {http.MethodPost, "/entry?scheme=runic", `{"headword": "ot", "hw_lang": "yge", "def_lang": "en-AU"}`, util.CodeInvalidParameter, "scheme:unknown"},
+    {http.MethodGet, "/entry?q=404", "", util.CodeNotFound, ""},
+    {http.MethodPatch, "/entry", "", util.CodeMethodNotAllowed, ""},
+  }
+  for _, table := range tables {
+    w := serve(entryHandler, table.method, table.target, table.body)
+    p := problem(w)
+    if p.Code != table.code || fields(p) != table.fields {
+      t.Errorf("%s %s %s was incorrect. Expected: %s with %q, got: %s with %q.", table.method, table.target, table.body, table.code, table.fields, p.Code, fields(p))
+    }
+  }
+
+  // Problems name the request they are about
+  r := httptest.NewRequest(http.MethodGet, "/search?q=ot&limit=0", nil)
+  r.Header.Set(util.RequestIDHeader, "abc123")
+  w := httptest.NewRecorder()
+  requestIDs(http.HandlerFunc(searchHandler)).ServeHTTP(w, r)
+  p := problem(w)
+  if p.Status != http.StatusBadRequest || p.Instance != "/search" || p.RequestID != "abc123" || fields(p) != "limit:invalid" {
+    t.Errorf("Expected: a bad limit on /search for request abc123, got: %+v", p)
+  }
+}
+
+func TestAccessLog(t *testing.T) {
+  newTestStore(t)
+  conf.Endpoints.Entry.Path = "/entry"
+
+  var logs bytes.Buffer
+  util.SetupLogging(&logs, false)
+  defer func(logger *slog.Logger, flags int) {
+    slog.SetDefault(logger)
+    log.SetFlags(flags)
+  }(slog.Default(), log.Flags())
+
+  mux := http.NewServeMux()
+  mux.HandleFunc(conf.Endpoints.Entry.Path, entryHandler)
+  handler := requestIDs(accessLog(authenticate(authorize(accessRules(), mux))))
+
+  tables := []struct {
+    method string
+    sent   string
+    status int
+  }{
+    {http.MethodGet, "", http.StatusNotFound},
+    {http.MethodGet, "trace-42.a_b", http.StatusNotFound},
+    {http.MethodGet, "not a valid id", http.StatusNotFound},
+    {http.MethodPost, "", http.StatusUnauthorized},
+  }
+  for _, table := range tables {
+    logs.Reset()
+    r := httptest.NewRequest(table.method, "/entry?q=404", strings.NewReader("{}"))
+    if table.sent != "" {
+      r.Header.Set(util.RequestIDHeader, table.sent)
+    }
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+
+    id := w.Header().Get(util.RequestIDHeader)
+    if id == "" || (table.sent == "trace-42.a_b") != (id == table.sent) {
+      t.Errorf("Request ID for %q was incorrect, got: %q", table.sent, id)
+    }
+
+    // The problem and the access log, both tagged with the request
+    var records []map[string]interface{}
+    decoder := json.NewDecoder(&logs)
+    for decoder.More() {
+      var record map[string]interface{}
+      if err := decoder.Decode(&record); err != nil {
+        t.Fatalf("Log isn't JSON: %v", err)
+      }
+      records = append(records, record)
+    }
+    if len(records) != 2 {
+      t.Fatalf("Expected: 2 log records, got: %v", records)
+    }
+    access := records[1]
+    if access["msg"] != "request" || access["level"] != "INFO" || access["request_id"] != id || access["status"] != float64(table.status) || access["path"] != "/entry" {
+      t.Errorf("Access log was incorrect, got: %v", access)
+    }
+    if records[0]["request_id"] != id {
+      t.Errorf("Expected: the problem logged with request %q, got: %v", id, records[0])
+    }
+  }
+}
+
+func TestMetrics(t *testing.T) {
+  newTestStore(t)
+  conf.Endpoints.Entry.Path = "/entry"
+  conf.Endpoints.Suggest.Path = "/suggest"
+
+  mux := http.NewServeMux()
+  mux.HandleFunc(conf.Endpoints.Entry.Path, entryHandler)
+  mux.HandleFunc(conf.Endpoints.Suggest.Path, suggestHandler)
+  handler := meter(mux, authenticate(authorize(accessRules(), mux)))
+
+  for _, target := range []string{"/entry?q=404", "/suggest?q=d", "/nowhere/at/all"} {
+    handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+  }
+  handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/entry", nil))
+  if _, err := crypto.HashPassword("password"); err != nil {
+    t.Fatal(err)
+  }
+
+  w := httptest.NewRecorder()
+  metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+  body := w.Body.String()
+  for _, series := range []string{
+    `yugur_http_requests_total{endpoint="/entry",method="GET",status="404"} 1`,
+    `yugur_http_requests_total{endpoint="/suggest",method="GET",status="200"} 1`,
+    `yugur_http_requests_total{endpoint="unknown",method="GET",status="404"} 1`,
+    `yugur_http_requests_total{endpoint="/entry",method="OTHER",status="405"} 1`,
+    `yugur_http_request_duration_seconds_count{endpoint="/entry",method="GET",status="404"} 1`,
+    `yugur_search_results_count{endpoint="suggest"}`,
+    `yugur_bcrypt_duration_seconds_count{operation="hash"}`,
+  } {
+    // Other tests search and hash too, so only the request counts are exact
+    if !strings.Contains(body, series) {
+      t.Errorf("Expected the metrics to include %s", series)
+    }
+  }
+}
+
+// downStore is a store whose database can't be reached.
+type downStore struct {
+  *memStore
+}
+
+func (s downStore) Ping(ctx context.Context) error {
+  return errors.New("connection refused")
+}
+
+func TestStatus(t *testing.T) {
+  s := newTestStore(t)
+
+  w := serve(statusHandler, http.MethodGet, "/status", "")
+  if w.Code != http.StatusOK {
+    t.Fatalf("Expected: status %d, got: %d.", http.StatusOK, w.Code)
+  }
+  var status serverStatus
+  if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+    t.Fatal(err)
+  }
+  if status.Status != statusOK || status.Build == nil || status.Build.Version != version || status.Started == nil {
+    t.Errorf("Status was incorrect, got: %+v", status)
+  }
+  if c := status.Checks["migrations"]; c == nil || c.Status != checkOK || c.Version != migrations.Latest() {
+    t.Errorf("Migrations check was incorrect, got: %+v", c)
+  }
+  if c := status.Checks["database"]; c == nil || c.Status != checkOK {
+    t.Errorf("Database check was incorrect, got: %+v", c)
+  }
+  if c := status.Counts; c == nil || c.Entries != 3 || c.Users != 0 || c.Languages["en-AU"] != 3 || c.Languages["yge"] != 0 {
+    t.Errorf("Counts were incorrect, got: %+v", c)
+  }
+
+  for _, handler := range []http.HandlerFunc{healthHandler, readyHandler} {
+    if w := serve(handler, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+      t.Errorf("Expected: status %d, got: %d.", http.StatusOK, w.Code)
+    }
+  }
+  if w := serve(healthHandler, http.MethodPost, "/health", ""); w.Code != http.StatusMethodNotAllowed {
+    t.Errorf("Expected: status %d for POST, got: %d.", http.StatusMethodNotAllowed, w.Code)
+  }
+
+  // Without a database the server is alive but not ready
+  data = downStore{s}
+  if w := serve(healthHandler, http.MethodGet, "/health", ""); w.Code != http.StatusOK {
+    t.Errorf("Expected: status %d while the database is down, got: %d.", http.StatusOK, w.Code)
+  }
+  for _, handler := range []http.HandlerFunc{readyHandler, statusHandler} {
+    w := serve(handler, http.MethodGet, "/", "")
+    if w.Code != http.StatusServiceUnavailable {
+      t.Errorf("Expected: status %d while the database is down, got: %d.", http.StatusServiceUnavailable, w.Code)
+    }
+    var status serverStatus
+    if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+      t.Fatal(err)
+    }
+    if c := status.Checks["database"]; status.Status != statusUnavailable || c == nil || c.Status != checkFail || c.Error == "" {
+      t.Errorf("Status was incorrect, got: %+v", status)
+    }
+  }
+}
+
+func TestRunServer(t *testing.T) {
+  conf = config.Defaults()
+  conf.Host = "127.0.0.1"
+  conf.Server.ShutdownTimeout = 5
+
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+
+  started, release := make(chan bool), make(chan bool)
+  srv, err := newServer(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    started <- true
+    <-release
+    w.Write([]byte("done"))
+  }))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if srv.Addr != "127.0.0.1:0" || srv.ReadHeaderTimeout != 10*time.Second || srv.WriteTimeout != 120*time.Second || srv.TLSConfig != nil {
+    t.Errorf("Server was incorrect, got: %+v", srv)
+  }
+
+  ln, err := net.Listen("tcp", srv.Addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  stopped := make(chan error, 1)
+  go func() {
+    stopped <- runServer(ctx, srv, ln)
+  }()
+
+  // A request in flight when the server is told to stop is still answered
+  responses := make(chan string, 1)
+  go func() {
+    resp, err := http.Get("http://" + ln.Addr().String() + "/")
+    if err != nil {
+      responses <- err.Error()
+      return
+    }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    responses <- string(body)
+  }()
+  <-started
+  cancel()
+  time.Sleep(50 * time.Millisecond)
+  select {
+  case err := <-stopped:
+    t.Fatalf("Expected: the server to wait for the request in flight, got: %v", err)
+  default:
+  }
+
+  close(release)
+  if body := <-responses; body != "done" {
+    t.Errorf("Expected: the request in flight to finish, got: %q", body)
+  }
+  if err := <-stopped; err != nil {
+    t.Errorf("Expected: a clean shutdown, got: %v", err)
+  }
+  if _, err := http.Get("http://" + ln.Addr().String() + "/"); err == nil {
+    t.Error("Expected: no new requests after shutting down")
+  }
+}
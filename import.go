@@ -0,0 +1,272 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "bufio"
+  "database/sql"
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "io"
+  "mime"
+  "path/filepath"
+  "sort"
+  "strings"
+
+  d "github.com/yugur/api/entry"
+)
+
+// Formats accepted by the import endpoint and subcommand
+const (
+  // A header row naming the columns, then one entry per row
+  formatCSV = "csv"
+  // One JSON entry per line
+  formatJSONL = "jsonl"
+  // Five lines per entry, as read by scripts/populate.sh: headword,
+  // wordtype, definition, headword language and definition language
+  formatText = "text"
+)
+
+// Columns that may appear in a CSV import.
+var importColumns = map[string]func(e *d.Entry, value string){
+  "id":         func(e *d.Entry, v string) { e.ID = v },
+  "headword":   func(e *d.Entry, v string) { e.Headword = v },
+  "wordtype":   func(e *d.Entry, v string) { e.Wordtype = v },
+  "definition": func(e *d.Entry, v string) { e.Definition = v },
+  "hw_lang":    func(e *d.Entry, v string) { e.Headword_Language = v },
+  "def_lang":   func(e *d.Entry, v string) { e.Definition_Language = v },
+  "etymology":  func(e *d.Entry, v string) { e.Etymology = v },
+  "ipa":        func(e *d.Entry, v string) { e.IPA = v },
+  "phonetic":   func(e *d.Entry, v string) { e.Phonetic = v },
+}
+
+// Columns that must appear in a CSV import.
+var requiredColumns = []string{"headword", "wordtype", "definition", "hw_lang", "def_lang"}
+
+// importRow is an entry read from an import and the line it starts on.
+type importRow struct {
+  Line  int
+  Entry *d.Entry
+}
+
+// rowError is a problem with a single row of an import.
+type rowError struct {
+  Line  int    `json:"line"`
+  Error string `json:"error"`
+}
+
+// importResult reports the outcome of an import. Nothing is imported unless
+// every row is valid.
+type importResult struct {
+  Rows     int        `json:"rows"`
+  Valid    int        `json:"valid"`
+  Imported int64      `json:"imported"`
+  DryRun   bool       `json:"dry_run"`
+  Errors   []rowError `json:"errors"`
+}
+
+// importFormat works out the format of an import from a format name, media
+// type or file extension, returning "" if it isn't recognised.
+func importFormat(name string) string {
+  if mediatype, _, err := mime.ParseMediaType(name); err == nil {
+    name = mediatype
+  }
+  switch strings.TrimPrefix(strings.ToLower(name), ".") {
+  case formatCSV, "text/csv":
+    return formatCSV
+  case formatJSONL, "ndjson", "application/jsonl", "application/x-ndjson", "application/x-jsonlines":
+    return formatJSONL
+  case formatText, "txt", "text/plain":
+    return formatText
+  }
+  return ""
+}
+
+// importFileFormat works out the format of an import from its file name.
+func importFileFormat(path string) string {
+  return importFormat(filepath.Ext(path))
+}
+
+/*
+  parseImport reads the entries of an import in the given format. Rows that
+  can't be read are reported as row errors rather than ending the import, so
+  that every problem can be fixed at once. An error is only returned if the
+  input itself can't be read.
+*/
+func parseImport(r io.Reader, format string) ([]importRow, []rowError, error) {
+  switch format {
+  case formatCSV:
+    return parseCSV(r)
+  case formatJSONL:
+    return parseJSONL(r)
+  case formatText:
+    return parseText(r)
+  }
+  return nil, nil, fmt.Errorf("unknown import format %q", format)
+}
+
+func parseCSV(r io.Reader) ([]importRow, []rowError, error) {
+  reader := csv.NewReader(r)
+  reader.FieldsPerRecord = -1
+
+  header, err := reader.Read()
+  if err == io.EOF {
+    return nil, nil, nil
+  } else if err != nil {
+    return nil, nil, err
+  }
+  setters := make([]func(*d.Entry, string), len(header))
+  present := make(map[string]bool)
+  for i, column := range header {
+    column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+    if setters[i] = importColumns[column]; setters[i] == nil {
+      return nil, []rowError{{1, fmt.Sprintf("unknown column %q", column)}}, nil
+    }
+    present[column] = true
+  }
+  var missing []string
+  for _, column := range requiredColumns {
+    if !present[column] {
+      missing = append(missing, column)
+    }
+  }
+  if len(missing) > 0 {
+    return nil, []rowError{{1, "missing columns: " + strings.Join(missing, ", ")}}, nil
+  }
+
+  var rows []importRow
+  var errs []rowError
+  for {
+    record, err := reader.Read()
+    if err == io.EOF {
+      break
+    }
+    if parseErr, ok := err.(*csv.ParseError); ok {
+      errs = append(errs, rowError{parseErr.StartLine, parseErr.Err.Error()})
+      continue
+    } else if err != nil {
+      return nil, nil, err
+    }
+    // FieldPos may only be called after a successful Read
+    line, _ := reader.FieldPos(0)
+    if len(record) != len(header) {
+      errs = append(errs, rowError{line, fmt.Sprintf("expected %d fields, got %d", len(header), len(record))})
+      continue
+    }
+
+    e := new(d.Entry)
+    for i, value := range record {
+      setters[i](e, strings.TrimSpace(value))
+    }
+    rows = append(rows, importRow{line, e})
+  }
+  return rows, errs, nil
+}
+
+func parseJSONL(r io.Reader) ([]importRow, []rowError, error) {
+  var rows []importRow
+  var errs []rowError
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(nil, 1<<20)
+  for line := 1; scanner.Scan(); line++ {
+    text := strings.TrimSpace(scanner.Text())
+    if text == "" {
+      continue
+    }
+    e := new(d.Entry)
+    if err := json.Unmarshal([]byte(text), e); err != nil {
+      errs = append(errs, rowError{line, "invalid JSON: " + err.Error()})
+      continue
+    }
+    rows = append(rows, importRow{line, e})
+  }
+  return rows, errs, scanner.Err()
+}
+
+func parseText(r io.Reader) ([]importRow, []rowError, error) {
+  var lines []string
+  scanner := bufio.NewScanner(r)
+  for scanner.Scan() {
+    lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, nil, err
+  }
+  // Ignore blank lines at the end of the file
+  for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+    lines = lines[:len(lines)-1]
+  }
+
+  var rows []importRow
+  var errs []rowError
+  for i := 0; i < len(lines); i += 5 {
+    if i+5 > len(lines) {
+      errs = append(errs, rowError{i + 1, fmt.Sprintf("incomplete entry, expected 5 lines, got %d", len(lines)-i)})
+      break
+    }
+    rows = append(rows, importRow{i + 1, &d.Entry{
+      Headword:            strings.TrimSpace(lines[i]),
+      Wordtype:            strings.TrimSpace(lines[i+1]),
+      Definition:          strings.TrimSpace(lines[i+2]),
+      Headword_Language:   strings.TrimSpace(lines[i+3]),
+      Definition_Language: strings.TrimSpace(lines[i+4]),
+    }})
+  }
+  return rows, errs, nil
+}
+
+/*
+  importEntries validates parsed rows and, unless dryRun is set or any row is
+  invalid, writes them in a single transaction on behalf of author. Rows with
+  an ID update that entry; the rest create new entries. Names of wordtypes
+  and languages are resolved as for any other entry, see asIncoming.
+*/
+func importEntries(author string, rows []importRow, errs []rowError, dryRun bool) (*importResult, error) {
+  result := &importResult{Rows: len(rows) + len(errs), DryRun: dryRun, Errors: errs}
+
+  var entries []*d.Entry
+  for _, row := range rows {
+    e := row.Entry
+    if e.Headword == "" {
+      result.Errors = append(result.Errors, rowError{row.Line, "missing headword"})
+      continue
+    }
+    if e.ID != "" {
+      if _, err := data.IDSearch(e.ID); err == sql.ErrNoRows {
+        result.Errors = append(result.Errors, rowError{row.Line, fmt.Sprintf("no entry with id %q", e.ID)})
+        continue
+      } else if err != nil {
+        return nil, err
+      }
+    }
+    if _, err := asIncoming(e); err != nil {
+      if _, ok := err.(*unknownNameError); !ok {
+        return nil, err
+      }
+      result.Errors = append(result.Errors, rowError{row.Line, err.Error()})
+      continue
+    }
+    entries = append(entries, e)
+  }
+  result.Valid = len(entries)
+  sort.SliceStable(result.Errors, func(i, j int) bool {
+    return result.Errors[i].Line < result.Errors[j].Line
+  })
+  if result.Errors == nil {
+    result.Errors = []rowError{}
+  }
+
+  if dryRun || len(result.Errors) > 0 || len(entries) == 0 {
+    return result, nil
+  }
+  imported, err := data.InsertEntry(author, entries...)
+  if err != nil {
+    return nil, err
+  }
+  result.Imported = imported
+  return result, nil
+}
+
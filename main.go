@@ -6,14 +6,30 @@
 package main
 
 import (
+  "context"
+  "crypto/tls"
+  "flag"
+  "net"
   "net/http"
   "log"
+  "log/slog"
   "os"
+  "os/signal"
   "fmt"
+  "strconv"
+  "sync"
+  "syscall"
+  "time"
   "database/sql"
 
   "github.com/gorilla/handlers"
+  "github.com/gorilla/sessions"
+  "github.com/yugur/api/blob"
+  "github.com/yugur/api/certs"
   "github.com/yugur/api/config"
+  "github.com/yugur/api/metrics"
+  "github.com/yugur/api/migrations"
+  "github.com/yugur/api/util"
 )
 
 // Global config values. This should only be changed via a call to config.Load(string)
@@ -22,16 +38,22 @@ var conf config.Values
 // The primary database instance
 var db *sql.DB
 
-func init() {
+// Storage for uploaded audio
+var blobs blob.Store
+
+// setup loads the configuration and prepares the database. It isn't run from
+// init so that tests can use the handlers without a live database.
+func setup() {
   var err error
-  fmt.Print("Loading configuration...")
+  util.SetupLogging(os.Stderr, false)
   conf, err = config.Load("config/config.json")
   if err != nil {
-    log.Fatal(err.Error())
+    fatal("failed to load configuration", err)
   }
-  fmt.Println("done!")
+  util.SetupLogging(os.Stderr, conf.Verbose)
+  sessionStore = sessions.NewCookieStore([]byte(conf.Keystore))
+  slog.Info("configuration loaded")
 
-  fmt.Print("Preparing database...")
   psqlInfo := fmt.Sprintf(
     "host=%s port=%d user=%s " + 
     "password=%s dbname=%s sslmode=disable",
@@ -43,17 +65,79 @@ func init() {
 
   db, err = sql.Open("postgres", psqlInfo)
   if err != nil {
-    log.Fatal(err)
+    fatal("failed to open database", err)
   }
 
   if err = db.Ping(); err != nil {
-    log.Fatal(err)
+    fatal("failed to connect to database", err)
+  }
+  if err = metrics.RegisterDB(db); err != nil {
+    fatal("failed to register database metrics", err)
+  }
+  pg := newPGStore(db)
+  data = pg
+  slog.Info("database ready", "host", conf.Database.Host, "name", conf.Database.Name)
+
+  blobs, err = blob.NewDisk(conf.Media.Path)
+  if err != nil {
+    fatal("failed to prepare media storage", err)
+  }
+  slog.Info("media storage ready", "path", conf.Media.Path)
+
+  // Refuse to touch a schema from the future, even when migrating by hand.
+  if err = migrations.Check(db); err != nil {
+    fatal("unsupported schema", err)
+  }
+
+  // The migrate subcommand manages migrations itself
+  if len(os.Args) > 1 && os.Args[1] == "migrate" {
+    return
+  }
+
+  applied, err := migrations.Up(db)
+  if err != nil {
+    fatal("failed to migrate database", err)
   }
-  fmt.Println("done!")
+  slog.Info("database migrated", "applied", applied)
+
+  indexed, err := pg.FillHeadwordKeys()
+  if err != nil {
+    fatal("failed to index headwords", err)
+  }
+  slog.Info("headwords indexed", "indexed", indexed)
+}
+
+// fatal logs an error that stops the API from starting and exits.
+func fatal(msg string, err error) {
+  slog.Error(msg, "error", err)
+  os.Exit(1)
 }
 
 func main() {
-  fmt.Print("Initialising mux...")
+  setup()
+
+  if len(os.Args) > 1 && os.Args[1] == "migrate" {
+    migrate(os.Args[2:])
+    return
+  }
+  if len(os.Args) > 1 && os.Args[1] == "role" {
+    setRole(os.Args[2:])
+    return
+  }
+  if len(os.Args) > 1 && os.Args[1] == "import" {
+    importFile(os.Args[2:])
+    return
+  }
+
+  // Shut down on SIGINT or SIGTERM; a second signal stops the server at once
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  go func() {
+    <-ctx.Done()
+    stop()
+  }()
+  // Goroutines using the database, waited for before it is closed
+  var background sync.WaitGroup
+
   mux := http.NewServeMux()
 
   if conf.Endpoints.Index.Enable {
@@ -62,6 +146,12 @@ func main() {
   if conf.Endpoints.Status.Enable {
     mux.HandleFunc(conf.Endpoints.Status.Path, statusHandler)
   }
+  if conf.Endpoints.Health.Enable {
+    mux.HandleFunc(conf.Endpoints.Health.Path, healthHandler)
+  }
+  if conf.Endpoints.Ready.Enable {
+    mux.HandleFunc(conf.Endpoints.Ready.Path, readyHandler)
+  }
   if conf.Endpoints.Search.Enable {
     mux.HandleFunc(conf.Endpoints.Search.Path, searchHandler)
   }
@@ -81,24 +171,298 @@ func main() {
     mux.HandleFunc(conf.Endpoints.Fetch.Path, fetchHandler)
   }
   if conf.Endpoints.Random.Enable {
-    mux.HandleFunc(conf.Endpoints.Random.Path, notImplemented)
+    mux.HandleFunc(conf.Endpoints.Random.Path, randomHandler)
   }
-  fmt.Println("done!")
-
-  fmt.Printf("The API is running at http://%s:%d/\n", conf.Host, conf.Port)
+  if conf.Endpoints.Audio.Enable {
+    mux.HandleFunc(conf.Endpoints.Audio.Path, audioHandler)
+  }
+  if conf.Endpoints.Translate.Enable {
+    mux.HandleFunc(conf.Endpoints.Translate.Path, translateHandler)
+  }
+  if conf.Endpoints.Relation.Enable {
+    mux.HandleFunc(conf.Endpoints.Relation.Path, relationHandler)
+  }
+  if conf.Endpoints.Token.Enable {
+    mux.HandleFunc(conf.Endpoints.Token.Path, tokenHandler)
+  }
+  if conf.Endpoints.Keys.Enable {
+    mux.HandleFunc(conf.Endpoints.Keys.Path, keysHandler)
+  }
+  if conf.Endpoints.Role.Enable {
+    mux.HandleFunc(conf.Endpoints.Role.Path, roleHandler)
+  }
+  if conf.Endpoints.History.Enable {
+    mux.HandleFunc(conf.Endpoints.History.Path, historyHandler)
+  }
+  if conf.Endpoints.Proposal.Enable {
+    mux.HandleFunc(conf.Endpoints.Proposal.Path, proposalHandler)
+  }
+  if conf.Endpoints.Review.Enable {
+    mux.HandleFunc(conf.Endpoints.Review.Path, reviewHandler)
+  }
+  if conf.Endpoints.Import.Enable {
+    mux.HandleFunc(conf.Endpoints.Import.Path, importHandler)
+  }
+  if conf.Endpoints.Export.Enable {
+    mux.HandleFunc(conf.Endpoints.Export.Path, exportHandler)
+  }
+  if conf.Endpoints.Suggest.Enable {
+    mux.HandleFunc(conf.Endpoints.Suggest.Path, suggestHandler)
+  }
+  if conf.Endpoints.Translit.Enable {
+    mux.HandleFunc(conf.Endpoints.Translit.Path, transliterateHandler)
+  }
+  if conf.Endpoints.Metrics.Enable {
+    mux.Handle(conf.Endpoints.Metrics.Path, metrics.Handler())
+  }
+  if conf.Endpoints.Bundle.Enable {
+    mux.HandleFunc(conf.Endpoints.Bundle.Path, bundleHandler)
+    if conf.Bundles.Interval > 0 {
+      background.Add(1)
+      go func() {
+        defer background.Done()
+        scheduleBundles(ctx, seconds(conf.Bundles.Interval))
+      }()
+    }
+  }
+  handler := authenticate(authorize(accessRules(), mux))
   if conf.CORS {
-    headersOk := handlers.AllowedHeaders([]string{"X-Requested-With"})
+    headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Authorization", "Content-Type", util.RequestIDHeader})
+    exposedOk := handlers.ExposedHeaders([]string{util.RequestIDHeader})
     originsOk := handlers.AllowedOrigins([]string{"*"})
     methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
+    handler = handlers.CORS(originsOk, headersOk, exposedOk, methodsOk)(handler)
+  }
+  // Every request is logged, including those refused by CORS or auth
+  handler = requestIDs(accessLog(meter(mux, handler)))
+
+  srv, err := newServer(ctx, handler)
+  if err != nil {
+    fatal("failed to load TLS certificate", err)
+  }
+  ln, err := net.Listen("tcp", srv.Addr)
+  if err != nil {
+    fatal("failed to listen", err)
+  }
+  scheme := "http"
+  if srv.TLSConfig != nil {
+    scheme = "https"
+  }
+  slog.Info("listening", "url", fmt.Sprintf("%s://%s/", scheme, ln.Addr()))
 
-    err := http.ListenAndServe(fmt.Sprintf(":%d", conf.Port), handlers.CORS(originsOk, headersOk, methodsOk)(mux))
+  if err = runServer(ctx, srv, ln); err != nil {
+    fatal("server failed", err)
+  }
+  // Let a bundle being generated finish with the database
+  background.Wait()
+  if err = db.Close(); err != nil {
+    slog.Error("failed to close database", "error", err)
+  }
+  slog.Info("stopped")
+}
+
+/*
+  newServer returns a server for handler listening on the configured host and
+  port, with the configured timeouts. If a TLS certificate and key are
+  configured the server is set up for HTTPS, reloading them as they change
+  until ctx is done.
+*/
+func newServer(ctx context.Context, handler http.Handler) (*http.Server, error) {
+  srv := &http.Server{
+    Addr:              net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port)),
+    Handler:           handler,
+    ReadHeaderTimeout: seconds(conf.Server.ReadHeaderTimeout),
+    ReadTimeout:       seconds(conf.Server.ReadTimeout),
+    WriteTimeout:      seconds(conf.Server.WriteTimeout),
+    IdleTimeout:       seconds(conf.Server.IdleTimeout),
+    ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+  }
+  if conf.TLS.Cert == "" || conf.TLS.Key == "" {
+    return srv, nil
+  }
+
+  cert, err := certs.New(conf.TLS.Cert, conf.TLS.Key)
+  if err != nil {
+    return nil, err
+  }
+  if conf.TLS.ReloadInterval > 0 {
+    go cert.Watch(ctx, seconds(conf.TLS.ReloadInterval))
+  }
+  srv.TLSConfig = &tls.Config{
+    MinVersion:     tls.VersionTLS12,
+    GetCertificate: cert.GetCertificate,
+  }
+  return srv, nil
+}
+
+/*
+  runServer runs srv on ln until ctx is done, then stops accepting connections
+  and waits for requests in flight to finish, for up to
+  conf.Server.ShutdownTimeout seconds (or as long as they take if 0).
+*/
+func runServer(ctx context.Context, srv *http.Server, ln net.Listener) error {
+  errs := make(chan error, 1)
+  go func() {
+    if srv.TLSConfig != nil {
+      errs <- srv.ServeTLS(ln, "", "")
+    } else {
+      errs <- srv.Serve(ln)
+    }
+  }()
+
+  select {
+  case err := <-errs:
+    return err
+  case <-ctx.Done():
+  }
+
+  slog.Info("shutting down", "timeout", conf.Server.ShutdownTimeout)
+  shutdown := context.Background()
+  if conf.Server.ShutdownTimeout > 0 {
+    var cancel context.CancelFunc
+    shutdown, cancel = context.WithTimeout(shutdown, seconds(conf.Server.ShutdownTimeout))
+    defer cancel()
+  }
+  return srv.Shutdown(shutdown)
+}
+
+// seconds converts a number of seconds from the config to a duration.
+func seconds(n int) time.Duration {
+  return time.Duration(n) * time.Second
+}
+
+/*
+  migrate implements the migrate subcommand.
+    migrate [up]     applies all pending migrations
+    migrate down [n] reverts the newest n migrations (default 1)
+    migrate version  prints the current and latest schema versions
+*/
+func migrate(args []string) {
+  command := "up"
+  if len(args) > 0 {
+    command = args[0]
+  }
+
+  switch command {
+  case "up":
+    applied, err := migrations.Up(db)
     if err != nil {
-      log.Fatal("ListenAndServe: ", err)
+      log.Fatal(err)
     }
-  } else {
-    err := http.ListenAndServe(fmt.Sprintf(":%d", conf.Port), handlers.LoggingHandler(os.Stdout, mux))
+    fmt.Printf("Applied %d migration(s)\n", applied)
+  case "down":
+    n := 1
+    if len(args) > 1 {
+      var err error
+      n, err = strconv.Atoi(args[1])
+      if err != nil || n < 1 {
+        log.Fatalf("migrate down: invalid count %q", args[1])
+      }
+    }
+    reverted, err := migrations.Down(db, n)
     if err != nil {
-      log.Fatal("ListenAndServe: ", err)
+      log.Fatal(err)
     }
+    fmt.Printf("Reverted %d migration(s)\n", reverted)
+  case "version":
+    version, err := migrations.Version(db)
+    if err != nil {
+      log.Fatal(err)
+    }
+    fmt.Printf("Schema version %d (latest %d)\n", version, migrations.Latest())
+  default:
+    log.Fatalf("migrate: unknown command %q (expected up, down or version)", command)
+  }
+}
+
+/*
+  setRole implements the role subcommand, which is the only way to make the
+  first admin.
+    role <username> <role>  gives the user the role
+*/
+func setRole(args []string) {
+  if len(args) != 2 {
+    log.Fatal("usage: role <username> <viewer|contributor|editor|admin>")
+  }
+  username, role := args[0], args[1]
+  if _, ok := roleRank[role]; !ok {
+    log.Fatalf("role: unknown role %q", role)
+  }
+
+  user, err := data.UserByName(username)
+  if err == sql.ErrNoRows {
+    log.Fatalf("role: no user called %q", username)
+  } else if err != nil {
+    log.Fatal(err)
+  }
+  if _, err := data.SetRole(user.UID, role); err != nil {
+    log.Fatal(err)
+  }
+  fmt.Printf("User %s is now %s\n", username, role)
+}
+
+/*
+  importFile implements the import subcommand, which imports entries like the
+  import endpoint but from a file.
+    import [-dry-run] [-format csv|jsonl|text] [-author username] <file>
+  The format defaults to the one implied by the file extension. Changes are
+  recorded as made by the author, if given.
+*/
+func importFile(args []string) {
+  flags := flag.NewFlagSet("import", flag.ExitOnError)
+  dryRun := flags.Bool("dry-run", false, "validate the file without importing it")
+  format := flags.String("format", "", "csv, jsonl or text (default from the file extension)")
+  username := flags.String("author", "", "user to record as the author of the changes")
+  flags.Parse(args)
+  if flags.NArg() != 1 {
+    log.Fatal("usage: import [-dry-run] [-format csv|jsonl|text] [-author username] <file>")
+  }
+  path := flags.Arg(0)
+
+  if *format == "" {
+    *format = importFileFormat(path)
+  } else {
+    *format = importFormat(*format)
+  }
+  if *format == "" {
+    log.Fatalf("import: unknown format for %q, use -format", path)
+  }
+
+  var author string
+  if *username != "" {
+    user, err := data.UserByName(*username)
+    if err == sql.ErrNoRows {
+      log.Fatalf("import: no user called %q", *username)
+    } else if err != nil {
+      log.Fatal(err)
+    }
+    author = user.UID
+  }
+
+  f, err := os.Open(path)
+  if err != nil {
+    log.Fatal(err)
+  }
+  defer f.Close()
+  rows, errs, err := parseImport(f, *format)
+  if err != nil {
+    log.Fatal(err)
+  }
+  result, err := importEntries(author, rows, errs, *dryRun)
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  for _, e := range result.Errors {
+    fmt.Printf("%s:%d: %s\n", path, e.Line, e.Error)
+  }
+  switch {
+  case len(result.Errors) > 0:
+    fmt.Printf("%d of %d row(s) invalid, nothing imported\n", len(result.Errors), result.Rows)
+    os.Exit(1)
+  case *dryRun:
+    fmt.Printf("%d row(s) valid, nothing imported (dry run)\n", result.Valid)
+  default:
+    fmt.Printf("Imported %d entry(s)\n", result.Imported)
   }
 }
@@ -0,0 +1,1081 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "context"
+  "database/sql"
+  "math/rand"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "unicode"
+  "unicode/utf8"
+
+  d "github.com/yugur/api/entry"
+  "github.com/yugur/api/fuzzy"
+  "github.com/yugur/api/migrations"
+  "github.com/yugur/api/normalize"
+)
+
+// memStore is an in-memory implementation of Store for use in tests and
+// demonstrations. It is safe for concurrent use. Entries are copied on the way
+// in and out so that callers can't modify the store by accident.
+type memStore struct {
+  mu     sync.RWMutex
+  nextID int
+
+  entries   map[string]*d.Entry
+  entryTags map[string]map[string]bool // entry ID -> set of tag IDs
+  tags      map[string]string          // tag ID -> name
+  wordtypes map[string]string          // wordtype ID -> name
+  languages map[string]string          // language ID -> code
+  audio     map[string]*audioFile      // audio ID -> clip
+  relations map[relation]bool
+  users     map[string]*User           // uid -> user
+  refresh   map[string]*refreshToken   // token hash -> token
+  apiKeys   map[string]*apiKey         // key ID -> key
+  revisions []*revision                // oldest first
+  proposals map[string]*proposal       // proposal ID -> proposal
+}
+
+// refreshToken is a refresh token as kept by memStore.
+type refreshToken struct {
+  UID     string
+  Expires time.Time
+}
+
+func newMemStore() *memStore {
+  return &memStore{
+    entries:   make(map[string]*d.Entry),
+    entryTags: make(map[string]map[string]bool),
+    tags:      make(map[string]string),
+    wordtypes: make(map[string]string),
+    languages: make(map[string]string),
+    audio:     make(map[string]*audioFile),
+    relations: make(map[relation]bool),
+    users:     make(map[string]*User),
+    refresh:   make(map[string]*refreshToken),
+    apiKeys:   make(map[string]*apiKey),
+    proposals: make(map[string]*proposal),
+  }
+}
+
+//---------------------------------------------------------
+//---- Search Queries
+//---------------------------------------------------------
+
+func (s *memStore) Index() ([]*d.Entry, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  return s.match(func(e *d.Entry) bool { return true }), nil
+}
+
+func (s *memStore) EntryPage(f entryFilter, p pageRequest) ([]*d.Entry, string, int, error) {
+  keep, err := s.filter(f)
+  if err != nil {
+    return nil, "", 0, err
+  }
+
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  matches := d.Matches(s.match(keep)...)
+  page, next := paginate(matches, p)
+
+  entries := make([]*d.Entry, 0, len(page))
+  for _, m := range page {
+    entries = append(entries, m.Entry)
+  }
+  if p.NoTotal {
+    return entries, next, 0, nil
+  }
+  return entries, next, len(matches), nil
+}
+
+func (s *memStore) IDSearch(ids ...string) ([]*d.Entry, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  var errNoRows error
+  entries := make([]*d.Entry, 0)
+
+  for _, id := range ids {
+    e, ok := s.entries[id]
+    if !ok {
+      errNoRows = sql.ErrNoRows
+      continue
+    }
+    entries = append(entries, s.output(e))
+  }
+  return entries, errNoRows
+}
+
+func (s *memStore) HeadwordSearch(word string) ([]*d.Entry, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  key := normalize.Key(word)
+  if utf8.RuneCountInString(word) == 1 {
+    return s.match(func(e *d.Entry) bool {
+      return strings.HasPrefix(normalize.Key(e.Headword), key)
+    }), nil
+  }
+  return s.match(func(e *d.Entry) bool { return normalize.Key(e.Headword) == key }), nil
+}
+
+func (s *memStore) FuzzyHeadwordSearch(word string, f entryFilter, threshold float64, limit int) ([]*d.Match, error) {
+  keep, err := s.filter(f)
+  if err != nil {
+    return nil, err
+  }
+
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  key := normalize.Key(word)
+  var matches []*d.Match
+  for _, e := range s.match(keep) {
+    similarity := fuzzy.Similarity(normalize.Key(e.Headword), key)
+    if similarity >= threshold && similarity > 0 {
+      matches = append(matches, &d.Match{Entry: e, Similarity: similarity})
+    }
+  }
+  sort.SliceStable(matches, func(i, j int) bool {
+    return matches[i].Similarity > matches[j].Similarity
+  })
+  if len(matches) > limit {
+    matches = matches[:limit]
+  }
+  return matches, nil
+}
+
+func (s *memStore) SuggestHeadwords(prefix string, f entryFilter, limit int) ([]*suggestion, error) {
+  keep, err := s.filter(f)
+  if err != nil {
+    return nil, err
+  }
+
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  prefix = normalize.Key(prefix)
+  found := make(map[[2]string]*suggestion)
+  exact := make(map[*suggestion]bool)
+  var suggestions []*suggestion
+  for _, e := range s.entries {
+    key := normalize.Key(e.Headword)
+    if !keep(e) || !strings.HasPrefix(key, prefix) {
+      continue
+    }
+    headword := [2]string{e.Headword, e.Headword_Language}
+    if sg, ok := found[headword]; ok {
+      sg.Entries++
+      continue
+    }
+    sg := &suggestion{Headword: e.Headword, Language: e.Headword_Language, Entries: 1}
+    found[headword] = sg
+    exact[sg] = key == prefix
+    suggestions = append(suggestions, sg)
+  }
+
+  sort.Slice(suggestions, func(i, j int) bool {
+    a, b := suggestions[i], suggestions[j]
+    if exact[a] != exact[b] {
+      return exact[a]
+    }
+    if la, lb := utf8.RuneCountInString(a.Headword), utf8.RuneCountInString(b.Headword); la != lb {
+      return la < lb
+    }
+    if a.Headword != b.Headword {
+      return a.Headword < b.Headword
+    }
+    return compareIDs(a.Language, b.Language) < 0
+  })
+  if len(suggestions) > limit {
+    suggestions = suggestions[:limit]
+  }
+  return suggestions, nil
+}
+
+func (s *memStore) TagSearch(tag string) ([]*d.Entry, error) {
+  tagID, err := s.TagID(tag)
+  if err != nil {
+    return nil, err
+  }
+
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  return s.match(func(e *d.Entry) bool { return s.entryTags[e.ID][tagID] }), nil
+}
+
+func (s *memStore) WordtypeSearch(wordtype string) ([]*d.Entry, error) {
+  id, err := s.WordtypeID(wordtype)
+  if err != nil {
+    return nil, err
+  }
+
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  return s.match(func(e *d.Entry) bool { return e.Wordtype == id }), nil
+}
+
+// DefinitionSearch approximates the Postgres search with case-insensitive
+// whole word matching. An entry matches if its definition contains every word
+// in the query and is ranked by how much of the definition those words make up.
+func (s *memStore) DefinitionSearch(query string, f entryFilter) ([]*d.Match, error) {
+  terms := make(map[string]bool)
+  for _, span := range wordSpans(query) {
+    terms[strings.ToLower(query[span[0]:span[1]])] = true
+  }
+  if len(terms) == 0 {
+    return nil, nil
+  }
+
+  keep, err := s.filter(f)
+  if err != nil {
+    return nil, err
+  }
+
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  var matches []*d.Match
+  for _, e := range s.match(keep) {
+    spans := wordSpans(e.Definition)
+    found := make(map[string]bool)
+    var snippet strings.Builder
+    last := 0
+    for _, span := range spans {
+      word := strings.ToLower(e.Definition[span[0]:span[1]])
+      if !terms[word] {
+        continue
+      }
+      found[word] = true
+      snippet.WriteString(e.Definition[last:span[0]])
+      snippet.WriteString(markStart + e.Definition[span[0]:span[1]] + markStop)
+      last = span[1]
+    }
+    if len(found) != len(terms) {
+      continue
+    }
+    snippet.WriteString(e.Definition[last:])
+
+    matches = append(matches, &d.Match{
+      Entry:   e,
+      Rank:    float64(len(found)) / float64(len(spans)),
+      Snippet: markSnippet(snippet.String()),
+    })
+  }
+  sort.SliceStable(matches, func(i, j int) bool {
+    return matches[i].Rank > matches[j].Rank
+  })
+  return matches, nil
+}
+
+func (s *memStore) RandomSearch(f entryFilter, n int) ([]*d.Entry, error) {
+  keep, err := s.filter(f)
+  if err != nil {
+    return nil, err
+  }
+
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  entries := s.match(keep)
+  rand.Shuffle(len(entries), func(i, j int) {
+    entries[i], entries[j] = entries[j], entries[i]
+  })
+  if len(entries) > n {
+    entries = entries[:n]
+  }
+  return entries, nil
+}
+
+func (s *memStore) DailySearch(f entryFilter, day time.Time) ([]*d.Entry, error) {
+  keep, err := s.filter(f)
+  if err != nil {
+    return nil, err
+  }
+
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  entries := s.match(keep)
+  if len(entries) == 0 {
+    return nil, nil
+  }
+  return entries[dailyOffset(day, f.key(), len(entries)):][:1], nil
+}
+
+//---------------------------------------------------------
+//---- Executable Queries
+//---------------------------------------------------------
+
+func (s *memStore) InsertEntry(author string, entries ...*d.Entry) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.insertEntries(author, entries...), nil
+}
+
+// insertEntries does the work of InsertEntry. The caller must hold s.mu.
+func (s *memStore) insertEntries(author string, entries ...*d.Entry) int64 {
+  var rowsAffected int64
+  for _, entry := range entries {
+    e := entry.Copy()
+    e.Audio = nil
+    e.Relations = nil
+    action := actionUpdate
+    if e.ID == "" {
+      e.ID = s.newID()
+      entry.ID = e.ID
+      action = actionCreate
+    } else if _, ok := s.entries[e.ID]; !ok {
+      continue
+    }
+    s.entries[e.ID] = e
+    s.record(e.ID, action, author, e)
+    rowsAffected++
+  }
+  return rowsAffected
+}
+
+func (s *memStore) RestoreEntry(author string, e *d.Entry) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  c := snapshotOf(e.ID, e)
+  s.entries[c.ID] = c
+  s.record(c.ID, actionRestore, author, c)
+  return nil
+}
+
+func (s *memStore) DeleteEntry(author string, ids ...string) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  var rowsAffected int64
+  for _, id := range ids {
+    if e, ok := s.entries[id]; ok {
+      s.record(id, actionDelete, author, e)
+      delete(s.entries, id)
+      delete(s.entryTags, id)
+      for audioID, f := range s.audio {
+        if f.EntryID == id {
+          delete(s.audio, audioID)
+        }
+      }
+      for r := range s.relations {
+        if r.EntryID == id || r.RelatedID == id {
+          delete(s.relations, r)
+        }
+      }
+      rowsAffected++
+    }
+  }
+  return rowsAffected, nil
+}
+
+func (s *memStore) AddTag(tagID, entryID string) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if _, ok := s.tags[tagID]; !ok {
+    return 0, sql.ErrNoRows
+  }
+  if _, ok := s.entries[entryID]; !ok {
+    return 0, sql.ErrNoRows
+  }
+  if s.entryTags[entryID] == nil {
+    s.entryTags[entryID] = make(map[string]bool)
+  }
+  s.entryTags[entryID][tagID] = true
+  return 1, nil
+}
+
+func (s *memStore) RemoveTag(tagID, entryID string) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if !s.entryTags[entryID][tagID] {
+    return 0, nil
+  }
+  delete(s.entryTags[entryID], tagID)
+  return 1, nil
+}
+
+func (s *memStore) CreateTag(name string) (string, error) {
+  return s.create(s.tags, name)
+}
+
+func (s *memStore) CreateWordtype(name string) (string, error) {
+  return s.create(s.wordtypes, name)
+}
+
+func (s *memStore) CreateLanguage(name, code string) (string, error) {
+  return s.create(s.languages, code)
+}
+
+//---------------------------------------------------------
+//---- Audio Queries
+//---------------------------------------------------------
+
+func (s *memStore) InsertAudio(f *audioFile) (string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if _, ok := s.entries[f.EntryID]; !ok {
+    return "", sql.ErrNoRows
+  }
+  c := *f
+  c.ID = s.newID()
+  c.Uploaded = time.Now()
+  s.audio[c.ID] = &c
+  return c.ID, nil
+}
+
+func (s *memStore) AudioFile(id string) (*audioFile, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  f, ok := s.audio[id]
+  if !ok {
+    return nil, sql.ErrNoRows
+  }
+  c := *f
+  return &c, nil
+}
+
+func (s *memStore) EntryAudio(entryID string) ([]*audioFile, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  return s.sortedAudio(entryID), nil
+}
+
+func (s *memStore) DeleteAudio(id string) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if _, ok := s.audio[id]; !ok {
+    return 0, nil
+  }
+  delete(s.audio, id)
+  return 1, nil
+}
+
+//---------------------------------------------------------
+//---- Revision Queries
+//---------------------------------------------------------
+
+// record adds a revision of an entry. The caller must hold the write lock.
+func (s *memStore) record(entryID, action, author string, e *d.Entry) {
+  r := &revision{
+    ID:       s.newID(),
+    EntryID:  entryID,
+    Action:   action,
+    AuthorID: author,
+    Created:  time.Now(),
+    Entry:    snapshotOf(entryID, e),
+  }
+  if u, ok := s.users[author]; ok {
+    r.Author = u.Username
+  }
+  s.revisions = append(s.revisions, r)
+}
+
+func (s *memStore) Revisions(entryID string) ([]*revision, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  var revisions []*revision
+  for i := len(s.revisions) - 1; i >= 0; i-- {
+    if r := s.revisions[i]; r.EntryID == entryID {
+      c := *r
+      c.Entry = nil
+      revisions = append(revisions, &c)
+    }
+  }
+  return revisions, nil
+}
+
+func (s *memStore) Revision(id string) (*revision, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  for _, r := range s.revisions {
+    if r.ID == id {
+      c := *r
+      c.Entry = r.Entry.Copy()
+      return &c, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+//---------------------------------------------------------
+//---- Proposal Queries
+//---------------------------------------------------------
+
+func (s *memStore) InsertProposal(p *proposal) (string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  u, ok := s.users[p.AuthorID]
+  if !ok {
+    return "", sql.ErrNoRows
+  }
+  c := copyProposal(p)
+  c.ID = s.newID()
+  c.Author = u.Username
+  c.Created = time.Now()
+  c.Updated = c.Created
+  c.Reviewed = nil
+  s.proposals[c.ID] = c
+  return c.ID, nil
+}
+
+func (s *memStore) Proposal(id string) (*proposal, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  p, ok := s.proposals[id]
+  if !ok {
+    return nil, sql.ErrNoRows
+  }
+  return copyProposal(p), nil
+}
+
+func (s *memStore) Proposals(status, authorID string) ([]*proposal, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  var proposals []*proposal
+  for _, p := range s.proposals {
+    if (status == "" || p.Status == status) && (authorID == "" || p.AuthorID == authorID) {
+      proposals = append(proposals, copyProposal(p))
+    }
+  }
+  sort.Slice(proposals, func(i, j int) bool {
+    return compareIDs(proposals[i].ID, proposals[j].ID) < 0
+  })
+  return proposals, nil
+}
+
+func (s *memStore) UpdateProposal(p *proposal, from ...string) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  stored, ok := s.proposals[p.ID]
+  if !ok || !hasStatus(stored, from...) {
+    return 0, nil
+  }
+  now := time.Now()
+  stored.EntryID = p.EntryID
+  stored.BaseRevision = p.BaseRevision
+  stored.Entry = p.Entry.Copy()
+  stored.Status = p.Status
+  stored.Comment = p.Comment
+  stored.ReviewerID = p.ReviewerID
+  stored.Updated = now
+  if p.ReviewerID != "" {
+    stored.Reviewed = &now
+  }
+  return 1, nil
+}
+
+func (s *memStore) ApproveProposal(p *proposal) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  stored, ok := s.proposals[p.ID]
+  if !ok || stored.Status != statusPending {
+    return 0, nil
+  }
+  if stored.EntryID != "" {
+    if _, ok := s.entries[stored.EntryID]; !ok {
+      return 0, errEntryDeleted
+    }
+    if s.latestRevision(stored.EntryID) != stored.BaseRevision {
+      return 0, errEntryChanged
+    }
+  }
+  e := stored.Entry.Copy()
+  if s.insertEntries(stored.AuthorID, e) == 0 {
+    return 0, errEntryDeleted
+  }
+
+  now := time.Now()
+  stored.EntryID = e.ID
+  stored.Entry.ID = e.ID
+  stored.Status = statusApproved
+  stored.Comment = p.Comment
+  stored.ReviewerID = p.ReviewerID
+  stored.Updated = now
+  stored.Reviewed = &now
+  p.Status, p.EntryID, p.Entry = statusApproved, e.ID, stored.Entry.Copy()
+  return 1, nil
+}
+
+// latestRevision returns the ID of the latest revision of an entry, or ""
+// if it has none. The caller must hold the read lock.
+func (s *memStore) latestRevision(entryID string) string {
+  for i := len(s.revisions) - 1; i >= 0; i-- {
+    if s.revisions[i].EntryID == entryID {
+      return s.revisions[i].ID
+    }
+  }
+  return ""
+}
+
+// hasStatus reports whether a proposal has one of the given statuses.
+func hasStatus(p *proposal, statuses ...string) bool {
+  for _, status := range statuses {
+    if p.Status == status {
+      return true
+    }
+  }
+  return false
+}
+
+// copyProposal returns a copy of a proposal which shares nothing with it.
+func copyProposal(p *proposal) *proposal {
+  c := *p
+  c.Entry = p.Entry.Copy()
+  if p.Reviewed != nil {
+    reviewed := *p.Reviewed
+    c.Reviewed = &reviewed
+  }
+  return &c
+}
+
+//---------------------------------------------------------
+//---- Relation Queries
+//---------------------------------------------------------
+
+func (s *memStore) AddRelation(r relation) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if _, ok := s.entries[r.EntryID]; !ok {
+    return 0, sql.ErrNoRows
+  }
+  if _, ok := s.entries[r.RelatedID]; !ok {
+    return 0, sql.ErrNoRows
+  }
+  if s.relations[r] {
+    return 0, nil
+  }
+  s.relations[r] = true
+  return 1, nil
+}
+
+func (s *memStore) RemoveRelation(r relation) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if !s.relations[r] {
+    return 0, nil
+  }
+  delete(s.relations, r)
+  return 1, nil
+}
+
+func (s *memStore) Relations(entryID string) ([]*d.Relation, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  return s.entryRelations(entryID), nil
+}
+
+//---------------------------------------------------------
+//---- User Queries
+//---------------------------------------------------------
+
+func (s *memStore) UserByID(uid string) (*User, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  u, ok := s.users[uid]
+  if !ok {
+    return nil, sql.ErrNoRows
+  }
+  user := *u
+  return &user, nil
+}
+
+func (s *memStore) UserByName(username string) (*User, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  for _, u := range s.users {
+    if u.Username == username {
+      user := *u
+      return &user, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+func (s *memStore) InsertUser(u *User) (string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for _, existing := range s.users {
+    if existing.Username == u.Username || existing.Email == u.Email {
+      return "", errDuplicate
+    }
+  }
+  user := *u
+  user.UID = s.newID()
+  if user.Role == "" {
+    user.Role = roleViewer
+  }
+  s.users[user.UID] = &user
+  return user.UID, nil
+}
+
+func (s *memStore) SetRole(uid, role string) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  u, ok := s.users[uid]
+  if !ok {
+    return 0, nil
+  }
+  u.Role = role
+  return 1, nil
+}
+
+//---------------------------------------------------------
+//---- Token Queries
+//---------------------------------------------------------
+
+func (s *memStore) InsertRefreshToken(hash, uid string, expires time.Time) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if _, ok := s.users[uid]; !ok {
+    return sql.ErrNoRows
+  }
+  if _, ok := s.refresh[hash]; ok {
+    return errDuplicate
+  }
+  s.refresh[hash] = &refreshToken{UID: uid, Expires: expires}
+  return nil
+}
+
+func (s *memStore) TakeRefreshToken(hash string, now time.Time) (string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  token, ok := s.refresh[hash]
+  if !ok {
+    return "", sql.ErrNoRows
+  }
+  delete(s.refresh, hash)
+  if !now.Before(token.Expires) {
+    return "", sql.ErrNoRows
+  }
+  return token.UID, nil
+}
+
+func (s *memStore) InsertAPIKey(k *apiKey) (string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  if _, ok := s.users[k.UID]; !ok {
+    return "", sql.ErrNoRows
+  }
+  for _, existing := range s.apiKeys {
+    if existing.Hash == k.Hash {
+      return "", errDuplicate
+    }
+  }
+  c := *k
+  c.ID = s.newID()
+  c.Created = time.Now()
+  c.LastUsed = nil
+  s.apiKeys[c.ID] = &c
+  return c.ID, nil
+}
+
+func (s *memStore) APIKeyUser(hash string) (*User, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for _, k := range s.apiKeys {
+    if k.Hash == hash {
+      now := time.Now()
+      k.LastUsed = &now
+      user := *s.users[k.UID]
+      return &user, nil
+    }
+  }
+  return nil, sql.ErrNoRows
+}
+
+func (s *memStore) UserAPIKeys(uid string) ([]*apiKey, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  var keys []*apiKey
+  for _, k := range s.apiKeys {
+    if k.UID == uid {
+      c := *k
+      keys = append(keys, &c)
+    }
+  }
+  sort.Slice(keys, func(i, j int) bool {
+    return compareIDs(keys[i].ID, keys[j].ID) < 0
+  })
+  return keys, nil
+}
+
+func (s *memStore) DeleteAPIKey(id, uid string) (int64, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  k, ok := s.apiKeys[id]
+  if !ok || k.UID != uid {
+    return 0, nil
+  }
+  delete(s.apiKeys, id)
+  return 1, nil
+}
+
+//---------------------------------------------------------
+//---- Health Queries
+//---------------------------------------------------------
+
+// Ping succeeds unless ctx is done, as a memStore can't be out of reach.
+func (s *memStore) Ping(ctx context.Context) error {
+  return ctx.Err()
+}
+
+// SchemaVersion is always the latest, a memStore has no schema to migrate.
+func (s *memStore) SchemaVersion() (int, error) {
+  return migrations.Latest(), nil
+}
+
+func (s *memStore) Counts() (*storeCounts, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  c := &storeCounts{
+    Entries:   len(s.entries),
+    Users:     len(s.users),
+    Languages: make(map[string]int),
+  }
+  for _, code := range s.languages {
+    c.Languages[code] = 0
+  }
+  for _, e := range s.entries {
+    if code, ok := s.languages[e.Headword_Language]; ok {
+      c.Languages[code]++
+    }
+  }
+  return c, nil
+}
+
+//---------------------------------------------------------
+//---- Helper Functions
+//---------------------------------------------------------
+
+func (s *memStore) TagID(name string) (string, error) {
+  return s.id(s.tags, name)
+}
+
+func (s *memStore) TagName(id string) (string, error) {
+  return s.name(s.tags, id)
+}
+
+func (s *memStore) WordtypeID(name string) (string, error) {
+  return s.id(s.wordtypes, name)
+}
+
+func (s *memStore) WordtypeName(id string) (string, error) {
+  return s.name(s.wordtypes, id)
+}
+
+func (s *memStore) LocaleID(code string) (string, error) {
+  return s.id(s.languages, code)
+}
+
+func (s *memStore) LocaleCode(id string) (string, error) {
+  return s.name(s.languages, id)
+}
+
+// newID returns a fresh identifier. The caller must hold the write lock.
+func (s *memStore) newID() string {
+  s.nextID++
+  return strconv.Itoa(s.nextID)
+}
+
+func (s *memStore) id(table map[string]string, name string) (string, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  for id, n := range table {
+    if n == name {
+      return id, nil
+    }
+  }
+  return "", sql.ErrNoRows
+}
+
+func (s *memStore) name(table map[string]string, id string) (string, error) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+
+  name, ok := table[id]
+  if !ok {
+    return "", sql.ErrNoRows
+  }
+  return name, nil
+}
+
+func (s *memStore) create(table map[string]string, name string) (string, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for _, n := range table {
+    if n == name {
+      return "", errDuplicate
+    }
+  }
+  id := s.newID()
+  table[id] = name
+  return id, nil
+}
+
+// match returns copies of the entries for which keep is true, ordered by ID.
+// The caller must hold the read lock.
+func (s *memStore) match(keep func(*d.Entry) bool) []*d.Entry {
+  var entries []*d.Entry
+  for _, e := range s.entries {
+    if keep(e) {
+      entries = append(entries, s.output(e))
+    }
+  }
+  sort.Slice(entries, func(i, j int) bool {
+    return compareIDs(entries[i].ID, entries[j].ID) < 0
+  })
+  return entries
+}
+
+// filter resolves f into a predicate for match.
+// Raises errUnknownFilter if any of the named values don't exist.
+func (s *memStore) filter(f entryFilter) (func(*d.Entry) bool, error) {
+  resolve := func(value string, lookup func(string) (string, error)) (string, error) {
+    if value == "" {
+      return "", nil
+    }
+    id, err := lookup(value)
+    if err == sql.ErrNoRows {
+      return "", errUnknownFilter
+    }
+    return id, err
+  }
+
+  hwLang, err := resolve(f.Headword_Language, s.LocaleID)
+  if err != nil {
+    return nil, err
+  }
+  defLang, err := resolve(f.Definition_Language, s.LocaleID)
+  if err != nil {
+    return nil, err
+  }
+  wordtype, err := resolve(f.Wordtype, s.WordtypeID)
+  if err != nil {
+    return nil, err
+  }
+  tag, err := resolve(f.Tag, s.TagID)
+  if err != nil {
+    return nil, err
+  }
+
+  return func(e *d.Entry) bool {
+    return (hwLang == "" || e.Headword_Language == hwLang) &&
+           (defLang == "" || e.Definition_Language == defLang) &&
+           (wordtype == "" || e.Wordtype == wordtype) &&
+           (tag == "" || s.entryTags[e.ID][tag])
+  }, nil
+}
+
+// wordSpans returns the byte offsets of each run of letters and digits in s.
+func wordSpans(s string) [][2]int {
+  var spans [][2]int
+  start := -1
+  for i, r := range s {
+    word := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+    if word && start < 0 {
+      start = i
+    } else if !word && start >= 0 {
+      spans = append(spans, [2]int{start, i})
+      start = -1
+    }
+  }
+  if start >= 0 {
+    spans = append(spans, [2]int{start, len(s)})
+  }
+  return spans
+}
+
+// output copies a stored entry for a caller, listing its audio clips and
+// relations.
+// The caller must hold the read lock.
+func (s *memStore) output(e *d.Entry) *d.Entry {
+  c := e.Copy()
+  for _, f := range s.sortedAudio(e.ID) {
+    c.Audio = append(c.Audio, f.info())
+  }
+  c.Relations = s.entryRelations(e.ID)
+  return c
+}
+
+// entryRelations lists the relations of an entry from its end.
+// The caller must hold the read lock.
+func (s *memStore) entryRelations(entryID string) []*d.Relation {
+  var relations []*d.Relation
+  for r := range s.relations {
+    kind, relatedID := r.Type, r.RelatedID
+    if r.RelatedID == entryID {
+      kind, relatedID = d.Inverse(r.Type), r.EntryID
+    } else if r.EntryID != entryID {
+      continue
+    }
+    related := s.entries[relatedID]
+    relations = append(relations, &d.Relation{
+      Type:     kind,
+      ID:       related.ID,
+      Headword: related.Headword,
+      Language: related.Headword_Language,
+    })
+  }
+  sortRelations(relations)
+  return relations
+}
+
+// sortedAudio returns the clips of an entry ordered by ID.
+// The caller must hold the read lock.
+func (s *memStore) sortedAudio(entryID string) []*audioFile {
+  var files []*audioFile
+  for _, f := range s.audio {
+    if f.EntryID == entryID {
+      c := *f
+      files = append(files, &c)
+    }
+  }
+  sort.Slice(files, func(i, j int) bool {
+    return compareIDs(files[i].ID, files[j].ID) < 0
+  })
+  return files
+}
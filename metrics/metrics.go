@@ -0,0 +1,88 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+/*
+  metrics collects measurements of the API for Prometheus: requests and their
+  latency, how many results searches find, how long password hashing takes
+  and the state of the database connection pool, along with the usual Go
+  runtime and process metrics. They are served by Handler in the Prometheus
+  text format.
+*/
+package metrics
+
+import (
+  "database/sql"
+  "net/http"
+  "time"
+
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/collectors"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes the names of the API's own metrics.
+const Namespace = "yugur"
+
+// Registry holds every metric served by Handler.
+var Registry = prometheus.NewRegistry()
+
+var (
+  // Requests counts requests served by endpoint, method and status.
+  Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Namespace: Namespace,
+    Name:      "http_requests_total",
+    Help:      "Requests served, by endpoint, method and status.",
+  }, []string{"endpoint", "method", "status"})
+
+  // RequestDuration is the time taken to serve requests.
+  RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: Namespace,
+    Name:      "http_request_duration_seconds",
+    Help:      "Time taken to serve requests, by endpoint, method and status.",
+    Buckets:   prometheus.DefBuckets,
+  }, []string{"endpoint", "method", "status"})
+
+  // SearchResults is the number of results found by the search, suggest
+  // and translate endpoints.
+  SearchResults = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: Namespace,
+    Name:      "search_results",
+    Help:      "Results found per query, by endpoint.",
+    Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+  }, []string{"endpoint"})
+
+  // Bcrypt is the time taken to hash and compare passwords.
+  Bcrypt = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Namespace: Namespace,
+    Name:      "bcrypt_duration_seconds",
+    Help:      "Time taken by bcrypt, by operation (hash or compare).",
+    Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+  }, []string{"operation"})
+)
+
+func init() {
+  Registry.MustRegister(
+    Requests,
+    RequestDuration,
+    SearchResults,
+    Bcrypt,
+    collectors.NewGoCollector(),
+    collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+  )
+}
+
+// RegisterDB adds the connection pool statistics of db, see sql.DBStats.
+func RegisterDB(db *sql.DB) error {
+  return Registry.Register(collectors.NewDBStatsCollector(db, Namespace))
+}
+
+// Since observes the seconds elapsed since start.
+func Since(o prometheus.Observer, start time.Time) {
+  o.Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+  return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,253 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// migrations provides versioned database schema migrations.
+//
+// Migrations are embedded SQL files named NNNN_name.up.sql and
+// NNNN_name.down.sql. Applied versions are tracked in the schema_migrations
+// table.
+package migrations
+
+import (
+  "database/sql"
+  "embed"
+  "errors"
+  "fmt"
+  "io/fs"
+  "path"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// Arbitrary key for the advisory lock held while migrating, so that two
+// instances starting at the same time don't race each other.
+const lockID = 7190417
+
+// ErrSchemaTooNew is raised when the database has been migrated by a newer
+// version of the API than this one.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary supports")
+
+type Migration struct {
+  Version int
+  Name    string
+  Up      string
+  Down    string
+}
+
+// All returns every embedded migration in version order.
+func All() ([]Migration, error) {
+  return parse(files, "sql")
+}
+
+// Latest returns the newest schema version known to this binary.
+func Latest() int {
+  migrations, err := All()
+  if err != nil || len(migrations) == 0 {
+    return 0
+  }
+  return migrations[len(migrations)-1].Version
+}
+
+// Version returns the current schema version of the database, creating the
+// tracking table if required. A fresh database is at version 0.
+func Version(db *sql.DB) (int, error) {
+  if err := prepare(db); err != nil {
+    return 0, err
+  }
+  return current(db)
+}
+
+// Check returns ErrSchemaTooNew if the database is ahead of this binary.
+func Check(db *sql.DB) error {
+  version, err := Version(db)
+  if err != nil {
+    return err
+  }
+  if version > Latest() {
+    return ErrSchemaTooNew
+  }
+  return nil
+}
+
+// Up applies all pending migrations and returns the number applied.
+func Up(db *sql.DB) (int, error) {
+  migrations, err := All()
+  if err != nil {
+    return 0, err
+  }
+  if err := Check(db); err != nil {
+    return 0, err
+  }
+
+  applied := 0
+  for _, m := range migrations {
+    ok, err := apply(db, m, true)
+    if err != nil {
+      return applied, fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+    }
+    if ok {
+      applied++
+    }
+  }
+  return applied, nil
+}
+
+// Down reverts the newest n applied migrations and returns the number reverted.
+func Down(db *sql.DB, n int) (int, error) {
+  migrations, err := All()
+  if err != nil {
+    return 0, err
+  }
+  if err := Check(db); err != nil {
+    return 0, err
+  }
+
+  reverted := 0
+  for i := len(migrations) - 1; i >= 0 && reverted < n; i-- {
+    m := migrations[i]
+    ok, err := apply(db, m, false)
+    if err != nil {
+      return reverted, fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+    }
+    if ok {
+      reverted++
+    }
+  }
+  return reverted, nil
+}
+
+//---------------------------------------------------------
+//---- Helper Functions
+//---------------------------------------------------------
+
+func prepare(db *sql.DB) error {
+  _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+                       version    int       PRIMARY KEY,
+                       name       text      NOT NULL,
+                       applied_at timestamp NOT NULL DEFAULT now()
+                     )`)
+  return err
+}
+
+type queryer interface {
+  QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func current(q queryer) (int, error) {
+  var version int
+  err := q.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+  return version, err
+}
+
+// apply runs a single migration in its own transaction. It reports false if
+// the migration was skipped because the database is already past it (or, when
+// reverting, hasn't reached it yet).
+func apply(db *sql.DB, m Migration, up bool) (bool, error) {
+  tx, err := db.Begin()
+  if err != nil {
+    return false, err
+  }
+  defer tx.Rollback()
+
+  if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", lockID); err != nil {
+    return false, err
+  }
+
+  version, err := current(tx)
+  if err != nil {
+    return false, err
+  }
+
+  if up {
+    if version >= m.Version {
+      return false, nil
+    }
+    if _, err := tx.Exec(m.Up); err != nil {
+      return false, err
+    }
+    _, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+  } else {
+    if version != m.Version {
+      return false, nil
+    }
+    if _, err := tx.Exec(m.Down); err != nil {
+      return false, err
+    }
+    _, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version)
+  }
+  if err != nil {
+    return false, err
+  }
+
+  return true, tx.Commit()
+}
+
+// parse reads the migrations in dir. Every version must have both an up and a
+// down file and versions must be unique.
+func parse(fsys fs.FS, dir string) ([]Migration, error) {
+  names, err := fs.Glob(fsys, path.Join(dir, "*.sql"))
+  if err != nil {
+    return nil, err
+  }
+
+  byVersion := make(map[int]*Migration)
+  for _, name := range names {
+    base := path.Base(name)
+
+    var up bool
+    switch {
+    case strings.HasSuffix(base, ".up.sql"):
+      up = true
+      base = strings.TrimSuffix(base, ".up.sql")
+    case strings.HasSuffix(base, ".down.sql"):
+      base = strings.TrimSuffix(base, ".down.sql")
+    default:
+      return nil, fmt.Errorf("migration %s: expected .up.sql or .down.sql", name)
+    }
+
+    parts := strings.SplitN(base, "_", 2)
+    if len(parts) != 2 || parts[1] == "" {
+      return nil, fmt.Errorf("migration %s: expected NNNN_name", name)
+    }
+    version, err := strconv.Atoi(parts[0])
+    if err != nil || version < 1 {
+      return nil, fmt.Errorf("migration %s: invalid version", name)
+    }
+
+    body, err := fs.ReadFile(fsys, name)
+    if err != nil {
+      return nil, err
+    }
+
+    m, ok := byVersion[version]
+    if !ok {
+      m = &Migration{Version: version, Name: parts[1]}
+      byVersion[version] = m
+    } else if m.Name != parts[1] {
+      return nil, fmt.Errorf("migration %s: version %d is already used by %s", name, version, m.Name)
+    }
+
+    if up {
+      m.Up = string(body)
+    } else {
+      m.Down = string(body)
+    }
+  }
+
+  migrations := make([]Migration, 0, len(byVersion))
+  for _, m := range byVersion {
+    if m.Up == "" || m.Down == "" {
+      return nil, fmt.Errorf("migration %04d_%s: missing up or down file", m.Version, m.Name)
+    }
+    migrations = append(migrations, *m)
+  }
+  sort.Slice(migrations, func(i, j int) bool {
+    return migrations[i].Version < migrations[j].Version
+  })
+  return migrations, nil
+}
@@ -0,0 +1,77 @@
+package migrations
+
+import (
+  "testing"
+  "testing/fstest"
+)
+
+func TestParse(t *testing.T) {
+  fsys := fstest.MapFS{
+    "sql/0002_second.up.sql":   {Data: []byte("up 2")},
+    "sql/0002_second.down.sql": {Data: []byte("down 2")},
+    "sql/0001_first.up.sql":    {Data: []byte("up 1")},
+    "sql/0001_first.down.sql":  {Data: []byte("down 1")},
+  }
+
+  migrations, err := parse(fsys, "sql")
+  if err != nil {
+    t.Fatalf("Unexpected error: %v", err)
+  }
+  if len(migrations) != 2 {
+    t.Fatalf("Expected: %d migrations, got: %d.", 2, len(migrations))
+  }
+  for i, m := range migrations {
+    if m.Version != i+1 {
+      t.Errorf("Migrations out of order. Expected: version %d, got: %d.", i+1, m.Version)
+    }
+  }
+  if migrations[1].Name != "second" || migrations[1].Up != "up 2" || migrations[1].Down != "down 2" {
+    t.Errorf("Wrong contents for migration 2, got: %+v", migrations[1])
+  }
+}
+
+func TestParseInvalid(t *testing.T) {
+  tables := []struct {
+    name string
+    fsys fstest.MapFS
+  }{
+    {
+      "missing down",
+      fstest.MapFS{"sql/0001_first.up.sql": {}},
+    },
+    {
+      "bad suffix",
+      fstest.MapFS{"sql/0001_first.sql": {}},
+    },
+    {
+      "bad version",
+      fstest.MapFS{"sql/one_first.up.sql": {}, "sql/one_first.down.sql": {}},
+    },
+    {
+      "duplicate version",
+      fstest.MapFS{
+        "sql/0001_first.up.sql":    {Data: []byte("up")},
+        "sql/0001_first.down.sql":  {Data: []byte("down")},
+        "sql/0001_other.up.sql":    {Data: []byte("up")},
+        "sql/0001_other.down.sql":  {Data: []byte("down")},
+      },
+    },
+  }
+
+  for _, table := range tables {
+    _, err := parse(table.fsys, "sql")
+    if err == nil {
+      t.Errorf("Expected an error for table %q, got none.", table.name)
+    }
+  }
+}
+
+func TestEmbedded(t *testing.T) {
+  migrations, err := All()
+  if err != nil {
+    t.Fatalf("Embedded migrations failed to parse: %v", err)
+  }
+  if Latest() != migrations[len(migrations)-1].Version {
+    t.Errorf("Expected: latest version %d, got: %d.", migrations[len(migrations)-1].Version, Latest())
+  }
+}
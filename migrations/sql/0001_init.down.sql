@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS entry_tags CASCADE;
+DROP TABLE IF EXISTS users CASCADE;
+DROP TABLE IF EXISTS entries CASCADE;
+DROP TABLE IF EXISTS tags CASCADE;
+DROP TABLE IF EXISTS wordtypes CASCADE;
+DROP TABLE IF EXISTS languages CASCADE;
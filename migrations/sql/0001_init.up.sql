@@ -0,0 +1,65 @@
+-- Initial schema. Tables are created only if missing so that databases set up
+-- by hand from the old scripts/demo.sql can be adopted without changes.
+
+CREATE TABLE IF NOT EXISTS languages (
+	lang_id		bigserial	PRIMARY KEY,
+	name		text		NOT NULL,
+	code		text		NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS wordtypes (
+	wordtype_id	bigserial	PRIMARY KEY,
+	name		text		NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS tags (
+	tag_id		bigserial	PRIMARY KEY,
+	name		text		NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS entries (
+	entry_id	bigserial 	PRIMARY KEY,
+	headword	text 		NOT NULL,
+	wordtype	bigint		REFERENCES wordtypes (wordtype_id),
+	definition	text		,
+	hw_lang		bigint		REFERENCES languages (lang_id) ON DELETE CASCADE,
+	def_lang	bigint		REFERENCES languages (lang_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS entry_tags (
+	tag_id		bigint,
+	entry_id	bigint,
+	CONSTRAINT PK_entry_tags PRIMARY KEY
+    (
+        tag_id,
+        entry_id
+    ),
+    FOREIGN KEY (tag_id) REFERENCES tags (tag_id) ON DELETE CASCADE,
+    FOREIGN KEY (entry_id) REFERENCES entries (entry_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS users (
+	uid			bigserial	PRIMARY KEY,
+	username	text		NOT NULL UNIQUE,
+	hash		text		NOT NULL,
+	email		text		NOT NULL UNIQUE,
+	dob			date		,
+	gender		text		,
+	joindate	timestamp	NOT NULL,
+	language	bigint		REFERENCES languages (lang_id),
+	fluency		int[]		
+);
+
+INSERT INTO languages (name, code) VALUES
+	('English (AU)', 'en-AU'),
+	('Western Yugur', 'yge'),
+	('Eastern Yugur', 'yuy'),
+	('Chinese', 'zh'),
+	('한국어', 'ko-KR')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO wordtypes (name) VALUES
+	('noun'),
+	('verb'),
+	('adjective')
+ON CONFLICT (name) DO NOTHING;
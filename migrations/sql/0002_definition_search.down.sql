@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS entries_definition_tsv_idx;
+ALTER TABLE entries DROP COLUMN IF EXISTS definition_tsv;
+DROP TRIGGER IF EXISTS languages_ts_config ON languages;
+DROP FUNCTION IF EXISTS languages_ts_config();
+DROP TRIGGER IF EXISTS entries_ts_config ON entries;
+DROP FUNCTION IF EXISTS entries_ts_config();
+ALTER TABLE entries DROP COLUMN IF EXISTS ts_config;
+ALTER TABLE languages DROP COLUMN IF EXISTS ts_config;
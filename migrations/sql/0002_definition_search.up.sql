@@ -0,0 +1,40 @@
+-- Ranked full-text search over definitions. Each language names the text
+-- search configuration used for definitions written in it, which is copied to
+-- the entry so that the tsvector can be a generated column.
+
+ALTER TABLE languages ADD COLUMN ts_config regconfig NOT NULL DEFAULT 'simple';
+
+UPDATE languages SET ts_config = 'english' WHERE code LIKE 'en%';
+
+ALTER TABLE entries ADD COLUMN ts_config regconfig NOT NULL DEFAULT 'simple';
+
+UPDATE entries SET ts_config = languages.ts_config
+FROM languages
+WHERE entries.def_lang = languages.lang_id;
+
+CREATE FUNCTION entries_ts_config() RETURNS trigger AS $$
+BEGIN
+	NEW.ts_config := COALESCE((SELECT ts_config FROM languages WHERE lang_id = NEW.def_lang), 'simple');
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER entries_ts_config
+	BEFORE INSERT OR UPDATE OF def_lang ON entries
+	FOR EACH ROW EXECUTE FUNCTION entries_ts_config();
+
+CREATE FUNCTION languages_ts_config() RETURNS trigger AS $$
+BEGIN
+	UPDATE entries SET ts_config = NEW.ts_config WHERE def_lang = NEW.lang_id;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER languages_ts_config
+	AFTER UPDATE OF ts_config ON languages
+	FOR EACH ROW EXECUTE FUNCTION languages_ts_config();
+
+ALTER TABLE entries ADD COLUMN definition_tsv tsvector
+	GENERATED ALWAYS AS (to_tsvector(ts_config, COALESCE(definition, ''))) STORED;
+
+CREATE INDEX entries_definition_tsv_idx ON entries USING GIN (definition_tsv);
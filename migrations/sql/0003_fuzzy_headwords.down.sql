@@ -0,0 +1,2 @@
+-- The extension is left in place as other databases objects may rely on it.
+DROP INDEX IF EXISTS entries_headword_trgm_idx;
@@ -0,0 +1,5 @@
+-- Trigram index for typo-tolerant headword matching.
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX entries_headword_trgm_idx ON entries USING GIN (headword gin_trgm_ops);
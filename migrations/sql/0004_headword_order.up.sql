@@ -0,0 +1,3 @@
+-- Supports keyset pagination of entries ordered by headword.
+
+CREATE INDEX entries_headword_idx ON entries (headword, entry_id);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS examples CASCADE;
+DROP TABLE IF EXISTS senses CASCADE;
+ALTER TABLE entries DROP COLUMN IF EXISTS etymology;
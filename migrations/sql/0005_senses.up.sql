@@ -0,0 +1,29 @@
+-- Entries own an ordered list of senses, each with its own usage examples.
+-- entries.wordtype and entries.definition are kept as a flattened copy of the
+-- senses for searching and for clients that predate them.
+
+ALTER TABLE entries ADD COLUMN etymology text;
+
+CREATE TABLE senses (
+	sense_id	bigserial	PRIMARY KEY,
+	entry_id	bigint		NOT NULL REFERENCES entries (entry_id) ON DELETE CASCADE,
+	position	int			NOT NULL,
+	wordtype	bigint		REFERENCES wordtypes (wordtype_id),
+	definition	text		NOT NULL,
+	labels		text[]		NOT NULL DEFAULT '{}',
+	UNIQUE (entry_id, position)
+);
+
+CREATE TABLE examples (
+	example_id	bigserial	PRIMARY KEY,
+	sense_id	bigint		NOT NULL REFERENCES senses (sense_id) ON DELETE CASCADE,
+	position	int			NOT NULL,
+	text		text		NOT NULL,
+	translation	text		,
+	UNIQUE (sense_id, position)
+);
+
+-- Every existing entry becomes a single sense
+INSERT INTO senses (entry_id, position, wordtype, definition)
+SELECT entry_id, 1, wordtype, COALESCE(definition, '')
+FROM entries;
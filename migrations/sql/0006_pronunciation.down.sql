@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS audio CASCADE;
+ALTER TABLE entries DROP COLUMN IF EXISTS phonetic;
+ALTER TABLE entries DROP COLUMN IF EXISTS ipa;
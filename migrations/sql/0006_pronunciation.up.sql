@@ -0,0 +1,17 @@
+-- Pronunciation transcriptions and audio recordings of headwords. The audio
+-- itself lives in the blob store under blob_key.
+
+ALTER TABLE entries ADD COLUMN ipa text;
+ALTER TABLE entries ADD COLUMN phonetic text;
+
+CREATE TABLE audio (
+	audio_id		bigserial	PRIMARY KEY,
+	entry_id		bigint		NOT NULL REFERENCES entries (entry_id) ON DELETE CASCADE,
+	blob_key		text		NOT NULL UNIQUE,
+	content_type	text		NOT NULL,
+	speaker			text		,
+	size			bigint		NOT NULL,
+	uploaded		timestamp	NOT NULL DEFAULT now()
+);
+
+CREATE INDEX audio_entry_id_idx ON audio (entry_id);
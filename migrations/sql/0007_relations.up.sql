@@ -0,0 +1,13 @@
+-- Typed links between entries. Symmetric relations are stored once, from the
+-- entry with the lower ID; derived_from points from the derived word to its
+-- origin.
+
+CREATE TABLE relations (
+	entry_id	bigint	NOT NULL REFERENCES entries (entry_id) ON DELETE CASCADE,
+	related_id	bigint	NOT NULL REFERENCES entries (entry_id) ON DELETE CASCADE,
+	relation	text	NOT NULL CHECK (relation IN ('synonym', 'antonym', 'see_also', 'translation', 'derived_from')),
+	PRIMARY KEY (entry_id, related_id, relation),
+	CHECK (entry_id <> related_id)
+);
+
+CREATE INDEX relations_related_id_idx ON relations (related_id);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS entries_lang_pair_idx;
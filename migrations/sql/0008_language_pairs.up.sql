@@ -0,0 +1,4 @@
+-- Translation lookups select entries by their pair of headword and definition
+-- languages, in both directions.
+
+CREATE INDEX entries_lang_pair_idx ON entries (hw_lang, def_lang);
@@ -0,0 +1,22 @@
+-- Refresh tokens and API keys for token authentication. Only a SHA-256 hash
+-- of each token is kept.
+
+CREATE TABLE refresh_tokens (
+	token_hash	text		PRIMARY KEY,
+	uid			bigint		NOT NULL REFERENCES users (uid) ON DELETE CASCADE,
+	expires		timestamp	NOT NULL,
+	created		timestamp	NOT NULL DEFAULT now()
+);
+
+CREATE INDEX refresh_tokens_uid_idx ON refresh_tokens (uid);
+
+CREATE TABLE api_keys (
+	key_id		bigserial	PRIMARY KEY,
+	uid			bigint		NOT NULL REFERENCES users (uid) ON DELETE CASCADE,
+	name		text		NOT NULL,
+	key_hash	text		NOT NULL UNIQUE,
+	created		timestamp	NOT NULL DEFAULT now(),
+	last_used	timestamp
+);
+
+CREATE INDEX api_keys_uid_idx ON api_keys (uid);
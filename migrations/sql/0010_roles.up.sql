@@ -0,0 +1,5 @@
+-- Every user has a role which decides what they may change. In increasing
+-- order of privilege: viewer, contributor, editor, admin.
+
+ALTER TABLE users ADD COLUMN role text NOT NULL DEFAULT 'viewer'
+	CHECK (role IN ('viewer', 'contributor', 'editor', 'admin'));
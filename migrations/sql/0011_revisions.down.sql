@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS revisions CASCADE;
+DROP FUNCTION IF EXISTS revisions_immutable();
@@ -0,0 +1,24 @@
+-- Every change to an entry is recorded as an immutable revision holding a
+-- full snapshot of the entry as JSON. Revisions outlive the entries and users
+-- they refer to, so neither is a foreign key.
+
+CREATE TABLE revisions (
+	revision_id	bigserial	PRIMARY KEY,
+	entry_id	bigint		NOT NULL,
+	action		text		NOT NULL CHECK (action IN ('create', 'update', 'delete', 'restore')),
+	uid			bigint		,
+	created		timestamp	NOT NULL DEFAULT now(),
+	snapshot	jsonb		NOT NULL
+);
+
+CREATE INDEX revisions_entry_id_idx ON revisions (entry_id, revision_id);
+
+CREATE FUNCTION revisions_immutable() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'revisions cannot be changed';
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER revisions_immutable
+	BEFORE UPDATE OR DELETE ON revisions
+	FOR EACH ROW EXECUTE FUNCTION revisions_immutable();
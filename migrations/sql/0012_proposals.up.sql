@@ -0,0 +1,20 @@
+-- Changes to entries proposed by contributors, waiting for an editor to
+-- review them. entry holds the proposed entry as JSON; entry_id is the entry
+-- being edited, or NULL for a new entry.
+
+CREATE TABLE proposals (
+	proposal_id	bigserial	PRIMARY KEY,
+	entry_id	bigint		,
+	uid			bigint		NOT NULL REFERENCES users (uid) ON DELETE CASCADE,
+	entry		jsonb		NOT NULL,
+	status		text		NOT NULL DEFAULT 'pending'
+				CHECK (status IN ('pending', 'approved', 'rejected', 'changes_requested')),
+	comment		text		,
+	reviewer	bigint		REFERENCES users (uid) ON DELETE SET NULL,
+	created		timestamp	NOT NULL DEFAULT now(),
+	updated		timestamp	NOT NULL DEFAULT now(),
+	reviewed	timestamp
+);
+
+CREATE INDEX proposals_status_idx ON proposals (status, proposal_id);
+CREATE INDEX proposals_uid_idx ON proposals (uid, proposal_id);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS entries_headword_prefix_idx;
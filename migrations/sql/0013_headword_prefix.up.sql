@@ -0,0 +1,5 @@
+-- Supports prefix matching of headwords, ignoring case, for suggestions as
+-- the user types. text_pattern_ops lets LIKE 'prefix%' use the index
+-- whatever the database's collation.
+
+CREATE INDEX entries_headword_prefix_idx ON entries (LOWER(headword) text_pattern_ops, hw_lang);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS entries_headword_key_idx;
+ALTER TABLE entries DROP COLUMN IF EXISTS headword_key;
+
+CREATE INDEX entries_headword_prefix_idx ON entries (LOWER(headword) text_pattern_ops, hw_lang);
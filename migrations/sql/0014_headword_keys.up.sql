@@ -0,0 +1,9 @@
+-- headword_key is the headword as matched by headword search and
+-- suggestions, ignoring case, diacritics, Unicode normalization form and
+-- script. Keys are made by the API (see the normalize package), which fills
+-- in any that are NULL when it starts.
+
+ALTER TABLE entries ADD COLUMN headword_key text;
+
+DROP INDEX IF EXISTS entries_headword_prefix_idx;
+CREATE INDEX entries_headword_key_idx ON entries (headword_key text_pattern_ops, hw_lang);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS entries_headword_key_trgm_idx;
+CREATE INDEX entries_headword_trgm_idx ON entries USING GIN (headword gin_trgm_ops);
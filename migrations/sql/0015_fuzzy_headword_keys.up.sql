@@ -0,0 +1,6 @@
+-- Typo-tolerant headword matching compares headword keys, like headword
+-- search and suggestions, so that spellings differing only in case,
+-- diacritics, normalization form or script still count as similar.
+
+DROP INDEX IF EXISTS entries_headword_trgm_idx;
+CREATE INDEX entries_headword_key_trgm_idx ON entries USING GIN (headword_key gin_trgm_ops);
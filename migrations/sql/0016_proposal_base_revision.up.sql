@@ -0,0 +1,9 @@
+-- The latest revision of the entry a proposal edits when it was made or last
+-- revised. Approving it once the entry has moved on would undo later changes.
+-- Like revisions, it isn't a foreign key.
+
+ALTER TABLE proposals ADD COLUMN base_revision bigint;
+
+UPDATE proposals AS p
+SET base_revision = (SELECT max(revision_id) FROM revisions AS r WHERE r.entry_id = p.entry_id)
+WHERE p.entry_id IS NOT NULL AND p.status IN ('pending', 'changes_requested');
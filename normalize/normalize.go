@@ -0,0 +1,107 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// normalize prepares text for storage and matching. Text is stored in NFC
+// and matched by keys which ignore the differences people don't expect to
+// matter when they search: Unicode normalization form, full-width and other
+// compatibility characters, case, diacritics and Cyrillic or Latin spelling.
+package normalize
+
+import (
+  "strings"
+  "unicode"
+
+  "github.com/yugur/api/translit"
+  "golang.org/x/text/cases"
+  "golang.org/x/text/unicode/norm"
+)
+
+// Text returns s in Unicode normalization form C, in which text is stored.
+func Text(s string) string {
+  return norm.NFC.String(s)
+}
+
+/*
+  Key returns the form of s used to match it regardless of spelling. Two
+  strings match if their keys are equal. Keys are made by:
+    - mapping compatibility characters such as full-width letters and Hangul
+      compatibility jamo to their usual forms (NFKD), so that jamo typed
+      separately match the syllables they make up;
+    - folding case;
+    - removing diacritics, so that "ö" matches "o";
+    - spelling Cyrillic letters as in the Latin orthography of Yugur;
+    - collapsing runs of white space into a single space.
+  Keys are only for comparison and shouldn't be shown to users.
+*/
+func Key(s string) string {
+  s = norm.NFC.String(folder.String(finalJamo(norm.NFKD.String(s))))
+
+  // The Cyrillic scheme is always defined
+  latin, _ := translit.Convert(s, "cyrillic", translit.Canonical)
+
+  var b strings.Builder
+  space := false
+  for _, r := range norm.NFD.String(latin) {
+    switch {
+    case unicode.Is(unicode.Mn, r):
+      continue
+    case unicode.IsSpace(r):
+      space = b.Len() > 0
+      continue
+    case r == 'ı':
+      // Dotless i has no decomposition to remove its "diacritic" from
+      r = 'i'
+    }
+    if space {
+      b.WriteByte(' ')
+      space = false
+    }
+    b.WriteRune(r)
+  }
+  // Recompose Hangul syllables, which NFD split into jamo
+  return norm.NFC.String(b.String())
+}
+
+var folder = cases.Fold()
+
+// Ranges of conjoining Hangul jamo: leading consonants, vowels and trailing
+// consonants
+const (
+  jamoL, jamoLLast = 0x1100, 0x1112
+  jamoV, jamoVLast = 0x1161, 0x1175
+)
+
+// trailingJamo gives the trailing form of each leading consonant, 0 for
+// those which can't end a syllable.
+var trailingJamo = [...]rune{
+  0x11A8, 0x11A9, 0x11AB, 0x11AE, 0, 0x11AF, 0x11B7, 0x11B8, 0, 0x11BA,
+  0x11BB, 0x11BC, 0x11BD, 0, 0x11BE, 0x11BF, 0x11C0, 0x11C1, 0x11C2,
+}
+
+/*
+  finalJamo turns leading consonants that end a syllable into trailing
+  consonants, so that jamo typed one at a time compose into syllables. NFKD
+  maps compatibility jamo, which don't say where in a syllable they belong,
+  to leading consonants; a consonant following a vowel and not followed by
+  one must end the syllable instead. s must be decomposed.
+*/
+func finalJamo(s string) string {
+  runes := []rune(s)
+  for i, r := range runes {
+    if r < jamoL || r > jamoLLast || i == 0 || !isVowelJamo(runes[i-1]) {
+      continue
+    }
+    if i+1 < len(runes) && isVowelJamo(runes[i+1]) {
+      continue
+    }
+    if t := trailingJamo[r-jamoL]; t != 0 {
+      runes[i] = t
+    }
+  }
+  return string(runes)
+}
+
+func isVowelJamo(r rune) bool {
+  return r >= jamoV && r <= jamoVLast
+}
@@ -0,0 +1,47 @@
+package normalize
+
+import (
+  "testing"
+)
+
+func TestText(t *testing.T) {
+  // "ö" as "o" and a combining diaeresis
+  if s := Text("öt"); s != "öt" {
+    t.Errorf("Text was incorrect. Expected: %q, got: %q.", "öt", s)
+  }
+}
+
+func TestKey(t *testing.T) {
+  tables := []struct {
+    a string
+    b string
+  }{
+    // NFC and NFD
+    {"öt", "öt"},
+    // Case and diacritics
+    {"Öt", "ot"},
+    {"JANDÏ", "jandi"},
+    {"qızıl", "qizil"},
+    // Full-width letters
+    {"ｆｉｒｅ", "fire"},
+    // White space
+    {"  fire \t engine ", "fire engine"},
+    // Cyrillic and Latin spellings
+    {"От", "öt"},
+    {"шар", "şar"},
+    {"Йол", "yol"},
+    // Hangul compatibility jamo, conjoining jamo and syllables
+    {"ㅅㅔㅅㅏㅇ", "세상"},
+    {"세상", "세상"},
+  }
+
+  for _, table := range tables {
+    if a, b := Key(table.a), Key(table.b); a != b {
+      t.Errorf("Keys of %q and %q differ: %q and %q.", table.a, table.b, a, b)
+    }
+  }
+
+  if a, b := Key("fire"), Key("fir"); a == b {
+    t.Errorf("Keys of %q and %q match: %q.", "fire", "fir", a)
+  }
+}
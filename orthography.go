@@ -0,0 +1,108 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "net/http"
+  "strconv"
+
+  d "github.com/yugur/api/entry"
+  "github.com/yugur/api/translit"
+  "github.com/yugur/api/util"
+)
+
+/*
+  Text in the languages configured in conf.Orthography is stored in the
+  canonical orthography. Clients may write it in any transliteration scheme
+  and read it back in the scheme they prefer by passing 'scheme'; what they
+  send is converted to the canonical orthography on the way in and entries
+  are rendered in their scheme on the way out.
+*/
+
+// schemeParam returns the transliteration scheme asked for with 'scheme',
+// or the canonical orthography if none was.
+func schemeParam(r *http.Request) (string, error) {
+  scheme := r.URL.Query().Get("scheme")
+  if scheme == "" {
+    return translit.Canonical, nil
+  }
+  if !translit.Valid(scheme) {
+    return "", util.InvalidParameter("scheme", util.FieldUnknown, "unknown orthography "+strconv.Quote(scheme))
+  }
+  return scheme, nil
+}
+
+// orthographic reports whether text in a language, given by its code, is
+// stored in the canonical orthography.
+func orthographic(language string) bool {
+  for _, code := range conf.Orthography.Languages {
+    if code == language {
+      return true
+    }
+  }
+  return false
+}
+
+// transliterate converts text between schemes which are known to exist.
+func transliterate(text, from, to string) string {
+  if from == to || text == "" {
+    return text
+  }
+  converted, err := translit.Convert(text, from, to)
+  if err != nil {
+    return text
+  }
+  return converted
+}
+
+// inScheme renders text in a language in scheme, if the language is written
+// in the canonical orthography.
+func inScheme(scheme, language, text string) string {
+  if !orthographic(language) {
+    return text
+  }
+  return transliterate(text, translit.Canonical, scheme)
+}
+
+// fromScheme converts the headwords and examples of incoming entries, with
+// language codes, from scheme to the canonical orthography.
+func fromScheme(scheme string, entries ...*d.Entry) {
+  if scheme == translit.Canonical {
+    return
+  }
+  for _, e := range entries {
+    if !orthographic(e.Headword_Language) {
+      continue
+    }
+    e.Headword = transliterate(e.Headword, scheme, translit.Canonical)
+    for _, sense := range e.Senses {
+      for _, example := range sense.Examples {
+        example.Text = transliterate(example.Text, scheme, translit.Canonical)
+      }
+    }
+  }
+}
+
+// toScheme renders the headwords, related headwords and examples of outgoing
+// entries, with language codes, in scheme.
+func toScheme(scheme string, entries ...*d.Entry) {
+  if scheme == translit.Canonical {
+    return
+  }
+  for _, e := range entries {
+    for _, relation := range e.Relations {
+      relation.Headword = inScheme(scheme, relation.Language, relation.Headword)
+    }
+    if !orthographic(e.Headword_Language) {
+      continue
+    }
+    e.Headword = transliterate(e.Headword, translit.Canonical, scheme)
+    for _, sense := range e.Senses {
+      for _, example := range sense.Examples {
+        example.Text = transliterate(example.Text, translit.Canonical, scheme)
+      }
+    }
+  }
+}
@@ -0,0 +1,188 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+
+  d "github.com/yugur/api/entry"
+  "github.com/yugur/api/util"
+)
+
+// Sort orders accepted by paginated endpoints. Prefixing an order with "-"
+// reverses it, e.g. "-headword". Relevance is only meaningful for search.
+const (
+  sortID        = "id"
+  sortHeadword  = "headword"
+  sortRelevance = "relevance"
+)
+
+// pageRequest describes which page of results a client wants.
+// Pages are keyset based: the cursor holds the last entry of the previous page
+// so that results aren't skipped or repeated when entries are added.
+type pageRequest struct {
+  Limit      int
+  Sort       string
+  Descending bool
+  After      *pageCursor
+  // Skip counting every match, for callers that don't need the total
+  NoTotal    bool
+}
+
+// pageCursor is the position of the last entry of a page.
+type pageCursor struct {
+  Sort     string `json:"s"`
+  ID       string `json:"i"`
+  Headword string `json:"h,omitempty"`
+}
+
+// pageResponse is the envelope for paginated results.
+type pageResponse struct {
+  Results    interface{} `json:"results"`
+  NextCursor string      `json:"next_cursor,omitempty"`
+  Total      int         `json:"total"`
+}
+
+// parsePage reads 'limit', 'cursor' and 'sort' from a request. fallback is the
+// sort order used if none is given. Limits are capped at the configured maximum.
+func parsePage(r *http.Request, fallback string, allowed ...string) (pageRequest, error) {
+  p := pageRequest{Limit: conf.Pagination.DefaultLimit, Sort: fallback}
+
+  if limit := r.FormValue("limit"); limit != "" {
+    n, err := strconv.Atoi(limit)
+    if err != nil || n < 1 {
+      return p, util.InvalidParameter("limit", util.FieldInvalid, "limit must be a positive integer")
+    }
+    p.Limit = n
+  }
+  if p.Limit > conf.Pagination.MaxLimit {
+    p.Limit = conf.Pagination.MaxLimit
+  }
+
+  if order := r.FormValue("sort"); order != "" {
+    p.Descending = strings.HasPrefix(order, "-")
+    p.Sort = strings.TrimPrefix(order, "-")
+  }
+  valid := false
+  for _, order := range allowed {
+    valid = valid || p.Sort == order
+  }
+  if !valid {
+    return p, util.InvalidParameter("sort", util.FieldInvalid, "cannot sort by "+strconv.Quote(p.Sort))
+  }
+
+  if cursor := r.FormValue("cursor"); cursor != "" {
+    c, err := decodeCursor(cursor)
+    if err != nil || c.Sort != p.sortKey() {
+      return p, util.InvalidParameter("cursor", util.FieldInvalid, "the cursor is invalid or from a different sort order")
+    }
+    p.After = c
+  }
+  return p, nil
+}
+
+// sortKey is the sort order including direction, as stored in cursors.
+func (p pageRequest) sortKey() string {
+  if p.Descending {
+    return "-" + p.Sort
+  }
+  return p.Sort
+}
+
+// cursor returns the cursor pointing after e.
+func (p pageRequest) cursor(e *d.Entry) string {
+  c := pageCursor{Sort: p.sortKey(), ID: e.ID}
+  if p.Sort == sortHeadword {
+    c.Headword = e.Headword
+  }
+  b, _ := json.Marshal(c)
+  return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reads a cursor made by pageRequest.cursor. As the store
+// compares its ID with entry IDs, it must be numeric.
+func decodeCursor(s string) (*pageCursor, error) {
+  b, err := base64.RawURLEncoding.DecodeString(s)
+  if err != nil {
+    return nil, err
+  }
+  c := new(pageCursor)
+  if err := json.Unmarshal(b, c); err != nil {
+    return nil, err
+  }
+  if _, err := strconv.ParseInt(c.ID, 10, 64); err != nil {
+    return nil, err
+  }
+  return c, nil
+}
+
+// less orders entries by the page's sort order, ties broken by ID.
+func (p pageRequest) less(a, b *d.Entry) bool {
+  if p.Descending {
+    a, b = b, a
+  }
+  if p.Sort == sortHeadword && a.Headword != b.Headword {
+    return a.Headword < b.Headword
+  }
+  return compareIDs(a.ID, b.ID) < 0
+}
+
+// compareIDs compares numeric entry IDs numerically, as Postgres does.
+func compareIDs(a, b string) int {
+  x, errX := strconv.ParseInt(a, 10, 64)
+  y, errY := strconv.ParseInt(b, 10, 64)
+  if errX != nil || errY != nil {
+    return strings.Compare(a, b)
+  }
+  switch {
+  case x < y:
+    return -1
+  case x > y:
+    return 1
+  }
+  return 0
+}
+
+// paginate slices a complete set of matches into the requested page.
+// Matches are sorted first unless the page is ordered by relevance, in which
+// case the given order is kept and the cursor marks a position within it.
+func paginate(matches []*d.Match, p pageRequest) ([]*d.Match, string) {
+  start := 0
+  if p.Sort == sortRelevance {
+    if p.After != nil {
+      // If the cursor's entry has gone there's no telling where the previous
+      // page ended, so end here rather than repeat results.
+      start = len(matches)
+      for i, m := range matches {
+        if m.ID == p.After.ID {
+          start = i + 1
+          break
+        }
+      }
+    }
+  } else {
+    sort.SliceStable(matches, func(i, j int) bool {
+      return p.less(matches[i].Entry, matches[j].Entry)
+    })
+    if p.After != nil {
+      after := &d.Entry{ID: p.After.ID, Headword: p.After.Headword}
+      start = sort.Search(len(matches), func(i int) bool {
+        return p.less(after, matches[i].Entry)
+      })
+    }
+  }
+
+  matches = matches[start:]
+  if len(matches) <= p.Limit {
+    return matches, ""
+  }
+  matches = matches[:p.Limit]
+  return matches, p.cursor(matches[len(matches)-1].Entry)
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+
+  d "github.com/yugur/api/entry"
+  "github.com/yugur/api/util"
+)
+
+/*
+  asProblem reports an error raised while handling a request as a problem.
+  Problems with the request itself, such as invalid parameters and unknown
+  names in entries, are reported with the fields they concern; anything else
+  is reported as an internal error, logging the cause.
+*/
+func asProblem(err error) *util.Problem {
+  switch e := err.(type) {
+  case *util.Problem:
+    return e
+  case *unknownNameError:
+    return util.BadRequest(util.CodeValidationFailed, e.Error(), util.Field{Name: e.field, Code: util.FieldUnknown, Message: e.Error()})
+  case *json.SyntaxError:
+    return util.BadRequest(util.CodeInvalidBody, fmt.Sprintf("malformed JSON at offset %d", e.Offset))
+  case *json.UnmarshalTypeError:
+    message := "expected " + e.Type.String() + ", not " + e.Value
+    return util.BadRequest(util.CodeValidationFailed, message, util.Field{Name: e.Field, Code: util.FieldInvalid, Message: message})
+  }
+  switch err {
+  case errUnknownFilter:
+    return util.BadRequest(util.CodeInvalidParameter, err.Error())
+  case io.EOF, io.ErrUnexpectedEOF:
+    return util.BadRequest(util.CodeInvalidBody, "the body is empty or incomplete")
+  }
+  return util.Internal(err)
+}
+
+// decodeEntry reads an entry from the body of a request, checking that the
+// fields every entry needs are there.
+func decodeEntry(r *http.Request) (*d.Entry, error) {
+  e := new(d.Entry)
+  if err := json.NewDecoder(r.Body).Decode(e); err != nil {
+    return nil, err
+  }
+
+  var fields []util.Field
+  required := []struct {
+    name, value string
+  }{
+    {"headword", e.Headword},
+    {"hw_lang", e.Headword_Language},
+    {"def_lang", e.Definition_Language},
+  }
+  for _, field := range required {
+    if field.value == "" {
+      fields = append(fields, util.Field{Name: field.name, Code: util.FieldRequired, Message: field.name + " is required"})
+    }
+  }
+  if len(fields) > 0 {
+    return nil, util.BadRequest(util.CodeValidationFailed, "the entry is missing required fields", fields...)
+  }
+  return e, nil
+}
@@ -5,321 +5,1363 @@
 package main
 
 import (
+  "context"
   "database/sql"
+  "encoding/json"
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+  "unicode/utf8"
 
+  "github.com/lib/pq"
   d "github.com/yugur/api/entry"
+  "github.com/yugur/api/migrations"
+  "github.com/yugur/api/normalize"
 )
+
+// Columns scanned by scanRows, in order. Avoid SELECT * so that adding columns
+// to the entries table doesn't break scanning.
+const entryColumns = "entry_id, headword, wordtype, definition, hw_lang, def_lang, etymology, ipa, phonetic"
+
+// Options for ts_headline when building definition snippets
+const headlineOptions = `StartSel="` + markStart + `", StopSel="` + markStop + `", MaxFragments=2, MinWords=5, MaxWords=20`
+
+// pgStore is the Postgres implementation of Store.
+type pgStore struct {
+  db *sql.DB
+}
+
+func newPGStore(db *sql.DB) *pgStore {
+  return &pgStore{db: db}
+}
+
 //---------------------------------------------------------
 //---- Search Queries
 //---------------------------------------------------------
 
-func index() ([]*d.Entry, error) {
-  query := `SELECT *
+func (s *pgStore) Index() ([]*d.Entry, error) {
+  query := `SELECT ` + entryColumns + `
             FROM entries`
 
-  rows, err := db.Query(query)
+  return s.queryEntries(query)
+}
+
+func (s *pgStore) EntryPage(f entryFilter, p pageRequest) ([]*d.Entry, string, int, error) {
+  where, args, err := s.where(f)
   if err != nil {
-    return nil, err
+    return nil, "", 0, err
   }
-  defer rows.Close()
 
-  entries, err := scanRows(rows)
+  var total int
+  if !p.NoTotal {
+    row := s.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM entries %s", where), args...)
+    if err := row.Scan(&total); err != nil {
+      return nil, "", 0, err
+    }
+  }
+
+  cmp, dir := ">", "ASC"
+  if p.Descending {
+    cmp, dir = "<", "DESC"
+  }
+
+  order := "entry_id " + dir
+  if p.Sort == sortHeadword {
+    order = "headword " + dir + ", " + order
+  }
+
+  if p.After != nil {
+    var keyset string
+    if p.Sort == sortHeadword {
+      args = append(args, p.After.Headword, p.After.ID)
+      keyset = fmt.Sprintf("(headword, entry_id) %s ($%d, $%d)", cmp, len(args)-1, len(args))
+    } else {
+      args = append(args, p.After.ID)
+      keyset = fmt.Sprintf("entry_id %s $%d", cmp, len(args))
+    }
+    if where == "" {
+      where = "WHERE " + keyset
+    } else {
+      where += " AND " + keyset
+    }
+  }
+
+  // Fetch one extra entry to find out whether there is another page
+  args = append(args, p.Limit+1)
+  query := fmt.Sprintf(`SELECT %s FROM entries %s
+                        ORDER BY %s
+                        LIMIT $%d`, entryColumns, where, order, len(args))
+  entries, err := s.queryEntries(query, args...)
   if err != nil {
-    return entries, err
+    return nil, "", 0, err
   }
 
-  return entries, nil
+  var next string
+  if len(entries) > p.Limit {
+    entries = entries[:p.Limit]
+    next = p.cursor(entries[len(entries)-1])
+  }
+  return entries, next, total, nil
 }
 
-// idSearch returns the matching entries for each id.
-// Raises sql.ErrNoRows if there is no matching entry for any provided id.
-func idSearch(ids ...string) ([]*d.Entry, error) {
+func (s *pgStore) IDSearch(ids ...string) ([]*d.Entry, error) {
   var errNoRows error
   entries := make([]*d.Entry, 0)
 
   for _, id := range ids {
-    e := new(d.Entry)
-
-    row := db.QueryRow("SELECT * FROM entries WHERE entry_id = $1", id)
-    err := row.Scan(&e.ID, &e.Headword, &e.Wordtype, &e.Definition, &e.Headword_Language, &e.Definition_Language)
-    if err != nil {
+    // IDs that aren't entry_ids can't match, as with memStore, rather than
+    // being refused by Postgres
+    if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+      errNoRows = sql.ErrNoRows
+      continue
+    }
+    row := s.db.QueryRow("SELECT "+entryColumns+" FROM entries WHERE entry_id = $1", id)
+    e, err := scanEntry(row)
+    if err == sql.ErrNoRows {
       errNoRows = err
       continue
+    } else if err != nil {
+      return nil, err
     }
     entries = append(entries, e)
   }
+  if err := s.load(entries...); err != nil {
+    return entries, err
+  }
   return entries, errNoRows
 }
 
-func headwordSearch(word string) ([]*d.Entry, error) {
-  var query string
-  if len(word) == 1 {
-    query = `SELECT * FROM entries
-             WHERE SUBSTRING(LOWER(headword), 1, 1) = LOWER($1)`
-  } else {
-    query = `SELECT * FROM entries
-             WHERE headword = $1`
+func (s *pgStore) HeadwordSearch(word string) ([]*d.Entry, error) {
+  key := normalize.Key(word)
+  if utf8.RuneCountInString(word) == 1 {
+    query := `SELECT ` + entryColumns + ` FROM entries
+              WHERE headword_key LIKE $1`
+    return s.queryEntries(query, likePrefix(key))
   }
-  rows, err := db.Query(query, word)
+  query := `SELECT ` + entryColumns + ` FROM entries
+            WHERE headword_key = $1`
+  return s.queryEntries(query, key)
+}
+
+func (s *pgStore) FuzzyHeadwordSearch(word string, f entryFilter, threshold float64, limit int) ([]*d.Match, error) {
+  conditions, args, err := s.conditions(f, normalize.Key(word), limit)
   if err != nil {
     return nil, err
   }
-  defer rows.Close()
+  conditions = append(conditions, "headword_key % $1")
 
-  entries, err := scanRows(rows)
+  matches, err := s.fuzzyMatches(conditions, args, threshold)
   if err != nil {
-    return entries, err
+    return matches, err
   }
-  return entries, nil
+  // Only once the transaction is done, so as not to need a second connection
+  // while it holds one
+  return matches, s.loadMatches(matches)
 }
 
-func tagSearch(tag string) ([]*d.Entry, error) {
-  tagID, err := getTagID(tag)
+// fuzzyMatches runs the query of FuzzyHeadwordSearch in a transaction of its
+// own, in which the similarity threshold is set.
+func (s *pgStore) fuzzyMatches(conditions []string, args []interface{}, threshold float64) ([]*d.Match, error) {
+  tx, err := s.db.Begin()
   if err != nil {
     return nil, err
   }
+  defer tx.Rollback()
 
-  rows, err := db.Query("SELECT entries.entry_id, entries.headword, entries.wordtype, entries.definition, entries.hw_lang, entries.def_lang FROM (SELECT * FROM entry_tags WHERE tag_id = $1) AS entry_tags JOIN entries ON entry_tags.entry_id = entries.entry_id", tagID)    
+  // The % operator, which can use the trigram index, compares against this
+  _, err = tx.Exec("SELECT set_config('pg_trgm.similarity_threshold', $1, true)", strconv.FormatFloat(threshold, 'f', -1, 64))
   if err != nil {
     return nil, err
   }
-  defer rows.Close()
 
-  entries, err := scanRows(rows)
+  rows, err := tx.Query(`
+    SELECT `+entryColumns+`, similarity(headword_key, $1) AS similarity
+    FROM entries
+    WHERE `+strings.Join(conditions, " AND ")+`
+    ORDER BY similarity DESC, entry_id
+    LIMIT $2`, args...)
   if err != nil {
-    return entries, err
+    return nil, err
   }
+  defer rows.Close()
 
-  return entries, nil
+  var matches []*d.Match
+  for rows.Next() {
+    m := new(d.Match)
+    m.Entry, err = scanEntry(rows, &m.Similarity)
+    if err != nil {
+      return matches, err
+    }
+    matches = append(matches, m)
+  }
+  return matches, rows.Err()
 }
 
-func wordtypeSearch(wordtype string) ([]*d.Entry, error) {
-  id, err := getWordtypeID(wordtype)
+func (s *pgStore) SuggestHeadwords(prefix string, f entryFilter, limit int) ([]*suggestion, error) {
+  key := normalize.Key(prefix)
+  conditions, args, err := s.conditions(f, likePrefix(key), key, limit)
   if err != nil {
     return nil, err
   }
+  conditions = append(conditions, "headword_key LIKE $1")
 
-  query := `SELECT * FROM entries
-            WHERE wordtype = $1`
-  rows, err := db.Query(query, id)
+  rows, err := s.db.Query(`
+    SELECT headword, hw_lang, COUNT(*)
+    FROM entries
+    WHERE `+strings.Join(conditions, " AND ")+`
+    GROUP BY headword, hw_lang
+    ORDER BY bool_or(headword_key = $2) DESC, LENGTH(headword), headword, hw_lang
+    LIMIT $3`, args...)
   if err != nil {
     return nil, err
   }
   defer rows.Close()
 
-  entries, err := scanRows(rows)
+  var suggestions []*suggestion
+  for rows.Next() {
+    sg := new(suggestion)
+    if err := rows.Scan(&sg.Headword, &sg.Language, &sg.Entries); err != nil {
+      return suggestions, err
+    }
+    suggestions = append(suggestions, sg)
+  }
+  return suggestions, rows.Err()
+}
+
+func (s *pgStore) TagSearch(tag string) ([]*d.Entry, error) {
+  tagID, err := s.TagID(tag)
   if err != nil {
-    return entries, err
+    return nil, err
   }
 
-  return entries, nil
+  query := `SELECT ` + entryColumns + ` FROM entries
+            WHERE entry_id IN (SELECT entry_id FROM entry_tags WHERE tag_id = $1)`
+  return s.queryEntries(query, tagID)
+}
+
+func (s *pgStore) WordtypeSearch(wordtype string) ([]*d.Entry, error) {
+  id, err := s.WordtypeID(wordtype)
+  if err != nil {
+    return nil, err
+  }
+
+  query := `SELECT ` + entryColumns + ` FROM entries
+            WHERE wordtype = $1`
+  return s.queryEntries(query, id)
 }
 
-func definitionSearch(token string) ([]*d.Entry, error) {
-  if token == "" {
+// DefinitionSearch parses the query with the text search configuration of
+// every definition language so that each entry is matched in its own language.
+func (s *pgStore) DefinitionSearch(query string, f entryFilter) ([]*d.Match, error) {
+  if query == "" {
     return nil, nil
   }
+  conditions, args, err := s.conditions(f, query, headlineOptions)
+  if err != nil {
+    return nil, err
+  }
+  conditions = append(conditions, "e.definition_tsv @@ queries.q")
 
-  query := `SELECT * FROM entries
-            WHERE STRPOS(definition, $1) > 0`
-  rows, err := db.Query(query, token)
+  rows, err := s.db.Query(`
+    WITH queries AS (
+      SELECT cfg, websearch_to_tsquery(cfg, $1) AS q
+      FROM (SELECT DISTINCT ts_config AS cfg FROM languages) AS configs
+    )
+    SELECT `+prefix("e", entryColumns)+`,
+      ts_rank(e.definition_tsv, queries.q) AS rank,
+      ts_headline(e.ts_config, COALESCE(e.definition, ''), queries.q, $2) AS snippet
+    FROM entries AS e
+    JOIN queries ON e.ts_config = queries.cfg
+    WHERE `+strings.Join(conditions, " AND ")+`
+    ORDER BY rank DESC, e.entry_id`, args...)
   if err != nil {
     return nil, err
   }
   defer rows.Close()
 
-  entries, err := scanRows(rows)
+  var matches []*d.Match
+  for rows.Next() {
+    m := new(d.Match)
+    m.Entry, err = scanEntry(rows, &m.Rank, &m.Snippet)
+    if err != nil {
+      return matches, err
+    }
+    m.Snippet = markSnippet(m.Snippet)
+    matches = append(matches, m)
+  }
+  if err := rows.Err(); err != nil {
+    return matches, err
+  }
+  return matches, s.loadMatches(matches)
+}
+
+func (s *pgStore) RandomSearch(f entryFilter, n int) ([]*d.Entry, error) {
+  where, args, err := s.where(f)
   if err != nil {
-    return entries, err
+    return nil, err
   }
 
-  return entries, nil
+  args = append(args, n)
+  query := fmt.Sprintf(`SELECT %s FROM entries %s
+                        ORDER BY random()
+                        LIMIT $%d`, entryColumns, where, len(args))
+  return s.queryEntries(query, args...)
+}
+
+func (s *pgStore) DailySearch(f entryFilter, day time.Time) ([]*d.Entry, error) {
+  where, args, err := s.where(f)
+  if err != nil {
+    return nil, err
+  }
+
+  var count int
+  row := s.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM entries %s", where), args...)
+  if err := row.Scan(&count); err != nil {
+    return nil, err
+  }
+  if count == 0 {
+    return nil, nil
+  }
+
+  args = append(args, dailyOffset(day, f.key(), count))
+  query := fmt.Sprintf(`SELECT %s FROM entries %s
+                        ORDER BY entry_id
+                        OFFSET $%d LIMIT 1`, entryColumns, where, len(args))
+  return s.queryEntries(query, args...)
 }
 
 //---------------------------------------------------------
 //---- Executable Queries
 //---------------------------------------------------------
 
-func insertEntry(entries ...*d.Entry) (int64, error) {
+// InsertEntry writes all of the entries, with their senses, in a single
+// transaction. Created entries are given their new ID.
+func (s *pgStore) InsertEntry(author string, entries ...*d.Entry) (int64, error) {
+  tx, err := s.db.Begin()
+  if err != nil {
+    return 0, err
+  }
+  defer tx.Rollback()
+
+  rowsAffected, ids, err := insertEntries(tx, author, entries...)
+  if err != nil {
+    return 0, err
+  }
+  if err := tx.Commit(); err != nil {
+    return 0, err
+  }
+  setCreatedIDs(entries, ids)
+  return rowsAffected, nil
+}
+
+// insertEntries does the work of InsertEntry within tx. It returns the ID of
+// each entry, which is empty for updates of entries that don't exist.
+// Created entries aren't given their ID until the caller commits, see
+// setCreatedIDs.
+func insertEntries(tx *sql.Tx, author string, entries ...*d.Entry) (int64, []string, error) {
   var rowsAffected int64
-  for _, entry := range entries {
+  ids := make([]string, len(entries))
+  for i, entry := range entries {
     var query string
-    var result sql.Result
+    var id string
     var err error
+    action := actionUpdate
 
     if entry.ID == "" {
-      query = `INSERT INTO entries (headword, wordtype, definition, hw_lang, def_lang) 
-                VALUES($1, $2, $3, $4, $5)`
-      result, err = db.Exec(
+      query = `INSERT INTO entries (headword, wordtype, definition, hw_lang, def_lang, etymology, ipa, phonetic, headword_key)
+                VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+                RETURNING entry_id`
+      err = tx.QueryRow(
         query,
         entry.Headword,
         entry.Wordtype,
         entry.Definition,
         entry.Headword_Language,
-        entry.Definition_Language)
+        entry.Definition_Language,
+        nullString(entry.Etymology),
+        nullString(entry.IPA),
+        nullString(entry.Phonetic),
+        normalize.Key(entry.Headword)).Scan(&id)
+      action = actionCreate
     } else {
       query = `UPDATE entries
-                SET headword = $1, wordtype = $2, definition = $3, hw_lang = $4, def_lang = $5
-                WHERE entry_id = $6`
-      result, err = db.Exec(
+                SET headword = $1, wordtype = $2, definition = $3, hw_lang = $4, def_lang = $5,
+                    etymology = $6, ipa = $7, phonetic = $8, headword_key = $9
+                WHERE entry_id = $10
+                RETURNING entry_id`
+      err = tx.QueryRow(
         query,
         entry.Headword,
         entry.Wordtype,
         entry.Definition,
         entry.Headword_Language,
         entry.Definition_Language,
-        entry.ID)
+        nullString(entry.Etymology),
+        nullString(entry.IPA),
+        nullString(entry.Phonetic),
+        normalize.Key(entry.Headword),
+        entry.ID).Scan(&id)
+      if err == sql.ErrNoRows {
+        continue
+      }
     }
-
     if err != nil {
-      return rowsAffected, err
+      return 0, nil, err
     }
 
-    r, err := result.RowsAffected()
+    if err := insertSenses(tx, id, entry.Senses); err != nil {
+      return 0, nil, err
+    }
+    if err := insertRevision(tx, id, action, author, entry); err != nil {
+      return 0, nil, err
+    }
+    ids[i] = id
+    rowsAffected++
+  }
+  return rowsAffected, ids, nil
+}
+
+// setCreatedIDs gives the entries created by insertEntries their IDs.
+func setCreatedIDs(entries []*d.Entry, ids []string) {
+  for i, entry := range entries {
+    if entry.ID == "" {
+      entry.ID = ids[i]
+    }
+  }
+}
+
+func (s *pgStore) RestoreEntry(author string, e *d.Entry) error {
+  tx, err := s.db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  // Deleted entries come back with their old ID
+  query := `INSERT INTO entries (entry_id, headword, wordtype, definition, hw_lang, def_lang, etymology, ipa, phonetic, headword_key)
+            VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+            ON CONFLICT (entry_id) DO UPDATE
+            SET headword = $2, wordtype = $3, definition = $4, hw_lang = $5, def_lang = $6,
+                etymology = $7, ipa = $8, phonetic = $9, headword_key = $10`
+  _, err = tx.Exec(
+    query,
+    e.ID,
+    e.Headword,
+    e.Wordtype,
+    e.Definition,
+    e.Headword_Language,
+    e.Definition_Language,
+    nullString(e.Etymology),
+    nullString(e.IPA),
+    nullString(e.Phonetic),
+    normalize.Key(e.Headword))
+  if err != nil {
+    return err
+  }
+
+  if err := insertSenses(tx, e.ID, e.Senses); err != nil {
+    return err
+  }
+  if err := insertRevision(tx, e.ID, actionRestore, author, e); err != nil {
+    return err
+  }
+  return tx.Commit()
+}
+
+// insertSenses replaces the senses of an entry.
+func insertSenses(tx *sql.Tx, entryID string, senses []*d.Sense) error {
+  if _, err := tx.Exec("DELETE FROM senses WHERE entry_id = $1", entryID); err != nil {
+    return err
+  }
+
+  for i, sense := range senses {
+    var senseID string
+    labels := sense.Labels
+    if labels == nil {
+      labels = []string{}
+    }
+    err := tx.QueryRow(`INSERT INTO senses (entry_id, position, wordtype, definition, labels)
+                        VALUES($1, $2, $3, $4, $5)
+                        RETURNING sense_id`,
+      entryID, i+1, nullString(sense.Wordtype), sense.Definition, pq.Array(labels)).Scan(&senseID)
     if err != nil {
-      return rowsAffected, err
+      return err
+    }
+
+    for j, example := range sense.Examples {
+      _, err := tx.Exec(`INSERT INTO examples (sense_id, position, text, translation)
+                         VALUES($1, $2, $3, $4)`,
+        senseID, j+1, example.Text, nullString(example.Translation))
+      if err != nil {
+        return err
+      }
     }
-    rowsAffected += r
   }
-  return rowsAffected, nil
+  return nil
+}
+
+/*
+  FillHeadwordKeys sets the headword key of entries which don't have one,
+  see normalize.Key, and returns how many were set. Keys are computed here
+  rather than by Postgres, so entries from before keys were added, or whose
+  keys have been cleared after a change to how keys are made, get them when
+  the API starts.
+*/
+func (s *pgStore) FillHeadwordKeys() (int, error) {
+  rows, err := s.db.Query("SELECT entry_id, headword FROM entries WHERE headword_key IS NULL")
+  if err != nil {
+    return 0, err
+  }
+  keys := make(map[string]string)
+  for rows.Next() {
+    var id, headword string
+    if err := rows.Scan(&id, &headword); err != nil {
+      rows.Close()
+      return 0, err
+    }
+    keys[id] = normalize.Key(headword)
+  }
+  rows.Close()
+  if err := rows.Err(); err != nil {
+    return 0, err
+  }
+
+  tx, err := s.db.Begin()
+  if err != nil {
+    return 0, err
+  }
+  defer tx.Rollback()
+  for id, key := range keys {
+    if _, err := tx.Exec("UPDATE entries SET headword_key = $1 WHERE entry_id = $2", key, id); err != nil {
+      return 0, err
+    }
+  }
+  return len(keys), tx.Commit()
 }
 
-func deleteEntry(ids ...string) (int64, error) {
+func (s *pgStore) DeleteEntry(author string, ids ...string) (int64, error) {
+  // Keep what is about to be deleted for the revisions
+  entries, err := s.IDSearch(ids...)
+  if err != nil && err != sql.ErrNoRows {
+    return 0, err
+  }
+
+  tx, err := s.db.Begin()
+  if err != nil {
+    return 0, err
+  }
+  defer tx.Rollback()
+
   var rowsAffected int64
-  for _, id := range ids {
+  for _, e := range entries {
     query := `DELETE FROM entries
               WHERE entry_id = $1`
-    result, err := db.Exec(query, id)
+    result, err := tx.Exec(query, e.ID)
     if err != nil {
-      return rowsAffected, err
+      return 0, err
     }
-
     r, err := result.RowsAffected()
     if err != nil {
-      return rowsAffected, err
+      return 0, err
+    }
+    if r == 0 {
+      continue
+    }
+    if err := insertRevision(tx, e.ID, actionDelete, author, e); err != nil {
+      return 0, err
     }
     rowsAffected += r
   }
-  return rowsAffected, nil
+  return rowsAffected, tx.Commit()
+}
+
+func (s *pgStore) AddTag(tagID, entryID string) (int64, error) {
+  return s.exec("INSERT INTO entry_tags VALUES($1, $2)", tagID, entryID)
+}
+
+func (s *pgStore) RemoveTag(tagID, entryID string) (int64, error) {
+  return s.exec("DELETE FROM entry_tags WHERE tag_id = $1 AND entry_id = $2", tagID, entryID)
+}
+
+func (s *pgStore) CreateTag(name string) (string, error) {
+  return s.lookup("INSERT INTO tags (name) VALUES($1) RETURNING tag_id", name)
+}
+
+func (s *pgStore) CreateWordtype(name string) (string, error) {
+  return s.lookup("INSERT INTO wordtypes (name) VALUES($1) RETURNING wordtype_id", name)
+}
+
+func (s *pgStore) CreateLanguage(name, code string) (string, error) {
+  return s.lookup("INSERT INTO languages (name, code) VALUES($1, $2) RETURNING lang_id", name, code)
 }
 
 //---------------------------------------------------------
-//---- Helper Functions
+//---- Audio Queries
 //---------------------------------------------------------
 
-func getTagID(tag string) (string, error) {
-  var result string
+const audioColumns = "audio_id, entry_id, blob_key, content_type, speaker, size, uploaded"
 
-  row := db.QueryRow("SELECT tag_id FROM tags WHERE name = $1", tag)
-  err := row.Scan(&result)
+func (s *pgStore) InsertAudio(f *audioFile) (string, error) {
+  query := `INSERT INTO audio (entry_id, blob_key, content_type, speaker, size)
+            VALUES($1, $2, $3, $4, $5)
+            RETURNING audio_id`
+  return s.lookup(query, f.EntryID, f.Key, f.ContentType, nullString(f.Speaker), f.Size)
+}
 
-  return result, err
+func (s *pgStore) AudioFile(id string) (*audioFile, error) {
+  row := s.db.QueryRow("SELECT "+audioColumns+" FROM audio WHERE audio_id = $1", id)
+  return scanAudio(row)
 }
 
-func getTagName(id string) (string, error) {
-  var result string
+func (s *pgStore) EntryAudio(entryID string) ([]*audioFile, error) {
+  rows, err := s.db.Query("SELECT "+audioColumns+" FROM audio WHERE entry_id = $1 ORDER BY audio_id", entryID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
 
-  row := db.QueryRow("SELECT name FROM tags WHERE tag_id = $1", id)
-  err := row.Scan(&result)
+  var files []*audioFile
+  for rows.Next() {
+    f, err := scanAudio(rows)
+    if err != nil {
+      return files, err
+    }
+    files = append(files, f)
+  }
+  return files, rows.Err()
+}
 
-  return result, err
+func (s *pgStore) DeleteAudio(id string) (int64, error) {
+  return s.exec("DELETE FROM audio WHERE audio_id = $1", id)
 }
 
-func getWordtypeID(name string) (string, error) {
-  var result string
+func scanAudio(row scanner) (*audioFile, error) {
+  f := new(audioFile)
+  var speaker sql.NullString
+  err := row.Scan(&f.ID, &f.EntryID, &f.Key, &f.ContentType, &speaker, &f.Size, &f.Uploaded)
+  if err != nil {
+    return nil, err
+  }
+  f.Speaker = speaker.String
+  return f, nil
+}
 
-  row := db.QueryRow("SELECT wordtype_id FROM wordtypes WHERE name = $1", name)
-  err := row.Scan(&result)
+//---------------------------------------------------------
+//---- Revision Queries
+//---------------------------------------------------------
 
-  return result, err
+const revisionColumns = "r.revision_id, r.entry_id, r.action, r.uid, u.username, r.created"
+
+// insertRevision records a snapshot of an entry after it was changed by author.
+func insertRevision(tx *sql.Tx, entryID, action, author string, e *d.Entry) error {
+  snapshot, err := json.Marshal(snapshotOf(entryID, e))
+  if err != nil {
+    return err
+  }
+  query := `INSERT INTO revisions (entry_id, action, uid, snapshot)
+            VALUES($1, $2, $3, $4)`
+  _, err = tx.Exec(query, entryID, action, nullString(author), snapshot)
+  return err
 }
 
-func getWordtypeName(id string) (string, error) {
-  var result string
+func (s *pgStore) Revisions(entryID string) ([]*revision, error) {
+  rows, err := s.db.Query(`SELECT `+revisionColumns+`
+                           FROM revisions AS r
+                           LEFT JOIN users AS u ON u.uid = r.uid
+                           WHERE r.entry_id = $1
+                           ORDER BY r.revision_id DESC`, entryID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
 
-  row := db.QueryRow("SELECT name FROM wordtypes WHERE wordtype_id = $1", id)
-  err := row.Scan(&result)
+  var revisions []*revision
+  for rows.Next() {
+    r, err := scanRevision(rows)
+    if err != nil {
+      return revisions, err
+    }
+    revisions = append(revisions, r)
+  }
+  return revisions, rows.Err()
+}
 
-  return result, err
+func (s *pgStore) Revision(id string) (*revision, error) {
+  var snapshot []byte
+  row := s.db.QueryRow(`SELECT `+revisionColumns+`, r.snapshot
+                        FROM revisions AS r
+                        LEFT JOIN users AS u ON u.uid = r.uid
+                        WHERE r.revision_id = $1`, id)
+  r, err := scanRevision(row, &snapshot)
+  if err != nil {
+    return nil, err
+  }
+  r.Entry = new(d.Entry)
+  return r, json.Unmarshal(snapshot, r.Entry)
 }
 
-func getLocaleID(code string) (string, error) {
-  var result string
+func scanRevision(row scanner, extra ...interface{}) (*revision, error) {
+  r := new(revision)
+  var uid, username sql.NullString
+  dest := append([]interface{}{&r.ID, &r.EntryID, &r.Action, &uid, &username, &r.Created}, extra...)
+  if err := row.Scan(dest...); err != nil {
+    return nil, err
+  }
+  r.AuthorID, r.Author = uid.String, username.String
+  return r, nil
+}
 
-  row := db.QueryRow("SELECT lang_id FROM languages WHERE code = $1", code)
-  err := row.Scan(&result)
+//---------------------------------------------------------
+//---- Proposal Queries
+//---------------------------------------------------------
 
-  return result, err
+const proposalColumns = `p.proposal_id, p.entry_id, p.base_revision, p.uid, u.username, p.entry, p.status,
+                         p.comment, p.reviewer, p.created, p.updated, p.reviewed`
+
+func (s *pgStore) InsertProposal(p *proposal) (string, error) {
+  entry, err := json.Marshal(p.Entry)
+  if err != nil {
+    return "", err
+  }
+  query := `INSERT INTO proposals (entry_id, base_revision, uid, entry, status)
+            VALUES($1, $2, $3, $4, $5)
+            RETURNING proposal_id`
+  return s.lookup(query, nullString(p.EntryID), nullString(p.BaseRevision), p.AuthorID, entry, p.Status)
+}
+
+func (s *pgStore) Proposal(id string) (*proposal, error) {
+  row := s.db.QueryRow(`SELECT `+proposalColumns+`
+                        FROM proposals AS p
+                        JOIN users AS u ON u.uid = p.uid
+                        WHERE p.proposal_id = $1`, id)
+  return scanProposal(row)
+}
+
+func (s *pgStore) Proposals(status, authorID string) ([]*proposal, error) {
+  rows, err := s.db.Query(`SELECT `+proposalColumns+`
+                           FROM proposals AS p
+                           JOIN users AS u ON u.uid = p.uid
+                           WHERE ($1 = '' OR p.status = $1) AND ($2 = '' OR p.uid::text = $2)
+                           ORDER BY p.proposal_id`, status, authorID)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var proposals []*proposal
+  for rows.Next() {
+    p, err := scanProposal(rows)
+    if err != nil {
+      return proposals, err
+    }
+    proposals = append(proposals, p)
+  }
+  return proposals, rows.Err()
 }
 
-func getLocaleCode(id string) (string, error) {
+func (s *pgStore) UpdateProposal(p *proposal, from ...string) (int64, error) {
+  entry, err := json.Marshal(p.Entry)
+  if err != nil {
+    return 0, err
+  }
+  query := `UPDATE proposals
+            SET entry_id = $1, entry = $2, status = $3, comment = $4, reviewer = $5, updated = now(),
+                reviewed = CASE WHEN $5::bigint IS NULL THEN reviewed ELSE now() END,
+                base_revision = $8
+            WHERE proposal_id = $6 AND status = ANY($7)`
+  return s.exec(query, nullString(p.EntryID), entry, p.Status, nullString(p.Comment), nullString(p.ReviewerID), p.ID, pq.Array(from),
+                nullString(p.BaseRevision))
+}
+
+func (s *pgStore) ApproveProposal(p *proposal) (int64, error) {
+  tx, err := s.db.Begin()
+  if err != nil {
+    return 0, err
+  }
+  defer tx.Rollback()
+
+  // Claim the proposal first: a concurrent approval waits on the row lock
+  // and then finds it no longer pending
+  var authorID string
+  var entryID, base sql.NullString
+  var stored []byte
+  err = tx.QueryRow(`UPDATE proposals
+                     SET status = $1, comment = $2, reviewer = $3, updated = now(), reviewed = now()
+                     WHERE proposal_id = $4 AND status = $5
+                     RETURNING uid, entry_id, base_revision, entry`,
+                     statusApproved, nullString(p.Comment), p.ReviewerID, p.ID, statusPending).Scan(&authorID, &entryID, &base, &stored)
+  if err == sql.ErrNoRows {
+    return 0, nil
+  } else if err != nil {
+    return 0, err
+  }
+
+  if entryID.Valid {
+    // Lock the entry so that it can't change between the check and the update
+    var locked string
+    err := tx.QueryRow("SELECT entry_id FROM entries WHERE entry_id = $1 FOR UPDATE", entryID.String).Scan(&locked)
+    if err == sql.ErrNoRows {
+      return 0, errEntryDeleted
+    } else if err != nil {
+      return 0, err
+    }
+    var latest sql.NullString
+    err = tx.QueryRow("SELECT max(revision_id) FROM revisions WHERE entry_id = $1", entryID.String).Scan(&latest)
+    if err != nil {
+      return 0, err
+    }
+    if latest != base {
+      return 0, errEntryChanged
+    }
+  }
+
+  entry := new(d.Entry)
+  if err := json.Unmarshal(stored, entry); err != nil {
+    return 0, err
+  }
+  applied, ids, err := insertEntries(tx, authorID, entry.Copy())
+  if err != nil {
+    return 0, err
+  }
+  if applied == 0 {
+    return 0, errEntryDeleted
+  }
+  entry.ID = ids[0]
+  snapshot, err := json.Marshal(entry)
+  if err != nil {
+    return 0, err
+  }
+  _, err = tx.Exec("UPDATE proposals SET entry_id = $1, entry = $2 WHERE proposal_id = $3", ids[0], snapshot, p.ID)
+  if err != nil {
+    return 0, err
+  }
+  if err := tx.Commit(); err != nil {
+    return 0, err
+  }
+  p.Status, p.EntryID, p.Entry = statusApproved, ids[0], entry
+  return 1, nil
+}
+
+func scanProposal(row scanner) (*proposal, error) {
+  p := &proposal{Entry: new(d.Entry)}
+  var entryID, base, comment, reviewer sql.NullString
+  var reviewed sql.NullTime
+  var entry []byte
+  err := row.Scan(&p.ID, &entryID, &base, &p.AuthorID, &p.Author, &entry, &p.Status,
+                  &comment, &reviewer, &p.Created, &p.Updated, &reviewed)
+  if err != nil {
+    return nil, err
+  }
+  p.EntryID, p.BaseRevision, p.Comment, p.ReviewerID = entryID.String, base.String, comment.String, reviewer.String
+  if reviewed.Valid {
+    p.Reviewed = &reviewed.Time
+  }
+  return p, json.Unmarshal(entry, p.Entry)
+}
+
+//---------------------------------------------------------
+//---- Relation Queries
+//---------------------------------------------------------
+
+func (s *pgStore) AddRelation(r relation) (int64, error) {
+  query := `INSERT INTO relations (entry_id, related_id, relation)
+            VALUES($1, $2, $3)
+            ON CONFLICT DO NOTHING`
+  return s.exec(query, r.EntryID, r.RelatedID, r.Type)
+}
+
+func (s *pgStore) RemoveRelation(r relation) (int64, error) {
+  query := `DELETE FROM relations
+            WHERE entry_id = $1 AND related_id = $2 AND relation = $3`
+  return s.exec(query, r.EntryID, r.RelatedID, r.Type)
+}
+
+func (s *pgStore) Relations(entryID string) ([]*d.Relation, error) {
+  relations, err := s.queryRelations(entryID)
+  return relations[entryID], err
+}
+
+// queryRelations finds the relations of each entry, seen from that entry.
+// Relations stored from the other end are reversed with d.Inverse.
+func (s *pgStore) queryRelations(ids ...string) (map[string][]*d.Relation, error) {
+  rows, err := s.db.Query(`
+    SELECT r.entry_id, r.relation, false, e.entry_id, e.headword, e.hw_lang
+    FROM relations AS r
+    JOIN entries AS e ON e.entry_id = r.related_id
+    WHERE r.entry_id = ANY($1::bigint[])
+    UNION ALL
+    SELECT r.related_id, r.relation, true, e.entry_id, e.headword, e.hw_lang
+    FROM relations AS r
+    JOIN entries AS e ON e.entry_id = r.entry_id
+    WHERE r.related_id = ANY($1::bigint[])`, pq.Array(ids))
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  relations := make(map[string][]*d.Relation)
+  for rows.Next() {
+    var entryID string
+    var reversed bool
+    var language sql.NullString
+    r := new(d.Relation)
+    if err := rows.Scan(&entryID, &r.Type, &reversed, &r.ID, &r.Headword, &language); err != nil {
+      return relations, err
+    }
+    if reversed {
+      r.Type = d.Inverse(r.Type)
+    }
+    r.Language = language.String
+    relations[entryID] = append(relations[entryID], r)
+  }
+  for _, list := range relations {
+    sortRelations(list)
+  }
+  return relations, rows.Err()
+}
+
+//---------------------------------------------------------
+//---- User Queries
+//---------------------------------------------------------
+
+const userColumns = "uid, username, hash, email, joindate, role"
+
+func (s *pgStore) UserByID(uid string) (*User, error) {
+  return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE uid = $1", uid))
+}
+
+func (s *pgStore) UserByName(username string) (*User, error) {
+  return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = $1", username))
+}
+
+func (s *pgStore) InsertUser(u *User) (string, error) {
+  role := u.Role
+  if role == "" {
+    role = roleViewer
+  }
+  query := `INSERT INTO users(username, hash, email, dob, gender, joindate, language, fluency, role)
+            VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+            RETURNING uid`
+  return s.lookup(query, u.Username, u.Hash, u.Email, nil, nil, u.Joindate, nil, nil, role)
+}
+
+func (s *pgStore) SetRole(uid, role string) (int64, error) {
+  return s.exec("UPDATE users SET role = $1 WHERE uid = $2", role, uid)
+}
+
+func scanUser(row scanner) (*User, error) {
+  user := new(User)
+  err := row.Scan(&user.UID, &user.Username, &user.Hash, &user.Email, &user.Joindate, &user.Role)
+  if err != nil {
+    return nil, err
+  }
+  return user, nil
+}
+
+//---------------------------------------------------------
+//---- Token Queries
+//---------------------------------------------------------
+
+func (s *pgStore) InsertRefreshToken(hash, uid string, expires time.Time) error {
+  _, err := s.exec("INSERT INTO refresh_tokens (token_hash, uid, expires) VALUES($1, $2, $3)", hash, uid, expires)
+  return err
+}
+
+func (s *pgStore) TakeRefreshToken(hash string, now time.Time) (string, error) {
+  query := `DELETE FROM refresh_tokens
+            WHERE token_hash = $1
+            RETURNING uid, expires`
+  var uid string
+  var expires time.Time
+  if err := s.db.QueryRow(query, hash).Scan(&uid, &expires); err != nil {
+    return "", err
+  }
+  if !now.Before(expires) {
+    return "", sql.ErrNoRows
+  }
+  return uid, nil
+}
+
+func (s *pgStore) InsertAPIKey(k *apiKey) (string, error) {
+  return s.lookup("INSERT INTO api_keys (uid, name, key_hash) VALUES($1, $2, $3) RETURNING key_id", k.UID, k.Name, k.Hash)
+}
+
+func (s *pgStore) APIKeyUser(hash string) (*User, error) {
+  uid, err := s.lookup("UPDATE api_keys SET last_used = now() WHERE key_hash = $1 RETURNING uid", hash)
+  if err != nil {
+    return nil, err
+  }
+  return s.UserByID(uid)
+}
+
+func (s *pgStore) UserAPIKeys(uid string) ([]*apiKey, error) {
+  rows, err := s.db.Query(`SELECT key_id, uid, name, created, last_used
+                           FROM api_keys
+                           WHERE uid = $1
+                           ORDER BY key_id`, uid)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var keys []*apiKey
+  for rows.Next() {
+    k := new(apiKey)
+    var lastUsed sql.NullTime
+    if err := rows.Scan(&k.ID, &k.UID, &k.Name, &k.Created, &lastUsed); err != nil {
+      return keys, err
+    }
+    if lastUsed.Valid {
+      k.LastUsed = &lastUsed.Time
+    }
+    keys = append(keys, k)
+  }
+  return keys, rows.Err()
+}
+
+func (s *pgStore) DeleteAPIKey(id, uid string) (int64, error) {
+  return s.exec("DELETE FROM api_keys WHERE key_id = $1 AND uid = $2", id, uid)
+}
+
+//---------------------------------------------------------
+//---- Health Queries
+//---------------------------------------------------------
+
+func (s *pgStore) Ping(ctx context.Context) error {
+  return s.db.PingContext(ctx)
+}
+
+func (s *pgStore) SchemaVersion() (int, error) {
+  return migrations.Version(s.db)
+}
+
+func (s *pgStore) Counts() (*storeCounts, error) {
+  c := &storeCounts{Languages: make(map[string]int)}
+  err := s.db.QueryRow("SELECT (SELECT count(*) FROM entries), (SELECT count(*) FROM users)").Scan(&c.Entries, &c.Users)
+  if err != nil {
+    return nil, err
+  }
+
+  rows, err := s.db.Query("SELECT l.code, count(e.entry_id) FROM languages l LEFT JOIN entries e ON e.hw_lang = l.lang_id GROUP BY l.code")
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var code string
+    var n int
+    if err := rows.Scan(&code, &n); err != nil {
+      return nil, err
+    }
+    c.Languages[code] = n
+  }
+  return c, rows.Err()
+}
+
+//---------------------------------------------------------
+//---- Helper Functions
+//---------------------------------------------------------
+
+func (s *pgStore) TagID(tag string) (string, error) {
+  return s.lookup("SELECT tag_id FROM tags WHERE name = $1", tag)
+}
+
+func (s *pgStore) TagName(id string) (string, error) {
+  return s.lookup("SELECT name FROM tags WHERE tag_id = $1", id)
+}
+
+func (s *pgStore) WordtypeID(name string) (string, error) {
+  return s.lookup("SELECT wordtype_id FROM wordtypes WHERE name = $1", name)
+}
+
+func (s *pgStore) WordtypeName(id string) (string, error) {
+  return s.lookup("SELECT name FROM wordtypes WHERE wordtype_id = $1", id)
+}
+
+func (s *pgStore) LocaleID(code string) (string, error) {
+  return s.lookup("SELECT lang_id FROM languages WHERE code = $1", code)
+}
+
+func (s *pgStore) LocaleCode(id string) (string, error) {
+  return s.lookup("SELECT code FROM languages WHERE lang_id = $1", id)
+}
+
+// lookup scans a single string from the first row of a query. This includes
+// INSERT ... RETURNING statements.
+func (s *pgStore) lookup(query string, args ...interface{}) (string, error) {
   var result string
 
-  row := db.QueryRow("SELECT code FROM languages WHERE lang_id = $1", id)
+  row := s.db.QueryRow(query, args...)
   err := row.Scan(&result)
 
   return result, err
 }
 
-// Given a variadic d.Entry(s) with database identifiers,
-// returns list of same entries with human names instead
-func asOutgoing(entries ...*d.Entry) ([]*d.Entry, error) {
-  for _, entry := range entries {
-    wordtype, err := getWordtypeName(entry.Wordtype)
-    if err != nil {
-      return entries, err
+// exec executes a statement and returns the number of rows affected.
+func (s *pgStore) exec(query string, args ...interface{}) (int64, error) {
+  result, err := s.db.Exec(query, args...)
+  if err != nil {
+    return 0, err
+  }
+  return result.RowsAffected()
+}
+
+func (s *pgStore) queryEntries(query string, args ...interface{}) ([]*d.Entry, error) {
+  rows, err := s.db.Query(query, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  entries, err := scanRows(rows)
+  if err != nil {
+    return entries, err
+  }
+  return entries, s.load(entries...)
+}
+
+// load fills in the details of entries which aren't kept in the entries table.
+func (s *pgStore) load(entries ...*d.Entry) error {
+  if err := s.loadSenses(entries...); err != nil {
+    return err
+  }
+  if err := s.loadAudio(entries...); err != nil {
+    return err
+  }
+  return s.loadRelations(entries...)
+}
+
+// loadSenses fills in the senses of each entry, and the examples of each sense.
+func (s *pgStore) loadSenses(entries ...*d.Entry) error {
+  if len(entries) == 0 {
+    return nil
+  }
+
+  byID := make(map[string]*d.Entry)
+  var ids []string
+  for _, e := range entries {
+    e.Senses = nil
+    byID[e.ID] = e
+    ids = append(ids, e.ID)
+  }
+
+  rows, err := s.db.Query(`SELECT sense_id, entry_id, wordtype, definition, labels
+                           FROM senses
+                           WHERE entry_id = ANY($1::bigint[])
+                           ORDER BY entry_id, position`, pq.Array(ids))
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+
+  senses := make(map[string]*d.Sense)
+  var senseIDs []string
+  for rows.Next() {
+    var senseID, entryID string
+    var wordtype sql.NullString
+    sense := new(d.Sense)
+    if err := rows.Scan(&senseID, &entryID, &wordtype, &sense.Definition, pq.Array(&sense.Labels)); err != nil {
+      return err
     }
-    headwordLanguage, err := getLocaleCode(entry.Headword_Language)
-    if err != nil {
-      return entries, err
+    sense.Wordtype = wordtype.String
+    if len(sense.Labels) == 0 {
+      sense.Labels = nil
     }
-    definitionLanguage, err := getLocaleCode(entry.Definition_Language)
-    if err != nil {
-      return entries, err
+    byID[entryID].Senses = append(byID[entryID].Senses, sense)
+    senses[senseID] = sense
+    senseIDs = append(senseIDs, senseID)
+  }
+  if err := rows.Err(); err != nil {
+    return err
+  }
+  if len(senseIDs) == 0 {
+    return nil
+  }
+
+  examples, err := s.db.Query(`SELECT sense_id, text, translation
+                               FROM examples
+                               WHERE sense_id = ANY($1::bigint[])
+                               ORDER BY sense_id, position`, pq.Array(senseIDs))
+  if err != nil {
+    return err
+  }
+  defer examples.Close()
+
+  for examples.Next() {
+    var senseID string
+    var translation sql.NullString
+    example := new(d.Example)
+    if err := examples.Scan(&senseID, &example.Text, &translation); err != nil {
+      return err
     }
-    entry.Wordtype = wordtype
-    entry.Headword_Language = headwordLanguage
-    entry.Definition_Language = definitionLanguage
+    example.Translation = translation.String
+    senses[senseID].Examples = append(senses[senseID].Examples, example)
   }
-  return entries, nil
+  return examples.Err()
 }
 
-// Given a variadic d.Entry(s) with human names,
-// returns list of same entries with database identifiers instead
-func asIncoming(entries ...*d.Entry) ([]*d.Entry, error) {
-  for _, entry := range entries {
-    wordtype, err := getWordtypeID(entry.Wordtype)
+// loadAudio lists the audio clips of each entry.
+func (s *pgStore) loadAudio(entries ...*d.Entry) error {
+  if len(entries) == 0 {
+    return nil
+  }
+
+  byID := make(map[string]*d.Entry)
+  var ids []string
+  for _, e := range entries {
+    e.Audio = nil
+    byID[e.ID] = e
+    ids = append(ids, e.ID)
+  }
+
+  rows, err := s.db.Query(`SELECT `+audioColumns+`
+                           FROM audio
+                           WHERE entry_id = ANY($1::bigint[])
+                           ORDER BY entry_id, audio_id`, pq.Array(ids))
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    f, err := scanAudio(rows)
     if err != nil {
-      return entries, err
+      return err
     }
-    headwordLanguage, err := getLocaleID(entry.Headword_Language)
-    if err != nil {
-      return entries, err
+    byID[f.EntryID].Audio = append(byID[f.EntryID].Audio, f.info())
+  }
+  return rows.Err()
+}
+
+// loadRelations lists the relations of each entry.
+func (s *pgStore) loadRelations(entries ...*d.Entry) error {
+  if len(entries) == 0 {
+    return nil
+  }
+
+  ids := make([]string, len(entries))
+  for i, e := range entries {
+    ids[i] = e.ID
+  }
+  relations, err := s.queryRelations(ids...)
+  if err != nil {
+    return err
+  }
+  for _, e := range entries {
+    e.Relations = relations[e.ID]
+  }
+  return nil
+}
+
+func (s *pgStore) loadMatches(matches []*d.Match) error {
+  entries := make([]*d.Entry, len(matches))
+  for i, m := range matches {
+    entries[i] = m.Entry
+  }
+  return s.load(entries...)
+}
+
+// where resolves the filter into a WHERE clause and its arguments.
+// Raises errUnknownFilter if any of the named values don't exist.
+func (s *pgStore) where(f entryFilter) (string, []interface{}, error) {
+  conditions, args, err := s.conditions(f)
+  if err != nil || len(conditions) == 0 {
+    return "", args, err
+  }
+  return "WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// conditions resolves the filter into a list of conditions on the entries
+// table. The arguments of the conditions follow those given, which the caller
+// may refer to as $1, $2, etc.
+func (s *pgStore) conditions(f entryFilter, args ...interface{}) ([]string, []interface{}, error) {
+  var conditions []string
+
+  add := func(condition, value string, lookup func(string) (string, error)) error {
+    if value == "" {
+      return nil
     }
-    definitionLanguage, err := getLocaleID(entry.Definition_Language)
-    if err != nil {
-      return entries, err
+    id, err := lookup(value)
+    if err == sql.ErrNoRows {
+      return errUnknownFilter
+    } else if err != nil {
+      return err
     }
-    entry.Wordtype = wordtype
-    entry.Headword_Language = headwordLanguage
-    entry.Definition_Language = definitionLanguage
+    args = append(args, id)
+    conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+    return nil
   }
-  return entries, nil
+
+  if err := add("hw_lang = $%d", f.Headword_Language, s.LocaleID); err != nil {
+    return nil, nil, err
+  }
+  if err := add("def_lang = $%d", f.Definition_Language, s.LocaleID); err != nil {
+    return nil, nil, err
+  }
+  if err := add("wordtype = $%d", f.Wordtype, s.WordtypeID); err != nil {
+    return nil, nil, err
+  }
+  if err := add("entry_id IN (SELECT entry_id FROM entry_tags WHERE tag_id = $%d)", f.Tag, s.TagID); err != nil {
+    return nil, nil, err
+  }
+  return conditions, args, nil
+}
+
+// likePrefix returns a LIKE pattern matching strings starting with s, with
+// LIKE's wildcards in s escaped so that they only match themselves.
+func likePrefix(s string) string {
+  return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s) + "%"
+}
+
+// prefix qualifies each of a comma separated list of columns with a table name.
+func prefix(table, columns string) string {
+  cols := strings.Split(columns, ", ")
+  for i, col := range cols {
+    cols[i] = table + "." + col
+  }
+  return strings.Join(cols, ", ")
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+  Scan(dest ...interface{}) error
+}
+
+// scanEntry scans the columns in entryColumns, followed by any extra columns
+// into extra.
+func scanEntry(row scanner, extra ...interface{}) (*d.Entry, error) {
+  entry := new(d.Entry)
+  var wordtype, definition, etymology, ipa, phonetic sql.NullString
+
+  dest := []interface{}{
+    &entry.ID,
+    &entry.Headword,
+    &wordtype,
+    &definition,
+    &entry.Headword_Language,
+    &entry.Definition_Language,
+    &etymology,
+    &ipa,
+    &phonetic,
+  }
+  if err := row.Scan(append(dest, extra...)...); err != nil {
+    return nil, err
+  }
+
+  entry.Wordtype = wordtype.String
+  entry.Definition = definition.String
+  entry.Etymology = etymology.String
+  entry.IPA = ipa.String
+  entry.Phonetic = phonetic.String
+  return entry, nil
 }
 
 func scanRows(rows *sql.Rows) ([]*d.Entry, error) {
   var entries []*d.Entry
 
   for rows.Next() {
-    entry := new(d.Entry)
-
-    err := rows.Scan(
-      &entry.ID,
-      &entry.Headword,
-      &entry.Wordtype,
-      &entry.Definition,
-      &entry.Headword_Language,
-      &entry.Definition_Language)
+    entry, err := scanEntry(rows)
     if err != nil {
       return entries, err
     }
@@ -329,4 +1371,9 @@ func scanRows(rows *sql.Rows) ([]*d.Entry, error) {
     return entries, err
   }
   return entries, nil
-}
\ No newline at end of file
+}
+
+// nullString maps empty strings to NULL.
+func nullString(s string) sql.NullString {
+  return sql.NullString{String: s, Valid: s != ""}
+}
@@ -1,63 +1,5 @@
-CREATE TABLE languages (
-	lang_id		bigserial	PRIMARY KEY,
-	name		text		NOT NULL,
-	code		text		NOT NULL UNIQUE
-);
-
-CREATE TABLE wordtypes (
-	wordtype_id	bigserial	PRIMARY KEY,
-	name		text		NOT NULL UNIQUE
-);
-
-CREATE TABLE tags (
-	tag_id		bigserial	PRIMARY KEY,
-	name		text		NOT NULL UNIQUE
-);
-
-CREATE TABLE entries (
-	entry_id	bigserial 	PRIMARY KEY,
-	headword	text 		NOT NULL,
-	wordtype	bigint		REFERENCES wordtypes (wordtype_id),
-	definition	text		,
-	hw_lang		bigint		REFERENCES languages (lang_id) ON DELETE CASCADE,
-	def_lang	bigint		REFERENCES languages (lang_id) ON DELETE CASCADE
-);
-
-CREATE TABLE entry_tags (
-	tag_id		bigint,
-	entry_id	bigint,
-	CONSTRAINT PK_entry_tags PRIMARY KEY
-    (
-        tag_id,
-        entry_id
-    ),
-    FOREIGN KEY (tag_id) REFERENCES tags (tag_id) ON DELETE CASCADE,
-    FOREIGN KEY (entry_id) REFERENCES entries (entry_id) ON DELETE CASCADE
-);
-
-CREATE TABLE users (
-	uid			bigserial	PRIMARY KEY,
-	username	text		NOT NULL UNIQUE,
-	hash		text		NOT NULL,
-	email		text		NOT NULL UNIQUE,
-	dob			date		,
-	gender		text		,
-	joindate	timestamp	NOT NULL,
-	language	bigint		REFERENCES languages (lang_id),
-	fluency		int[]		
-);
-
-INSERT INTO languages (name, code) VALUES
-	('English (AU)', 'en-AU'),
-	('Western Yugur', 'yge'),
-	('Eastern Yugur', 'yuy'),
-	('Chinese', 'zh'),
-	('한국어', 'ko-KR');
-
-INSERT INTO wordtypes (name) VALUES
-	('noun'),
-	('verb'),
-	('adjective');
+-- Sample rows for a database prepared by the API's migrations.
+-- Start the API (or run `api migrate`) once before loading this script.
 
 INSERT INTO tags (name) VALUES
 	('fire'),
@@ -66,10 +8,21 @@ INSERT INTO tags (name) VALUES
 	('passion'),
 	('fervor');
 
-INSERT INTO entries (headword, wordtype, definition, hw_lang, def_lang) VALUES
-	('fire', (SELECT wordtype_id FROM wordtypes WHERE name='noun'), 'Burning fuel or other material: a cooking fire; a forest fire.', (SELECT lang_id FROM languages WHERE code='en-AU'), (SELECT lang_id FROM languages WHERE code='en-AU')),
-	('fire', (SELECT wordtype_id FROM wordtypes WHERE name='noun'), 'Burning intensity of feeling; ardor.', (SELECT lang_id FROM languages WHERE code='en-AU'), (SELECT lang_id FROM languages WHERE code='en-AU')),
-	('zeal', (SELECT wordtype_id FROM wordtypes WHERE name='noun'), 'great energy or enthusiasm in pursuit of a cause or an objective.', (SELECT lang_id FROM languages WHERE code='en-AU'), (SELECT lang_id FROM languages WHERE code='en-AU'));
+INSERT INTO entries (headword, wordtype, definition, hw_lang, def_lang, etymology) VALUES
+	('fire', (SELECT wordtype_id FROM wordtypes WHERE name='noun'), '1. Burning fuel or other material. 2. Burning intensity of feeling; ardor.', (SELECT lang_id FROM languages WHERE code='en-AU'), (SELECT lang_id FROM languages WHERE code='en-AU'), 'From Old English fȳr.'),
+	('zeal', (SELECT wordtype_id FROM wordtypes WHERE name='noun'), 'great energy or enthusiasm in pursuit of a cause or an objective.', (SELECT lang_id FROM languages WHERE code='en-AU'), (SELECT lang_id FROM languages WHERE code='en-AU'), NULL);
+
+INSERT INTO senses (entry_id, position, wordtype, definition, labels)
+SELECT entry_id, 1, wordtype, 'Burning fuel or other material.', '{}' FROM entries WHERE headword='fire'
+UNION ALL
+SELECT entry_id, 2, wordtype, 'Burning intensity of feeling; ardor.', '{literary}' FROM entries WHERE headword='fire'
+UNION ALL
+SELECT entry_id, 1, wordtype, definition, '{}' FROM entries WHERE headword='zeal';
+
+INSERT INTO examples (sense_id, position, text)
+SELECT sense_id, 1, 'a cooking fire' FROM senses JOIN entries USING (entry_id) WHERE headword='fire' AND position=1
+UNION ALL
+SELECT sense_id, 2, 'a forest fire' FROM senses JOIN entries USING (entry_id) WHERE headword='fire' AND position=1;
 
 INSERT INTO
 	entry_tags (tag_id, entry_id)
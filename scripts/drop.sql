@@ -1,6 +1,15 @@
 DROP TABLE languages CASCADE;
 DROP TABLE entries CASCADE;
+DROP TABLE senses CASCADE;
+DROP TABLE examples CASCADE;
+DROP TABLE audio CASCADE;
+DROP TABLE relations CASCADE;
+DROP TABLE revisions CASCADE;
+DROP TABLE proposals CASCADE;
+DROP TABLE refresh_tokens CASCADE;
+DROP TABLE api_keys CASCADE;
 DROP TABLE users CASCADE;
 DROP TABLE wordtypes CASCADE;
 DROP TABLE tags	CASCADE;
-DROP TABLE entry_tags CASCADE;
\ No newline at end of file
+DROP TABLE entry_tags CASCADE;
+DROP TABLE schema_migrations CASCADE;
\ No newline at end of file
@@ -1,7 +1,9 @@
 #!/bin/bash
 # usage:
 #	chmod +x populate.sh
-#	./populate.sh [DATA] [IP] [PORT]
+#	./populate.sh [DATA] [IP] [PORT] [KEY]
+#
+# KEY is an optional API key (see the keys endpoint) to authenticate with.
 #
 # DATA needs to be a plain text file with one entry value per line i.e.
 # 1. headword
@@ -19,6 +21,10 @@ dict=""
 lang=""
 ip=$2
 port=$3
+auth=()
+if [[ -n "$4" ]]; then
+	auth=(-H "Authorization: Bearer $4")
+fi
 while IFS='' read -r line || [[ -n "$line" ]]; do
 	case $index in
 		0) word=$line
@@ -43,7 +49,7 @@ EOF
 )
 		echo "REQUEST #$count"
 		echo "$body"
-		curl -X POST -H "Content-Type: application/json" -d "$body" "http://$ip:$port/entry"
+		curl -X POST -H "Content-Type: application/json" "${auth[@]}" -d "$body" "http://$ip:$port/entry"
 		index=-1
 		;;
 	esac
@@ -0,0 +1,207 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "runtime"
+  "runtime/debug"
+  "time"
+
+  "github.com/yugur/api/migrations"
+  "github.com/yugur/api/util"
+)
+
+// Build information, set when building with
+//   go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)"
+// The commit is otherwise taken from the version control information Go
+// embeds in the binary, if any.
+var (
+  version = "dev"
+  commit  = ""
+)
+
+// When the server started, for its uptime
+var started = time.Now()
+
+// Longest a readiness check may wait for the store
+const checkTimeout = 2 * time.Second
+
+// Results of status checks
+const (
+  checkOK   = "ok"
+  checkFail = "fail"
+)
+
+// check is the result of one readiness check.
+type check struct {
+  Status    string  `json:"status"`
+  LatencyMS float64 `json:"latency_ms,omitempty"`
+  // Schema version of the store and the latest known to the API
+  Version   int     `json:"version,omitempty"`
+  Latest    int     `json:"latest,omitempty"`
+  Error     string  `json:"error,omitempty"`
+}
+
+// buildInfo describes the running binary.
+type buildInfo struct {
+  Version   string `json:"version"`
+  Commit    string `json:"commit,omitempty"`
+  GoVersion string `json:"go_version"`
+}
+
+// serverStatus is the body of the status endpoints. Liveness only says that
+// the server is up; readiness adds the checks; the status endpoint has it all.
+type serverStatus struct {
+  Status  string            `json:"status"`
+  Build   *buildInfo        `json:"build,omitempty"`
+  Started *time.Time        `json:"started,omitempty"`
+  Uptime  float64           `json:"uptime_seconds"`
+  Checks  map[string]*check `json:"checks,omitempty"`
+  Counts  *storeCounts      `json:"counts,omitempty"`
+}
+
+// Overall statuses
+const (
+  statusOK          = "ok"
+  statusUnavailable = "unavailable"
+)
+
+/*
+  statusHandler reports everything known about the server: its build, uptime,
+  the readiness checks and how many entries, users and entries per headword
+  language there are. Like readyHandler it responds 503 Service Unavailable
+  if a check fails.
+*/
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    s := readiness(r.Context())
+    s.Build = currentBuild()
+    s.Started = &started
+
+    counts, err := data.Counts()
+    if err != nil {
+      util.Logger(r.Context()).Error("counting entries failed", "error", err)
+    } else {
+      s.Counts = counts
+    }
+    writeStatus(w, s)
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+/*
+  healthHandler is the liveness probe: it responds 200 OK as long as the
+  server can serve requests, without checking anything it depends on, so
+  that a server waiting for its database isn't restarted for it.
+*/
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    writeStatus(w, &serverStatus{Status: statusOK, Uptime: uptime()})
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+/*
+  readyHandler is the readiness probe: it responds 200 OK if the server can
+  reach the database and its schema is up to date, or 503 Service
+  Unavailable with the failed checks.
+*/
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    writeStatus(w, readiness(r.Context()))
+  default:
+    // Unsupported method
+    util.WriteProblem(w, r, util.MethodNotAllowed(r))
+  }
+}
+
+// readiness runs the readiness checks.
+func readiness(ctx context.Context) *serverStatus {
+  s := &serverStatus{
+    Status: statusOK,
+    Uptime: uptime(),
+    Checks: map[string]*check{
+      "database":   checkDatabase(ctx),
+      "migrations": checkMigrations(),
+    },
+  }
+  for _, c := range s.Checks {
+    if c.Status != checkOK {
+      s.Status = statusUnavailable
+    }
+  }
+  return s
+}
+
+// checkDatabase pings the store, timing how long it takes to answer.
+func checkDatabase(ctx context.Context) *check {
+  ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+  defer cancel()
+
+  start := time.Now()
+  err := data.Ping(ctx)
+  c := &check{Status: checkOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+  if err != nil {
+    c.Status = checkFail
+    c.Error = err.Error()
+  }
+  return c
+}
+
+// checkMigrations checks that the store's schema is at the latest migration.
+func checkMigrations() *check {
+  c := &check{Status: checkOK, Latest: migrations.Latest()}
+  v, err := data.SchemaVersion()
+  switch {
+  case err != nil:
+    c.Status = checkFail
+    c.Error = err.Error()
+  case v != c.Latest:
+    c.Status = checkFail
+    c.Error = "the schema isn't at the latest migration"
+  }
+  c.Version = v
+  return c
+}
+
+// currentBuild returns the build information of the running binary.
+func currentBuild() *buildInfo {
+  b := &buildInfo{Version: version, Commit: commit, GoVersion: runtime.Version()}
+  if b.Commit == "" {
+    if info, ok := debug.ReadBuildInfo(); ok {
+      for _, setting := range info.Settings {
+        if setting.Key == "vcs.revision" {
+          b.Commit = setting.Value
+        }
+      }
+    }
+  }
+  return b
+}
+
+// uptime returns the seconds since the server started.
+func uptime() float64 {
+  return time.Since(started).Round(time.Millisecond).Seconds()
+}
+
+// writeStatus responds with s, as 503 Service Unavailable unless it is OK.
+func writeStatus(w http.ResponseWriter, s *serverStatus) {
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Cache-Control", "no-store")
+  if s.Status != statusOK {
+    w.WriteHeader(http.StatusServiceUnavailable)
+  }
+  json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,541 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+  "context"
+  "database/sql"
+  "errors"
+  "hash/fnv"
+  "html"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  d "github.com/yugur/api/entry"
+  "github.com/yugur/api/normalize"
+)
+
+// The primary data store. Handlers should only access the database through
+// this so that they can be tested against a memStore.
+var data Store
+
+//---------------------------------------------------------
+//---- Database Structs
+//---------------------------------------------------------
+
+type User struct {
+  UID      string    `json:"uid"`
+  Username string    `json:"username"`
+  Hash     string    `json:"hash"`
+  Email    string    `json:"email"`
+  Joindate time.Time `json:"joindate"`
+  Role     string    `json:"role"`
+}
+
+// apiKey is a long lived key with which a user, typically a service account,
+// authenticates scripts. Only the hash of the key itself is kept.
+type apiKey struct {
+  ID       string     `json:"id"`
+  UID      string     `json:"-"`
+  Name     string     `json:"name"`
+  Hash     string     `json:"-"`
+  Created  time.Time  `json:"created"`
+  LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// audioFile is an audio clip of an entry along with where its data is kept
+// in the blob store.
+type audioFile struct {
+  ID          string
+  EntryID     string
+  Key         string
+  ContentType string
+  Speaker     string
+  Size        int64
+  Uploaded    time.Time
+}
+
+// info returns the details of the clip that are shared with clients.
+func (f *audioFile) info() *d.Audio {
+  return &d.Audio{ID: f.ID, ContentType: f.ContentType, Speaker: f.Speaker}
+}
+
+// relation is a link between two entries as it is stored. See
+// canonicalRelation.
+type relation struct {
+  EntryID   string
+  RelatedID string
+  Type      string
+}
+
+// suggestion is a headword completing a prefix, with the number of entries
+// in the headword's language having it.
+type suggestion struct {
+  Headword string `json:"headword"`
+  Language string `json:"hw_lang"`
+  Entries  int    `json:"entries"`
+}
+
+// Actions recorded by revisions
+const (
+  actionCreate  = "create"
+  actionUpdate  = "update"
+  actionDelete  = "delete"
+  actionRestore = "restore"
+)
+
+// revision is a snapshot of an entry taken whenever it is changed. The
+// snapshot of a deletion is the entry as it was when deleted. Snapshots
+// are only loaded for single revisions.
+type revision struct {
+  ID       string    `json:"id"`
+  EntryID  string    `json:"entry_id"`
+  Action   string    `json:"action"`
+  AuthorID string    `json:"author_id,omitempty"`
+  Author   string    `json:"author,omitempty"`
+  Created  time.Time `json:"created"`
+  Entry    *d.Entry  `json:"entry,omitempty"`
+}
+
+// snapshotOf returns the copy of an entry kept by a revision, without the
+// audio and relations which are managed separately.
+func snapshotOf(entryID string, e *d.Entry) *d.Entry {
+  c := e.Copy()
+  c.ID = entryID
+  c.Audio = nil
+  c.Relations = nil
+  return c
+}
+
+// Statuses of proposals
+const (
+  statusPending          = "pending"
+  statusApproved         = "approved"
+  statusRejected         = "rejected"
+  statusChangesRequested = "changes_requested"
+)
+
+// proposal is a change to an entry proposed by a contributor for an editor
+// to review. EntryID is the entry being edited, or empty for a new entry.
+// BaseRevision is the latest revision of that entry when the proposal was
+// made or last revised, so that it isn't applied over later changes.
+type proposal struct {
+  ID           string     `json:"id"`
+  EntryID      string     `json:"entry_id,omitempty"`
+  BaseRevision string     `json:"base_revision,omitempty"`
+  AuthorID     string     `json:"author_id"`
+  Author       string     `json:"author"`
+  Entry        *d.Entry   `json:"entry"`
+  Status       string     `json:"status"`
+  Comment      string     `json:"comment,omitempty"`
+  ReviewerID   string     `json:"reviewer_id,omitempty"`
+  Created      time.Time  `json:"created"`
+  Updated      time.Time  `json:"updated"`
+  Reviewed     *time.Time `json:"reviewed,omitempty"`
+}
+
+// storeCounts sums up the contents of a store for the status endpoint.
+type storeCounts struct {
+  Entries   int            `json:"entries"`
+  Users     int            `json:"users"`
+  // Entries by the code of their headword language
+  Languages map[string]int `json:"languages"`
+}
+
+type Tag struct {
+  ID       string `json:"id"`
+  Name     string `json:"name"`
+}
+
+//---------------------------------------------------------
+//---- Store Interfaces
+//---------------------------------------------------------
+
+// Store provides access to everything the API keeps in its database.
+// Lookups that find nothing raise sql.ErrNoRows, whatever the implementation.
+type Store interface {
+  EntryStore
+  RevisionStore
+  ProposalStore
+  TagStore
+  WordtypeStore
+  LanguageStore
+  AudioStore
+  RelationStore
+  UserStore
+  TokenStore
+  HealthStore
+}
+
+// EntryStore deals in entries with database identifiers for their wordtype
+// and languages. See asIncoming and asOutgoing.
+type EntryStore interface {
+  // Index returns every entry in the dictionary.
+  Index() ([]*d.Entry, error)
+  // EntryPage returns one page of the entries matching f, the cursor for the
+  // next page (empty if this is the last) and the total number of matches,
+  // which is 0 if the page request asks for no total.
+  EntryPage(f entryFilter, p pageRequest) ([]*d.Entry, string, int, error)
+  // IDSearch returns the matching entries for each id.
+  // Raises sql.ErrNoRows if there is no matching entry for any provided id,
+  // including ids that aren't valid; any other error is raised straight away.
+  IDSearch(ids ...string) ([]*d.Entry, error)
+  // HeadwordSearch matches whole headwords, or the first letter of the
+  // headword if word is a single character.
+  HeadwordSearch(word string) ([]*d.Entry, error)
+  // FuzzyHeadwordSearch finds up to limit entries matching f with a headword
+  // whose trigram similarity to word is at least threshold, most similar first.
+  // Headwords are compared by their normalized keys, see normalize.Key.
+  FuzzyHeadwordSearch(word string, f entryFilter, threshold float64, limit int) ([]*d.Match, error)
+  // SuggestHeadwords returns up to limit distinct headwords of entries
+  // matching f that start with prefix, ignoring case. An exact match comes
+  // first, then shorter headwords before longer ones.
+  SuggestHeadwords(prefix string, f entryFilter, limit int) ([]*suggestion, error)
+  TagSearch(tag string) ([]*d.Entry, error)
+  WordtypeSearch(wordtype string) ([]*d.Entry, error)
+  // DefinitionSearch finds entries matching f whose definitions contain the
+  // words in query, ranked best first, with a snippet of each definition,
+  // escaped for HTML, in which the matching words are wrapped in
+  // <mark></mark>. See markSnippet.
+  DefinitionSearch(query string, f entryFilter) ([]*d.Match, error)
+  // RandomSearch returns up to n entries chosen at random from those matching f.
+  RandomSearch(f entryFilter, n int) ([]*d.Entry, error)
+  // DailySearch returns the "word of the day" for the given day amongst the
+  // entries matching f. Every caller asking for the same day and filter gets
+  // the same entry for as long as the matching entries don't change.
+  DailySearch(f entryFilter, day time.Time) ([]*d.Entry, error)
+
+  // InsertEntry creates entries without an ID and updates those with one,
+  // replacing their senses. Created entries are given their new ID.
+  // Each change is recorded as a revision by author, the uid of a user or
+  // empty if the change wasn't made by a user.
+  InsertEntry(author string, entries ...*d.Entry) (int64, error)
+  DeleteEntry(author string, ids ...string) (int64, error)
+}
+
+// RevisionStore keeps the history of entries, see revision.
+type RevisionStore interface {
+  // Revisions lists the revisions of an entry, newest first, without their
+  // snapshots.
+  Revisions(entryID string) ([]*revision, error)
+  Revision(id string) (*revision, error)
+  // RestoreEntry writes an entry from a snapshot, recreating it with the
+  // same ID if it has been deleted.
+  RestoreEntry(author string, e *d.Entry) error
+}
+
+// ProposalStore keeps proposed changes to entries. Proposed entries are kept
+// with database identifiers, like those of EntryStore.
+type ProposalStore interface {
+  InsertProposal(p *proposal) (string, error)
+  Proposal(id string) (*proposal, error)
+  // Proposals lists the proposals with the given status and/or author,
+  // oldest first. Empty values are ignored.
+  Proposals(status, authorID string) ([]*proposal, error)
+  // UpdateProposal saves the entry, status, comment and reviewer of a
+  // proposal, setting the time it was updated or reviewed, provided that its
+  // status is still one of from. Otherwise no rows are affected, so that
+  // concurrent changes to a proposal can't undo one another.
+  UpdateProposal(p *proposal, from ...string) (int64, error)
+  // ApproveProposal applies the entry of a pending proposal as made by its
+  // author and marks the proposal approved by p.ReviewerID, in a single
+  // transaction. No rows are affected if the proposal is no longer pending;
+  // errEntryDeleted is raised if the entry it edits has been deleted and
+  // errEntryChanged if it has been changed since its base revision. The
+  // proposal is given the ID of the entry.
+  ApproveProposal(p *proposal) (int64, error)
+}
+
+type TagStore interface {
+  TagID(name string) (string, error)
+  TagName(id string) (string, error)
+  CreateTag(name string) (string, error)
+  // AddTag and RemoveTag manage the tags attached to an entry.
+  AddTag(tagID, entryID string) (int64, error)
+  RemoveTag(tagID, entryID string) (int64, error)
+}
+
+type WordtypeStore interface {
+  WordtypeID(name string) (string, error)
+  WordtypeName(id string) (string, error)
+  CreateWordtype(name string) (string, error)
+}
+
+type LanguageStore interface {
+  LocaleID(code string) (string, error)
+  LocaleCode(id string) (string, error)
+  CreateLanguage(name, code string) (string, error)
+}
+
+// AudioStore keeps track of the audio clips of entries. The clips themselves
+// are kept in a blob.Store. Entries are returned with their clips listed.
+type AudioStore interface {
+  InsertAudio(f *audioFile) (string, error)
+  AudioFile(id string) (*audioFile, error)
+  EntryAudio(entryID string) ([]*audioFile, error)
+  DeleteAudio(id string) (int64, error)
+}
+
+// RelationStore manages the typed links between entries. Relations are given
+// in canonical form (see canonicalRelation) and entries are returned with
+// their relations listed from their own end.
+type RelationStore interface {
+  // AddRelation links two existing entries, doing nothing if they are
+  // already linked.
+  AddRelation(r relation) (int64, error)
+  RemoveRelation(r relation) (int64, error)
+  // Relations lists the relations of an entry from its end, ordered by type
+  // and then headword.
+  Relations(entryID string) ([]*d.Relation, error)
+}
+
+type UserStore interface {
+  UserByID(uid string) (*User, error)
+  UserByName(username string) (*User, error)
+  // InsertUser creates a user, as a viewer unless they are given a role.
+  InsertUser(u *User) (string, error)
+  SetRole(uid, role string) (int64, error)
+}
+
+// HealthStore reports on the store itself, for the status endpoints.
+type HealthStore interface {
+  // Ping checks that the store can be reached.
+  Ping(ctx context.Context) error
+  // SchemaVersion returns the migration the store's schema is at, see the
+  // migrations package.
+  SchemaVersion() (int, error)
+  Counts() (*storeCounts, error)
+}
+
+// TokenStore keeps the refresh tokens and API keys of users, by their hash.
+// See crypto.HashToken.
+type TokenStore interface {
+  InsertRefreshToken(hash, uid string, expires time.Time) error
+  // TakeRefreshToken removes a refresh token so that it can only be used once,
+  // and returns the user it was issued to. Raises sql.ErrNoRows if the token
+  // doesn't exist or expired before now.
+  TakeRefreshToken(hash string, now time.Time) (string, error)
+
+  InsertAPIKey(k *apiKey) (string, error)
+  // APIKeyUser returns the user owning a key and records that it was used.
+  APIKeyUser(hash string) (*User, error)
+  UserAPIKeys(uid string) ([]*apiKey, error)
+  // DeleteAPIKey revokes the key id if it belongs to the user uid.
+  DeleteAPIKey(id, uid string) (int64, error)
+}
+
+//---------------------------------------------------------
+//---- Filters
+//---------------------------------------------------------
+
+// errDuplicate is raised by memStore where Postgres would raise a unique
+// constraint violation.
+var errDuplicate = errors.New("duplicate value")
+
+// errEntryDeleted is raised when approving a proposal to edit an entry which
+// has been deleted since.
+var errEntryDeleted = errors.New("the entry has been deleted since the proposal was made")
+
+// errEntryChanged is raised when approving a proposal to edit an entry which
+// has been changed since its base revision.
+var errEntryChanged = errors.New("the entry has been changed since the proposal was made")
+
+// errUnknownFilter is raised when a filter names a language, wordtype or tag
+// that does not exist.
+var errUnknownFilter = errors.New("unknown filter value")
+
+// entryFilter narrows a selection of entries by language, wordtype or tag.
+// Values are human names (e.g. "en-AU", "noun") and empty values are ignored.
+type entryFilter struct {
+  Headword_Language   string
+  Definition_Language string
+  Wordtype            string
+  Tag                 string
+}
+
+// key identifies the filter so that each combination gets its own daily word.
+func (f entryFilter) key() string {
+  return strings.Join([]string{f.Headword_Language, f.Definition_Language, f.Wordtype, f.Tag}, "|")
+}
+
+// dailyOffset deterministically picks an offset in [0, count) from the date
+// (in UTC) and a salt.
+func dailyOffset(day time.Time, salt string, count int) int {
+  h := fnv.New64a()
+  h.Write([]byte(day.UTC().Format("2006-01-02") + "|" + salt))
+  return int(h.Sum64() % uint64(count))
+}
+
+// canonicalRelation returns the one way in which a relation is stored.
+// Symmetric relations run from the lower entry ID to the higher and
+// derivatives are stored as derived_from their counterpart.
+func canonicalRelation(entryID, relatedID, kind string) relation {
+  if kind == d.Derivative || (d.Symmetric(kind) && compareIDs(entryID, relatedID) > 0) {
+    entryID, relatedID, kind = relatedID, entryID, d.Inverse(kind)
+  }
+  return relation{EntryID: entryID, RelatedID: relatedID, Type: kind}
+}
+
+// sortRelations orders relations by type and then headword.
+func sortRelations(relations []*d.Relation) {
+  sort.SliceStable(relations, func(i, j int) bool {
+    a, b := relations[i], relations[j]
+    if a.Type != b.Type {
+      return a.Type < b.Type
+    }
+    if a.Headword != b.Headword {
+      return a.Headword < b.Headword
+    }
+    return compareIDs(a.ID, b.ID) < 0
+  })
+}
+
+//---------------------------------------------------------
+//---- Snippets
+//---------------------------------------------------------
+
+// Delimiters of the matching words in a snippet until it is escaped, from
+// Unicode's private use area so that they can't be confused with any text.
+const (
+  markStart = "\ue000"
+  markStop  = "\ue001"
+)
+
+var markReplacer = strings.NewReplacer(markStart, "<mark>", markStop, "</mark>")
+
+// markSnippet escapes a snippet of a definition for HTML, since definitions
+// are written by users, and then wraps the words between markStart and
+// markStop in <mark></mark>.
+func markSnippet(snippet string) string {
+  return markReplacer.Replace(html.EscapeString(snippet))
+}
+
+//---------------------------------------------------------
+//---- Conversion
+//---------------------------------------------------------
+
+// Given a variadic d.Entry(s) with database identifiers,
+// returns list of same entries with human names instead
+func asOutgoing(entries ...*d.Entry) ([]*d.Entry, error) {
+  for _, entry := range entries {
+    entry.Normalize()
+    wordtype, err := data.WordtypeName(entry.Wordtype)
+    if err != nil {
+      return entries, err
+    }
+    headwordLanguage, err := data.LocaleCode(entry.Headword_Language)
+    if err != nil {
+      return entries, err
+    }
+    definitionLanguage, err := data.LocaleCode(entry.Definition_Language)
+    if err != nil {
+      return entries, err
+    }
+    for _, sense := range entry.Senses {
+      if sense.Wordtype == "" {
+        continue
+      }
+      if sense.Wordtype, err = data.WordtypeName(sense.Wordtype); err != nil {
+        return entries, err
+      }
+    }
+    for _, audio := range entry.Audio {
+      audio.URL = audioURL(audio.ID)
+    }
+    if err := outgoingRelations(entry.Relations...); err != nil {
+      return entries, err
+    }
+    entry.Wordtype = wordtype
+    entry.Headword_Language = headwordLanguage
+    entry.Definition_Language = definitionLanguage
+  }
+  return entries, nil
+}
+
+// outgoingRelations gives relations the language code of the related entry.
+func outgoingRelations(relations ...*d.Relation) error {
+  for _, r := range relations {
+    code, err := data.LocaleCode(r.Language)
+    if err != nil {
+      return err
+    }
+    r.Language = code
+  }
+  return nil
+}
+
+// unknownNameError is returned by asIncoming for a wordtype or language that
+// doesn't exist, naming it and the field it was given in so that it can be
+// reported back to the client.
+type unknownNameError struct {
+  kind, field, name string
+}
+
+func (e *unknownNameError) Error() string {
+  return "unknown " + e.kind + " " + strconv.Quote(e.name)
+}
+
+// resolve looks up the identifier of a wordtype or language by its name,
+// given in field.
+func resolve(kind, field, name string, lookup func(string) (string, error)) (string, error) {
+  id, err := lookup(name)
+  if err == sql.ErrNoRows {
+    return "", &unknownNameError{kind, field, name}
+  }
+  return id, err
+}
+
+// normalizeText puts the text of an entry in the form it is stored in, see
+// normalize.Text.
+func normalizeText(e *d.Entry) {
+  e.Headword = normalize.Text(strings.TrimSpace(e.Headword))
+  e.Definition = normalize.Text(e.Definition)
+  e.Etymology = normalize.Text(e.Etymology)
+  for _, sense := range e.Senses {
+    sense.Definition = normalize.Text(sense.Definition)
+    for _, example := range sense.Examples {
+      example.Text = normalize.Text(example.Text)
+      example.Translation = normalize.Text(example.Translation)
+    }
+  }
+}
+
+// Given a variadic d.Entry(s) with human names,
+// returns list of same entries with database identifiers instead.
+// Flat entries are given a single sense, see d.Entry.Normalize.
+func asIncoming(entries ...*d.Entry) ([]*d.Entry, error) {
+  for _, entry := range entries {
+    flat := len(entry.Senses) == 0
+    normalizeText(entry)
+    entry.Normalize()
+    headwordLanguage, err := resolve("language", "hw_lang", entry.Headword_Language, data.LocaleID)
+    if err != nil {
+      return entries, err
+    }
+    definitionLanguage, err := resolve("language", "def_lang", entry.Definition_Language, data.LocaleID)
+    if err != nil {
+      return entries, err
+    }
+    for i, sense := range entry.Senses {
+      field := "senses[" + strconv.Itoa(i) + "].wordtype"
+      if flat {
+        field = "wordtype"
+      }
+      if sense.Wordtype, err = resolve("wordtype", field, sense.Wordtype, data.WordtypeID); err != nil {
+        return entries, err
+      }
+    }
+    wordtype, err := resolve("wordtype", "wordtype", entry.Wordtype, data.WordtypeID)
+    if err != nil {
+      return entries, err
+    }
+    entry.Wordtype = wordtype
+    entry.Headword_Language = headwordLanguage
+    entry.Definition_Language = definitionLanguage
+  }
+  return entries, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+/*
+  translit converts text between the orthographies Western Yugur is written
+  in. Every scheme is defined by a table of rules pairing letters of the
+  canonical Latin orthography with how the scheme writes them, so text is
+  converted by way of the canonical orthography. Letters without a rule are
+  left as they are.
+*/
+package translit
+
+import (
+  "errors"
+  "sort"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+
+  "golang.org/x/text/unicode/norm"
+)
+
+// Canonical is the scheme text is converted through, and in which entries
+// are stored.
+const Canonical = "latin"
+
+// ErrUnknownScheme is raised for schemes that aren't defined.
+var ErrUnknownScheme = errors.New("unknown orthography")
+
+// Directions in which a rule applies
+const (
+  both = iota
+  // Only when writing canonical text in the scheme
+  encodeOnly
+  // Only when reading text in the scheme, e.g. for variant spellings
+  decodeOnly
+)
+
+// rule pairs a canonical spelling with how a scheme writes it.
+type rule struct {
+  canonical string
+  written   string
+  direction int
+}
+
+// Scheme is an orthography.
+type Scheme struct {
+  Name        string `json:"name"`
+  Description string `json:"description"`
+  // Rules for encoding and decoding, longest match first
+  encode, decode []rule
+}
+
+var schemes = map[string]*Scheme{}
+
+func define(name, description string, rules []rule) {
+  s := &Scheme{Name: name, Description: description}
+  for _, r := range rules {
+    if r.direction != decodeOnly {
+      s.encode = append(s.encode, r)
+    }
+    if r.direction != encodeOnly {
+      s.decode = append(s.decode, r)
+    }
+  }
+  // Stable so that the first of rules of the same length wins
+  sort.SliceStable(s.encode, func(i, j int) bool {
+    return utf8.RuneCountInString(s.encode[i].canonical) > utf8.RuneCountInString(s.encode[j].canonical)
+  })
+  sort.SliceStable(s.decode, func(i, j int) bool {
+    return utf8.RuneCountInString(s.decode[i].written) > utf8.RuneCountInString(s.decode[j].written)
+  })
+  schemes[name] = s
+}
+
+func init() {
+  define(Canonical, "Latin orthography with Turkic letters, the canonical orthography", []rule{
+    {"ı", "ï", decodeOnly},
+    {"ň", "ñ", decodeOnly},
+    {"ň", "ŋ", decodeOnly},
+  })
+
+  define("cyrillic", "Cyrillic orthography", []rule{
+    {"ya", "я", both}, {"yu", "ю", both}, {"yo", "ё", both}, {"ts", "ц", both},
+    {"a", "а", both}, {"b", "б", both}, {"ç", "ч", both}, {"d", "д", both},
+    {"e", "е", both}, {"f", "ф", both}, {"g", "г", both}, {"ğ", "ғ", both},
+    {"h", "һ", both}, {"ı", "ы", both}, {"i", "и", both}, {"j", "ж", both},
+    {"k", "к", both}, {"l", "л", both}, {"m", "м", both}, {"n", "н", both},
+    {"ň", "ң", both}, {"o", "о", both}, {"ö", "ө", both}, {"p", "п", both},
+    {"q", "қ", both}, {"r", "р", both}, {"s", "с", both}, {"ş", "ш", both},
+    {"t", "т", both}, {"u", "у", both}, {"ü", "ү", both}, {"v", "в", both},
+    {"x", "х", both}, {"y", "й", both}, {"z", "з", both},
+    {"c", "ц", encodeOnly}, {"w", "в", encodeOnly},
+    {"e", "э", decodeOnly}, {"i", "і", decodeOnly}, {"u", "ұ", decodeOnly},
+    {"şç", "щ", decodeOnly}, {"", "ъ", decodeOnly}, {"", "ь", decodeOnly},
+  })
+
+  define("ascii", "Latin orthography without diacritics, for plain keyboards; ı is written i and can't be told apart from it", []rule{
+    {"ç", "ch", both}, {"ş", "sh", both}, {"ğ", "gh", both}, {"ň", "ng", both},
+    {"ö", "oe", both}, {"ü", "ue", both},
+    {"ı", "i", encodeOnly},
+  })
+
+  define("ipa", "International Phonetic Alphabet, phonemic", []rule{
+    {"ç", "tʃ", both}, {"j", "dʒ", both},
+    {"a", "a", both}, {"b", "b", both}, {"d", "d", both}, {"e", "e", both},
+    {"f", "f", both}, {"g", "ɡ", both}, {"ğ", "ʁ", both}, {"h", "h", both},
+    {"ı", "ɯ", both}, {"i", "i", both}, {"k", "k", both}, {"l", "l", both},
+    {"m", "m", both}, {"n", "n", both}, {"ň", "ŋ", both}, {"o", "o", both},
+    {"ö", "ø", both}, {"p", "p", both}, {"q", "q", both}, {"r", "r", both},
+    {"s", "s", both}, {"ş", "ʃ", both}, {"t", "t", both}, {"u", "u", both},
+    {"ü", "y", both}, {"v", "v", both}, {"w", "w", both}, {"x", "χ", both},
+    {"y", "j", both}, {"z", "z", both},
+    {"c", "ts", encodeOnly},
+    {"g", "g", decodeOnly}, {"h", "ʰ", decodeOnly}, {"", "ː", decodeOnly},
+  })
+}
+
+// Schemes returns every scheme, ordered by name.
+func Schemes() []*Scheme {
+  list := make([]*Scheme, 0, len(schemes))
+  for _, s := range schemes {
+    list = append(list, s)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+  return list
+}
+
+// Valid reports whether a scheme is defined.
+func Valid(name string) bool {
+  _, ok := schemes[name]
+  return ok
+}
+
+// Convert transliterates text from one scheme to another. Capitalized
+// letters stay capitalized.
+func Convert(text, from, to string) (string, error) {
+  source, ok := schemes[from]
+  if !ok {
+    return "", ErrUnknownScheme
+  }
+  target, ok := schemes[to]
+  if !ok {
+    return "", ErrUnknownScheme
+  }
+
+  text = norm.NFC.String(text)
+  if from == to {
+    return text, nil
+  }
+  canonical := apply(text, source.decode, func(r rule) (string, string) { return r.written, r.canonical })
+  return apply(canonical, target.encode, func(r rule) (string, string) { return r.canonical, r.written }), nil
+}
+
+// apply rewrites text by the rules, trying the longest first at each
+// position. sides gives what a rule matches and what it is replaced with.
+func apply(text string, rules []rule, sides func(rule) (string, string)) string {
+  runes := []rune(text)
+  lower := make([]rune, len(runes))
+  for i, r := range runes {
+    lower[i] = unicode.ToLower(r)
+  }
+
+  var b strings.Builder
+  for i := 0; i < len(runes); {
+    matched := false
+    for _, r := range rules {
+      match, replacement := sides(r)
+      n := utf8.RuneCountInString(match)
+      if n == 0 || i+n > len(runes) || string(lower[i:i+n]) != match {
+        continue
+      }
+      if unicode.IsUpper(runes[i]) {
+        replacement = capitalize(replacement, i+n < len(runes) && unicode.IsUpper(runes[i+n]) || n > 1 && unicode.IsUpper(runes[i+1]))
+      }
+      b.WriteString(replacement)
+      i += n
+      matched = true
+      break
+    }
+    if !matched {
+      b.WriteRune(runes[i])
+      i++
+    }
+  }
+  return norm.NFC.String(b.String())
+}
+
+// capitalize uppercases the first letter of s, or all of it if the text
+// around it is all in capitals.
+func capitalize(s string, all bool) string {
+  if all {
+    return strings.ToUpper(s)
+  }
+  r, n := utf8.DecodeRuneInString(s)
+  return string(unicode.ToUpper(r)) + s[n:]
+}
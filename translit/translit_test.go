@@ -0,0 +1,68 @@
+package translit
+
+import (
+  "testing"
+)
+
+func TestConvert(t *testing.T) {
+  tables := []struct {
+    text     string
+    from     string
+    to       string
+    expected string
+  }{
+    {"öt", "latin", "cyrillic", "өт"},
+    {"Öt jandı", "latin", "cyrillic", "Өт жанды"},
+    {"yaş", "latin", "cyrillic", "яш"},
+    {"ŞAR", "latin", "cyrillic", "ШАР"},
+    {"Яш", "cyrillic", "latin", "Yaş"},
+    {"съел", "cyrillic", "latin", "sel"},
+    {"çoğ", "latin", "ascii", "chogh"},
+    {"chogh", "ascii", "latin", "çoğ"},
+    {"qızıl", "latin", "ascii", "qizil"},
+    {"çay", "latin", "ipa", "tʃaj"},
+    {"tʃaj", "ipa", "latin", "çay"},
+    {"ʰtʃaː", "ipa", "latin", "hça"},
+    {"öt", "ipa", "cyrillic", "өт"},
+    // Variant Latin spellings are read as the canonical letters
+    {"qïzïl", "latin", "latin", "qïzïl"},
+    {"qïzïl", "latin", "cyrillic", "қызыл"},
+    // Letters without a rule are kept
+    {"fire 1", "latin", "cyrillic", "фире 1"},
+    {"世界", "cyrillic", "latin", "世界"},
+    // NFD input
+    {"öt", "latin", "cyrillic", "өт"},
+  }
+
+  for _, table := range tables {
+    result, err := Convert(table.text, table.from, table.to)
+    if err != nil {
+      t.Fatalf("Convert(%q, %s, %s) failed: %v", table.text, table.from, table.to, err)
+    }
+    if result != table.expected {
+      t.Errorf("Convert(%q, %s, %s) was incorrect. Expected: %q, got: %q.", table.text, table.from, table.to, table.expected, result)
+    }
+  }
+}
+
+func TestRoundTrip(t *testing.T) {
+  words := []string{"öt", "jandı", "şar", "yaş", "çoğ", "ňa", "xatun", "qızıl"}
+  for _, scheme := range []string{"cyrillic", "ipa"} {
+    for _, word := range words {
+      written, _ := Convert(word, Canonical, scheme)
+      back, _ := Convert(written, scheme, Canonical)
+      if back != word {
+        t.Errorf("%q became %q in %s and %q again.", word, written, scheme, back)
+      }
+    }
+  }
+}
+
+func TestUnknownScheme(t *testing.T) {
+  if _, err := Convert("öt", "latin", "runic"); err != ErrUnknownScheme {
+    t.Errorf("Expected: ErrUnknownScheme, got: %v", err)
+  }
+  if Valid("runic") || !Valid("cyrillic") {
+    t.Errorf("Valid was incorrect")
+  }
+}
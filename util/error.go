@@ -6,39 +6,113 @@
 package util
 
 import (
+	"encoding/json"
+	"log/slog"
 	"net/http"
-	"log"
 )
 
+// ProblemContentType is the media type of problem details, see RFC 7807.
+const ProblemContentType = "application/problem+json"
+
+// RequestIDHeader carries the identifier of a request, which is repeated in
+// the response and in any problem reported for it.
+const RequestIDHeader = "X-Request-ID"
+
+// Problem codes. These are part of the API and must not change.
+const (
+	CodeBadRequest           = "bad_request"
+	CodeInvalidParameter     = "invalid_parameter"
+	CodeInvalidBody          = "invalid_body"
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeConflict             = "conflict"
+	CodeTooLarge             = "too_large"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeInternal             = "internal_error"
+	CodeNotImplemented       = "not_implemented"
+)
+
+/*
+	Problem is an API error, written as RFC 7807 problem details. Type is a
+	URI made from Code, which clients should use to tell problems apart;
+	Detail is for people and may change. Problems with the fields of a
+	request are listed in Fields.
+*/
+type Problem struct {
+	Type      string  `json:"type"`
+	Title     string  `json:"title"`
+	Status    int     `json:"status"`
+	Code      string  `json:"code"`
+	Detail    string  `json:"detail,omitempty"`
+	Instance  string  `json:"instance,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+	Fields    []Field `json:"fields,omitempty"`
+	// What caused an internal error, which is logged but not shown
+	Cause     error   `json:"-"`
+}
+
+// Field is a problem with one field of a request: a parameter, or a member
+// of the body given as a path such as "senses[0].wordtype".
+type Field struct {
+	Name    string `json:"name"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Field problem codes
 const (
-	// Internal API error codes
-	FatalError = 1
+	FieldRequired = "required"
+	FieldInvalid  = "invalid"
+	FieldUnknown  = "unknown"
 )
 
-func getRequestMessage(r *http.Request) string {
-	return r.Method + " " + r.URL.String()
-}
-
-func Error(e int, msg string, w http.ResponseWriter) {
-	if w != nil {
-		http.Error(w, http.StatusText(e), e)
-		log.Println(msg)
-	} else {
-		switch (e) {
-		case FatalError:
-			log.Fatal(msg)
-		default:
-			log.Println(msg)
-		}
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return p.Title
 	}
+	return p.Title + ": " + p.Detail
 }
 
-//---------------------------------------------------------
-//---- API Errors 
-//---------------------------------------------------------
+// NewProblem returns a problem with the given status, code and detail.
+func NewProblem(status int, code, detail string, fields ...Field) *Problem {
+	return &Problem{
+		Type:   "urn:yugur:problem:" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+		Fields: fields,
+	}
+}
 
-func Fatal() (int, string, http.ResponseWriter) {
-	return FatalError, "Fatal Error", nil
+// WriteProblem responds to r with p as problem details and logs it, as an
+// error if it is the server's fault.
+func WriteProblem(w http.ResponseWriter, r *http.Request, p *Problem) {
+	p.Instance = r.URL.Path
+	p.RequestID = RequestID(r.Context())
+
+	attrs := []any{"status", p.Status, "code", p.Code, "method", r.Method, "url", r.URL.String()}
+	if p.Detail != "" {
+		attrs = append(attrs, "detail", p.Detail)
+	}
+	if p.Cause != nil {
+		attrs = append(attrs, "error", p.Cause.Error())
+	}
+	level := slog.LevelInfo
+	if p.Status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	Logger(r.Context()).Log(r.Context(), level, p.Title, attrs...)
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		Logger(r.Context()).Error("writing problem failed", "error", err)
+	}
 }
 
 //---------------------------------------------------------
@@ -46,38 +120,69 @@ func Fatal() (int, string, http.ResponseWriter) {
 //---------------------------------------------------------
 
 //----
-//---- 2xx
+//---- 4xx
 //----
 
-// HTTP 200 OK
-func OK(w http.ResponseWriter, r *http.Request) (int, string, http.ResponseWriter) {
-	return http.StatusOK, http.StatusText(http.StatusOK) + " (" + getRequestMessage(r) + ")", w
+// HTTP 400 Bad Request
+func BadRequest(code, detail string, fields ...Field) *Problem {
+	return NewProblem(http.StatusBadRequest, code, detail, fields...)
 }
 
-//----
-//---- 4xx
-//----
+// InvalidParameter is a 400 Bad Request for a single query or form parameter.
+func InvalidParameter(name, code, message string) *Problem {
+	return BadRequest(CodeInvalidParameter, message, Field{name, code, message})
+}
 
-// HTTP 400 Bad Request
-func BadRequest(w http.ResponseWriter, r *http.Request) (int, string, http.ResponseWriter) {
-	return http.StatusBadRequest, http.StatusText(http.StatusBadRequest) + " (" + getRequestMessage(r) + ")", w
+// HTTP 401 Unauthorized
+func Unauthorized(detail string) *Problem {
+	return NewProblem(http.StatusUnauthorized, CodeUnauthorized, detail)
+}
+
+// HTTP 403 Forbidden
+func Forbidden(detail string) *Problem {
+	return NewProblem(http.StatusForbidden, CodeForbidden, detail)
 }
 
 // HTTP 404 Not Found
-func NotFound(w http.ResponseWriter, r *http.Request) (int, string, http.ResponseWriter) {
-	return http.StatusNotFound, http.StatusText(http.StatusNotFound) + " (" + getRequestMessage(r) + ")", w
+func NotFound(detail string) *Problem {
+	return NewProblem(http.StatusNotFound, CodeNotFound, detail)
+}
+
+// HTTP 405 Method Not Allowed
+func MethodNotAllowed(r *http.Request) *Problem {
+	return NewProblem(http.StatusMethodNotAllowed, CodeMethodNotAllowed, r.Method+" is not supported here")
+}
+
+// HTTP 409 Conflict
+func Conflict(detail string) *Problem {
+	return NewProblem(http.StatusConflict, CodeConflict, detail)
+}
+
+// HTTP 413 Request Entity Too Large
+func TooLarge(detail string) *Problem {
+	return NewProblem(http.StatusRequestEntityTooLarge, CodeTooLarge, detail)
+}
+
+// HTTP 415 Unsupported Media Type
+func UnsupportedMediaType(detail string) *Problem {
+	return NewProblem(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, detail)
 }
 
 //----
 //---- 5xx
 //----
 
-// HTTP 500 Internal Server Error
-func Internal(w http.ResponseWriter, r *http.Request) (int, string, http.ResponseWriter) {
-	return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError) + " (" + getRequestMessage(r) + ")", w
+// HTTP 500 Internal Server Error. The cause, if given, is logged rather than
+// shown to clients.
+func Internal(cause ...error) *Problem {
+	p := NewProblem(http.StatusInternalServerError, CodeInternal, "")
+	if len(cause) > 0 {
+		p.Cause = cause[0]
+	}
+	return p
 }
 
 // HTTP 501 Not Implemented
-func NotImplemented(w http.ResponseWriter, r *http.Request) (int, string, http.ResponseWriter) {
-	return http.StatusNotImplemented, http.StatusText(http.StatusNotImplemented) + " (" + getRequestMessage(r) + ")", w
-}
\ No newline at end of file
+func NotImplemented() *Problem {
+	return NewProblem(http.StatusNotImplemented, CodeNotImplemented, "")
+}
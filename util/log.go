@@ -0,0 +1,65 @@
+// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// util provides additional logging/benchmarking tools.
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"log/slog"
+)
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+/*
+	SetupLogging makes a JSON logger writing to w the default, for both slog
+	and the log package. Records are written from the info level, or from the
+	debug level if verbose. Messages written with the log package are logged
+	at the info level.
+*/
+func SetupLogging(w io.Writer, verbose bool) {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+	// slog.SetDefault points the log package at the handler, which adds its
+	// own time
+	log.SetFlags(0)
+}
+
+// NewRequestID returns a random identifier for a request.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID returns a copy of ctx carrying the identifier of a request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the identifier of the request ctx belongs to, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Logger returns the default logger, tagging records with the identifier of
+// the request ctx belongs to.
+func Logger(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
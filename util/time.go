@@ -1,16 +0,0 @@
-// Copyright 2017 The Yugur RESTful API Authors. All rights reserved.
-// Use of this source code is governed by an MIT-style
-// license that can be found in the LICENSE file.
-
-// util provides additional logging/benchmarking tools.
-package util
-
-import (
-  "time"
-  "log"
-)
-
-func TrackTime(start time.Time, name string) {
-  elapsed := time.Since(start)
-  log.Printf("%s took %s", name, elapsed)
-}